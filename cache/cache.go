@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile is held shared by every running container with --cache and exclusively by prune
+const lockFile = ".lock"
+
+// installLockFile inside an exclusive cache is held by the install filling it
+const installLockFile = ".otala-install.lock"
+
+// Ecosystem is a package manager whose download cache --cache shares between containers
+type Ecosystem struct {
+	Name string
+	// Destination is where the cache is mounted in the container
+	Destination string
+	// Env points the package manager at Destination
+	Env []string
+	// Requires is a path the image must have for the cache to be mounted, empty for always
+	Requires string
+	// Link is created as a symlink to Destination when the image does not have it yet
+	Link string
+	// Tool is the install command of the dependency phase that uses the cache
+	Tool string
+	// Exclusive caches are not safe to fill from several containers at once, so installs
+	// into them take turns
+	Exclusive bool
+}
+
+// Ecosystems are the caches --cache mounts
+var Ecosystems = []Ecosystem{
+	{
+		Name:        "pip",
+		Destination: "/var/cache/otala/pip",
+		Env:         []string{"PIP_CACHE_DIR=/var/cache/otala/pip"},
+		Tool:        "pip",
+	},
+	{
+		Name:        "npm",
+		Destination: "/var/cache/otala/npm",
+		Env:         []string{"npm_config_cache=/var/cache/otala/npm"},
+		Tool:        "npm",
+	},
+	{
+		// yarn 1 writes its cache without any locking between processes
+		Name:        "yarn",
+		Destination: "/var/cache/otala/yarn",
+		Env:         []string{"YARN_CACHE_FOLDER=/var/cache/otala/yarn"},
+		Tool:        "yarn",
+		Exclusive:   true,
+	},
+	{
+		Name:        "gomod",
+		Destination: "/var/cache/otala/gomod",
+		Env:         []string{"GOMODCACHE=/var/cache/otala/gomod"},
+		Tool:        "go",
+	},
+	{
+		Name:        "apk",
+		Destination: "/var/cache/apk",
+		Requires:    "/etc/apk",
+		Link:        "/etc/apk/cache",
+	},
+}
+
+// Find returns the ecosystem called name
+func Find(name string) (*Ecosystem, error) {
+	for i := range Ecosystems {
+		if Ecosystems[i].Name == name {
+			return &Ecosystems[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no such cache: %s", name)
+}
+
+// ForTool returns the ecosystem whose cache an install command fills, or nil
+func ForTool(tool string) *Ecosystem {
+	for i := range Ecosystems {
+		if Ecosystems[i].Tool != "" && Ecosystems[i].Tool == filepath.Base(tool) {
+			return &Ecosystems[i]
+		}
+	}
+	return nil
+}
+
+// Root returns the host directory holding every cache, creating it and the cache directories
+func Root() (string, error) {
+	dataDir, _, err := runConfig.RuntimePaths()
+	if err != nil {
+		return "", err
+	}
+	root := filepath.Join(dataDir, "caches")
+	for _, ecosystem := range Ecosystems {
+		if err := os.MkdirAll(filepath.Join(root, ecosystem.Name), 0755); err != nil {
+			return "", fmt.Errorf("failed to create cache directory: %v", err)
+		}
+	}
+	return root, nil
+}
+
+// lock flocks path, returning its release. Without wait it fails at once when the lock is taken.
+func lock(path string, exclusive, wait bool) (func(), error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+	for {
+		err = unix.Flock(int(file.Fd()), how)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		_ = unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// Use marks the caches under root as in use by a running container until the release is called
+func Use(root string) (func(), error) {
+	release, err := lock(filepath.Join(root, lockFile), false, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock caches: %v", err)
+	}
+	return release, nil
+}
+
+// LockInstall takes the turn of an install into an exclusive cache mounted at destination,
+// waiting for installs in other containers to finish
+func LockInstall(destination string) (func(), error) {
+	release, err := lock(filepath.Join(destination, installLockFile), true, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock cache %s: %v", destination, err)
+	}
+	return release, nil
+}
+
+// Usage is the size of a cache on the host
+type Usage struct {
+	Ecosystem
+	Path string
+	Size uint64
+}
+
+// List returns the size of every cache under root
+func List(root string) []Usage {
+	usage := make([]Usage, 0, len(Ecosystems))
+	for _, ecosystem := range Ecosystems {
+		path := filepath.Join(root, ecosystem.Name)
+		size, _ := utils.DirSize(path)
+		usage = append(usage, Usage{Ecosystem: ecosystem, Path: path, Size: size})
+	}
+	return usage
+}
+
+// InUse reports whether a running container has the caches under root mounted
+func InUse(root string) bool {
+	release, err := lock(filepath.Join(root, lockFile), true, false)
+	if err != nil {
+		return true
+	}
+	release()
+	return false
+}
+
+// Prune empties the named caches under root, every cache when names is empty, and returns the
+// space freed. It refuses while a container has the caches mounted.
+func Prune(root string, names []string) (uint64, error) {
+	ecosystems := Ecosystems
+	if len(names) > 0 {
+		ecosystems = nil
+		for _, name := range names {
+			ecosystem, err := Find(name)
+			if err != nil {
+				return 0, err
+			}
+			ecosystems = append(ecosystems, *ecosystem)
+		}
+	}
+
+	release, err := lock(filepath.Join(root, lockFile), true, false)
+	if err != nil {
+		return 0, fmt.Errorf("the caches are in use by a running container, try again once it exits")
+	}
+	defer release()
+
+	var freed uint64
+	for _, ecosystem := range ecosystems {
+		path := filepath.Join(root, ecosystem.Name)
+		size, _ := utils.DirSize(path)
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return freed, err
+		}
+		for _, entry := range entries {
+			if err := makeWritable(filepath.Join(path, entry.Name())); err != nil {
+				return freed, err
+			}
+			if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+				return freed, fmt.Errorf("failed to prune %s cache: %v", ecosystem.Name, err)
+			}
+		}
+		if after, _ := utils.DirSize(path); after < size {
+			freed += size - after
+		}
+	}
+	return freed, nil
+}
+
+// makeWritable gives the owner write access to every directory under path. The Go module cache
+// makes its directories read-only, which would stop RemoveAll.
+func makeWritable(path string) error {
+	return filepath.WalkDir(path, func(walkPath string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm()&0200 == 0 {
+			return os.Chmod(walkPath, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/image"
+	"github.com/Simeon2001/AlpineCell/isolator"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"github.com/Simeon2001/AlpineCell/namespace"
+	"github.com/Simeon2001/AlpineCell/systemd"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// buildMemory is the memory limit of RUN steps unless --memory is given
+const buildMemory = 1024 * 1024 * 1024
+
+// buildStepRequest is what a build hands the build-step helper running one RUN instruction
+type buildStepRequest struct {
+	ID        string              `json:"id"`
+	Config    runConfig.RunConfig `json:"config"`
+	LowerDirs []string            `json:"lowerDirs"`
+}
+
+// buildCommitRequest is what a build hands the build-commit helper. Without a key it only removes
+// the leftovers of a step.
+type buildCommitRequest struct {
+	Key         string   `json:"key,omitempty"`
+	Instruction string   `json:"instruction,omitempty"`
+	Parent      []string `json:"parent,omitempty"`
+	Upper       string   `json:"upper,omitempty"`
+	Strip       []string `json:"strip,omitempty"`
+	// Parents are directories COPY created in Upper to hold files, which take the metadata the
+	// parent layers give them
+	Parents []string              `json:"parents,omitempty"`
+	Config  runConfig.ImageConfig `json:"config"`
+	Remove  []string              `json:"remove,omitempty"`
+}
+
+// builder carries the image being built from one instruction to the next
+type builder struct {
+	store      *image.Store
+	contextDir string
+	ignore     *utils.IgnoreMatcher
+	scratch    string
+	noCache    bool
+	// container is the configuration RUN steps start from
+	container runConfig.RunConfig
+
+	layers []string
+	config runConfig.ImageConfig
+	key    string
+}
+
+// buildImage builds an image from an Otalafile, reusing the cached result of every step whose
+// instruction, inputs and preceding steps are unchanged
+func buildImage(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	tag := cmd.String("tag")
+	if tag == "" {
+		return fmt.Errorf("--tag is required")
+	}
+	if cmd.Args().Len() > 1 {
+		return fmt.Errorf("usage: otala-box build [context] -t <name>")
+	}
+	if tag == image.EmbeddedImage {
+		return fmt.Errorf("%q is reserved for the built-in Alpine rootfs", image.EmbeddedImage)
+	}
+
+	contextDir, err := filepath.Abs(cmd.Args().First())
+	if err != nil {
+		return err
+	}
+	if !dirExists(contextDir) {
+		return fmt.Errorf("build context %s is not a directory", contextDir)
+	}
+	otalafile := cmd.String("file")
+	if otalafile == "" {
+		otalafile = filepath.Join(contextDir, "Otalafile")
+	}
+	instructions, err := parseOtalafile(otalafile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", otalafile, err)
+	}
+
+	resources, err := parseResources(cmd, runConfig.Resources{Memory: buildMemory})
+	if err != nil {
+		return err
+	}
+	if err := resources.Validate(); err != nil {
+		return err
+	}
+	shmSize, err := runConfig.ParseSize(cmd.String("shm-size"))
+	if err != nil || shmSize == 0 {
+		return fmt.Errorf("invalid --shm-size %q", cmd.String("shm-size"))
+	}
+
+	patterns, err := utils.ReadIgnorePatterns(contextDir, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", utils.IgnoreFileName, err)
+	}
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+	dataDir, _, err := runConfig.RuntimePaths()
+	if err != nil {
+		return err
+	}
+	buildID, err := generateUniqueID()
+	if err != nil {
+		return err
+	}
+	release, err := lockBuilds(dataDir, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	scratch := filepath.Join(dataDir, "build", buildID)
+	if err := os.MkdirAll(scratch, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	b := &builder{
+		store:      store,
+		contextDir: contextDir,
+		ignore:     utils.NewIgnoreMatcher(patterns),
+		scratch:    scratch,
+		noCache:    cmd.Bool("no-cache"),
+		container: runConfig.RunConfig{
+			Network:      cmd.Bool("net"),
+			Resources:    resources,
+			CgroupParent: cmd.String("cgroup-parent"),
+			ShmSize:      shmSize,
+		},
+	}
+
+	color.New(color.FgYellow, color.Bold).Printf("🏺 Building %s from %s\n", tag, otalafile)
+	for i, instruction := range instructions {
+		color.New(color.FgCyan).Printf("Step %d/%d: %s\n", i+1, len(instructions), instruction)
+		if err := b.step(instruction); err != nil {
+			return err
+		}
+	}
+
+	img, err := store.Tag(tag, b.layers, b.config, otalafile)
+	if err != nil {
+		return err
+	}
+	printImage(img)
+	return nil
+}
+
+// lockBuilds flocks <data>/build/.lock, held shared by every build while it runs so that system
+// prune, which takes it exclusively without waiting, leaves the containers of a build alone
+func lockBuilds(dataDir string, exclusive bool) (func(), error) {
+	if err := os.MkdirAll(filepath.Join(dataDir, "build"), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dataDir, "build", ".lock"), os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX | unix.LOCK_NB
+	}
+	for {
+		err = unix.Flock(int(file.Fd()), how)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		_ = unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// step applies one instruction to the image being built
+func (b *builder) step(instruction buildInstruction) error {
+	switch instruction.Command {
+	case "FROM":
+		return b.from(instruction)
+	case "RUN":
+		return b.run(instruction)
+	case "COPY":
+		return b.copy(instruction)
+	case "ENV":
+		pairs, err := envArgs(instruction)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			b.config.Env = setEnv(b.config.Env, pair)
+		}
+	case "WORKDIR":
+		b.config.WorkingDir = workDir(b.config.WorkingDir, instruction.Args)
+	case "CMD":
+		argv, err := commandArgv(instruction)
+		if err != nil {
+			return err
+		}
+		b.config.Cmd = argv
+	}
+	// Metadata only instructions add no layer but still change the key of every later step
+	b.key = stepKey(b.key, instruction.String())
+	return nil
+}
+
+// stepKey chains the cache key of a step to the key of the step before it
+func stepKey(parent string, parts ...string) string {
+	hash := sha256.New()
+	hash.Write([]byte(parent))
+	for _, part := range parts {
+		hash.Write([]byte{0})
+		hash.Write([]byte(part))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// from starts the build on a stored image or the embedded Alpine rootfs
+func (b *builder) from(instruction buildInstruction) error {
+	if instruction.Args == image.EmbeddedImage {
+		data, err := alpineFS.ReadFile("alpine-minirootfs.tar.gz")
+		if err != nil {
+			return err
+		}
+		lower, err := b.store.EmbeddedLayer(data)
+		if err != nil {
+			return err
+		}
+		digest, err := b.store.LayerDigest(lower)
+		if err != nil {
+			return err
+		}
+		b.layers = []string{digest}
+		b.config = runConfig.ImageConfig{}
+		b.key = stepKey("", instruction.String(), digest)
+		return nil
+	}
+
+	img, err := b.store.Resolve(instruction.Args)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", instruction.Line, err)
+	}
+	config, err := json.Marshal(img.Config)
+	if err != nil {
+		return err
+	}
+	b.layers = img.Layers
+	b.config = img.Config
+	b.key = stepKey("", instruction.String(), strings.Join(img.Layers, ","), string(config))
+	return nil
+}
+
+// cached moves the build on to the recorded result of key, reporting whether there was one
+func (b *builder) cached(key string) (bool, error) {
+	if b.noCache {
+		return false, nil
+	}
+	step, err := b.store.CachedStep(key)
+	if err != nil || step == nil {
+		return false, err
+	}
+	color.New(color.FgGreen).Println("    Using cache")
+	b.layers = step.Layers
+	b.config = step.Config
+	b.key = key
+	return true, nil
+}
+
+// run executes a RUN instruction in a container on the layers built so far and commits what it
+// changed as a new layer
+func (b *builder) run(instruction buildInstruction) error {
+	argv, err := commandArgv(instruction)
+	if err != nil {
+		return err
+	}
+	key := stepKey(b.key, instruction.String())
+	if hit, err := b.cached(key); hit || err != nil {
+		return err
+	}
+
+	lowers, err := b.store.ChainLowerDirs(b.layers, "the build")
+	if err != nil {
+		return err
+	}
+	id, err := generateUniqueID()
+	if err != nil {
+		return err
+	}
+	dataDir, configDir, err := runConfig.RuntimePaths()
+	if err != nil {
+		return err
+	}
+	name := runConfig.ContainerPrefix + id
+
+	config := b.container
+	config.ImageConfig = runConfig.ImageConfig{
+		Env:        b.config.Env,
+		WorkingDir: workDir(b.config.WorkingDir, "."),
+		Cmd:        argv,
+	}
+	config.StatsFile = filepath.Join(b.scratch, id+"-exit.json")
+	requestPath := filepath.Join(b.scratch, id+".json")
+	if err := writeJSON(requestPath, buildStepRequest{ID: id, Config: config, LowerDirs: lowers}); err != nil {
+		return err
+	}
+
+	// The step stops its own scope when it is done, so its exit status says nothing; the exit
+	// code of the command is read from its stats file instead
+	step := exec.Command("/proc/self/exe", "build-step", requestPath)
+	step.Stdin = os.Stdin
+	step.Stdout = os.Stdout
+	step.Stderr = os.Stderr
+	_ = step.Run()
+
+	storage := filepath.Join(dataDir, "storage", name)
+	commit := buildCommitRequest{Remove: []string{storage, filepath.Join(configDir, name)}}
+	exitCode, err := stepExitCode(config.StatsFile)
+	if err != nil || exitCode != 0 {
+		if cleanupErr := b.commit(commit); cleanupErr != nil {
+			log.Printf("[⚠️] Failed to remove build container %s: %v", name, cleanupErr)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: RUN did not finish: %w", instruction.Line, err)
+		}
+		return fmt.Errorf("line %d: RUN exited with code %d", instruction.Line, exitCode)
+	}
+
+	commit.Key = key
+	commit.Instruction = instruction.String()
+	commit.Parent = b.layers
+	commit.Upper = filepath.Join(storage, "upper")
+	commit.Config = b.config
+	// Leave out what the runtime itself put in the container
+	commit.Strip = []string{isolator.ProjectDirPrefix + id, ".pivot_old"}
+	if config.Network {
+		commit.Strip = append(commit.Strip, "etc/resolv.conf")
+	}
+	return b.commit(commit)
+}
+
+// stepExitCode reads the exit code a RUN step recorded in its stats file
+func stepExitCode(statsFile string) (int, error) {
+	data, err := os.ReadFile(statsFile)
+	if err != nil {
+		return 0, err
+	}
+	var report struct {
+		ExitCode int `json:"exitCode"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return 0, err
+	}
+	return report.ExitCode, nil
+}
+
+// copy adds files from the build context as a new layer. The cache key covers the names, modes
+// and contents of the sources, not their times.
+func (b *builder) copy(instruction buildInstruction) error {
+	sources, dest, err := copyArgs(instruction)
+	if err != nil {
+		return err
+	}
+	intoDir := strings.HasSuffix(dest, "/") || len(sources) > 1
+	dest = workDir(b.config.WorkingDir, dest)
+
+	var matches []string
+	for _, source := range sources {
+		found, err := b.contextPaths(source)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", instruction.Line, err)
+		}
+		matches = append(matches, found...)
+	}
+	if len(matches) > 1 {
+		intoDir = true
+	}
+	digest, err := b.hashSources(matches)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", instruction.Line, err)
+	}
+	key := stepKey(b.key, instruction.String(), digest)
+	if hit, err := b.cached(key); hit || err != nil {
+		return err
+	}
+
+	id, err := generateUniqueID()
+	if err != nil {
+		return err
+	}
+	staging := filepath.Join(b.scratch, id)
+	upper := filepath.Join(staging, "upper")
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		return err
+	}
+	parents := make(map[string]bool)
+	copiedOnto := make(map[string]bool)
+	for _, match := range matches {
+		info, err := os.Lstat(match)
+		if err != nil {
+			return err
+		}
+		target := dest
+		if !info.IsDir() && intoDir {
+			target = path.Join(dest, filepath.Base(match))
+		}
+		if err := makeParents(upper, path.Dir(target), parents); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			copiedOnto[strings.TrimPrefix(target, "/")] = true
+		}
+		target = filepath.Join(upper, filepath.FromSlash(target))
+		rel, _ := filepath.Rel(b.contextDir, match)
+		opts := utils.CopyOptions{Merge: true, Ignore: b.ignore, IgnoreBase: filepath.ToSlash(rel)}
+		if err := utils.CopyTree(match, target, opts); err != nil {
+			return fmt.Errorf("line %d: failed to copy %s: %w", instruction.Line, rel, err)
+		}
+	}
+
+	var created []string
+	for dir := range parents {
+		// A directory a source directory was copied onto keeps what the copy gave it
+		if !copiedOnto[dir] {
+			created = append(created, dir)
+		}
+	}
+	sort.Strings(created)
+
+	return b.commit(buildCommitRequest{
+		Key:         key,
+		Instruction: instruction.String(),
+		Parent:      b.layers,
+		Upper:       upper,
+		Parents:     created,
+		Config:      b.config,
+		Remove:      []string{staging},
+	})
+}
+
+// makeParents creates the directories leading to dir, an absolute image path, inside upper and
+// adds those it made to created, relative to upper. They are made 0755 and owned by root; the
+// commit gives the ones the image already has their metadata from the parent layers.
+func makeParents(upper, dir string, created map[string]bool) error {
+	current := upper
+	rel := ""
+	for _, part := range strings.Split(strings.Trim(path.Clean(dir), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		rel = path.Join(rel, part)
+		current = filepath.Join(current, part)
+		if err := os.Mkdir(current, 0755); err == nil {
+			created[rel] = true
+		} else if !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// contextPaths expands a COPY source, which may be a glob, to paths inside the build context
+func (b *builder) contextPaths(source string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(b.contextDir, filepath.FromSlash(source)))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s matches nothing in the build context", source)
+	}
+	for _, match := range matches {
+		resolved, err := filepath.EvalSymlinks(match)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range []string{match, resolved} {
+			rel, err := filepath.Rel(b.contextDir, candidate)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return nil, fmt.Errorf("%s is outside the build context", source)
+			}
+		}
+	}
+	return matches, nil
+}
+
+// hashSources digests the names, modes, link targets and contents of the COPY sources, leaving
+// out what the context's .otalaignore matches
+func (b *builder) hashSources(sources []string) (string, error) {
+	hash := sha256.New()
+	for _, source := range sources {
+		rel, err := filepath.Rel(b.contextDir, source)
+		if err != nil {
+			return "", err
+		}
+		base := filepath.ToSlash(rel)
+		err = filepath.WalkDir(source, func(walkPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			sub, err := filepath.Rel(source, walkPath)
+			if err != nil {
+				return err
+			}
+			name := path.Join(base, filepath.ToSlash(sub))
+			if sub != "." && b.ignore.Match(name, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00%o\x00", name, info.Mode())
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(walkPath)
+				if err != nil {
+					return err
+				}
+				hash.Write([]byte(target))
+			case info.Mode().IsRegular():
+				file, err := os.Open(walkPath)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(hash, file)
+				file.Close()
+				if err != nil {
+					return err
+				}
+			}
+			hash.Write([]byte{0})
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// commit hands a step to the build-commit helper, which runs in the container user namespace
+// where the files of the step belong to the ids the image expects
+func (b *builder) commit(request buildCommitRequest) error {
+	id, err := generateUniqueID()
+	if err != nil {
+		return err
+	}
+	requestPath := filepath.Join(b.scratch, id+"-commit.json")
+	if err := writeJSON(requestPath, request); err != nil {
+		return err
+	}
+	helper := exec.Command("/proc/self/exe", "build-commit", requestPath)
+	helper.Stdout = os.Stdout
+	helper.Stderr = os.Stderr
+	if err := helper.Run(); err != nil {
+		return fmt.Errorf("failed to commit build step: %w", err)
+	}
+	if request.Key == "" {
+		return nil
+	}
+
+	step, err := b.store.CachedStep(request.Key)
+	if err != nil {
+		return err
+	}
+	if step == nil {
+		return fmt.Errorf("build step %s was not recorded", request.Instruction)
+	}
+	b.layers = step.Layers
+	b.config = step.Config
+	b.key = request.Key
+	return nil
+}
+
+// writeJSON writes v to a file only the current user can read
+func writeJSON(filePath string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0600)
+}
+
+// readJSON reads a file written by writeJSON
+func readJSON(filePath string, v interface{}) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// buildStep runs one RUN instruction of a build in a container of its own, the way run starts one
+func buildStep(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	var request buildStepRequest
+	if err := readJSON(cmd.Args().First(), &request); err != nil {
+		return fmt.Errorf("failed to read build step: %w", err)
+	}
+	config := request.Config
+	name := runConfig.ContainerPrefix + request.ID
+
+	err, _, cgroupPath := systemd.Manager(name, config.CgroupParent, false, config.Resources)
+	if err != nil {
+		return fmt.Errorf("systemd error: %w", err)
+	}
+	configData, err := loadConfig(&configJSONFile)
+	if err != nil {
+		return err
+	}
+	containerPath, containerConfigPath, configJSONData, err := namespace.SetupContainerEnvironment(name, configData, false, &alpineFS, request.LowerDirs)
+	if err != nil {
+		return fmt.Errorf("setting up build container: %w", err)
+	}
+	config.SetContainerConfig(request.ID, containerPath, containerConfigPath)
+	config.ContainerConfig.CgroupPath = cgroupPath
+
+	namespace.Stage1UserNS(&config, configJSONData)
+	return nil
+}
+
+// buildCommit stores the upper layer of a build step in the image store and removes what the
+// step left behind
+func buildCommit(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("usage: otala-box build-commit <request>")
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+	var request buildCommitRequest
+	if err := readJSON(cmd.Args().First(), &request); err != nil {
+		return fmt.Errorf("failed to read build commit: %w", err)
+	}
+	defer func() {
+		for _, dir := range request.Remove {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("[⚠️] Failed to remove %s: %v", dir, err)
+			}
+		}
+	}()
+	if request.Key == "" {
+		return nil
+	}
+
+	if dirExists(isolator.VFSPath(request.Upper)) {
+		return fmt.Errorf("the vfs storage driver keeps no separate upper layer, builds need overlay or fuse-overlayfs")
+	}
+	for _, strip := range request.Strip {
+		if err := os.RemoveAll(filepath.Join(request.Upper, strip)); err != nil {
+			return err
+		}
+	}
+
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+	if len(request.Parents) > 0 && len(request.Parent) > 0 {
+		lowers, err := store.ChainLowerDirs(request.Parent, "the build")
+		if err != nil {
+			return err
+		}
+		if err := image.InheritLowerDirs(request.Upper, lowers, request.Parents); err != nil {
+			return fmt.Errorf("%s: %w", request.Instruction, err)
+		}
+	}
+	_, err = store.CommitStep(request.Key, request.Instruction, request.Parent, request.Upper, request.Config)
+	return err
+}
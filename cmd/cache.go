@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Simeon2001/AlpineCell/cache"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"os"
+	"text/tabwriter"
+)
+
+// cacheCommand groups the commands managing the package manager caches shared with --cache
+func cacheCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "cache",
+		Usage: "Manage the package manager caches containers share with --cache",
+		Commands: []*cli.Command{
+			{
+				Name:    "ls",
+				Aliases: []string{"list"},
+				Usage:   "List the caches, where containers see them and their size",
+				Action:  listCaches,
+			},
+			{
+				Name:      "prune",
+				Usage:     "Empty the named caches, or all of them, when no running container uses them",
+				ArgsUsage: "[pip|npm|yarn|gomod|apk...]",
+				Action:    pruneCaches,
+			},
+		},
+	}
+}
+
+// listCaches prints every cache with its size
+func listCaches(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	root, err := cache.Root()
+	if err != nil {
+		return err
+	}
+
+	var total uint64
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMOUNTED AT\tSIZE")
+	for _, usage := range cache.List(root) {
+		total += usage.Size
+		fmt.Fprintf(w, "%s\t%s\t%s\n", usage.Name, usage.Destination, runConfig.FormatSize(usage.Size))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%s in %s", runConfig.FormatSize(total), root)
+	if cache.InUse(root) {
+		fmt.Print(", in use by a running container")
+	}
+	fmt.Println()
+	return nil
+}
+
+// pruneCaches empties caches to free their space
+func pruneCaches(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	names := cmd.Args().Slice()
+	for _, name := range names {
+		if _, err := cache.Find(name); err != nil {
+			return err
+		}
+	}
+	// Files written by other users in a container are only removable from its user namespace
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	root, err := cache.Root()
+	if err != nil {
+		return err
+	}
+	freed, err := cache.Prune(root, names)
+	if err != nil {
+		return err
+	}
+	color.New(color.FgGreen).Printf("✅ Pruned caches, freed %s\n", runConfig.FormatSize(freed))
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/image"
+	"github.com/Simeon2001/AlpineCell/isolator"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"os"
+	"path/filepath"
+)
+
+// containerPaths are the storage locations recorded in a container's config.json
+type containerPaths struct {
+	Rootfs string   `json:"rootfs"`
+	Lowers []string `json:"lowerdirs"`
+	Upper  string   `json:"upper"`
+	Work   string   `json:"work"`
+}
+
+// readContainerPaths reads the storage locations of a container
+func readContainerPaths(containerConfigPath string) (*containerPaths, error) {
+	data, err := os.ReadFile(filepath.Join(containerConfigPath, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container config: %w", err)
+	}
+
+	var paths containerPaths
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return nil, fmt.Errorf("failed to parse container config: %w", err)
+	}
+	// Containers created before the layer store run on a single extracted rootfs
+	if len(paths.Lowers) == 0 && paths.Rootfs != "" {
+		paths.Lowers = []string{paths.Rootfs}
+	}
+	if len(paths.Lowers) == 0 || paths.Upper == "" {
+		return nil, fmt.Errorf("container config has no rootfs or upper layer")
+	}
+	return &paths, nil
+}
+
+// containerLayers returns the lowerdirs (topmost first) and the persistent upper layer recorded in a container's config.json.
+// A container on the vfs storage driver has no lowerdirs, its full copy stands in for the upper layer.
+func containerLayers(containerConfigPath string) ([]string, string, error) {
+	paths, err := readContainerPaths(containerConfigPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if vfsPath := isolator.VFSPath(paths.Upper); dirExists(vfsPath) {
+		return nil, vfsPath, nil
+	}
+	if err := os.MkdirAll(paths.Upper, 0755); err != nil {
+		return nil, "", err
+	}
+	return paths.Lowers, paths.Upper, nil
+}
+
+// commitContainer turns the changes of a container into a new image
+func commitContainer(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 2 {
+		return fmt.Errorf("usage: otala-box commit <container-id> <image-name>")
+	}
+	if cmd.Args().Get(1) == "" {
+		return fmt.Errorf("an image name is required")
+	}
+	containerConfigPath, err := runConfig.FindContainer(cmd.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	state, err := runConfig.LoadState(containerConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load container state: %w", err)
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	lowers, upper, err := containerLayers(containerConfigPath)
+	if err != nil {
+		return err
+	}
+
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+	var base *image.Image
+	if state.Image != "" {
+		if base, err = store.Get(state.Image); err != nil {
+			return err
+		}
+	}
+
+	color.New(color.FgYellow, color.Bold).Printf("🏺 Committing %s\n", state.Name)
+	img, err := store.Commit(cmd.Args().Get(1), base, lowers, upper, state.Name)
+	if err != nil {
+		return err
+	}
+	printImage(img)
+	return nil
+}
+
+// exportContainer writes the container's filesystem as a flat tarball
+func exportContainer(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	output := cmd.String("output")
+	if output == "" {
+		return fmt.Errorf("--output is required")
+	}
+	if info, err := os.Stat(filepath.Dir(output)); err != nil || !info.IsDir() {
+		return fmt.Errorf("cannot write %s, its directory does not exist", output)
+	}
+	containerConfigPath, state, err := loadContainerArg(cmd)
+	if err != nil {
+		return err
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	lowers, upper, err := containerLayers(containerConfigPath)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := image.Export(lowers, upper, outFile); err != nil {
+		outFile.Close()
+		_ = os.Remove(output)
+		return fmt.Errorf("failed to export %s: %w", state.Name, err)
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+
+	color.New(color.FgGreen).Printf("✅ Exported %s to %s\n", state.Name, output)
+	return nil
+}
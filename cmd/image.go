@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/image"
+	"github.com/Simeon2001/AlpineCell/namespace"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// imageCommand groups the commands managing stored images
+func imageCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "image",
+		Usage: "Manage images containers can be created from",
+		Commands: []*cli.Command{
+			{
+				Name:      "pull",
+				Usage:     "Download an image from an OCI or Docker v2 registry",
+				ArgsUsage: "<reference>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Talk to the registry over plain HTTP",
+					},
+				},
+				Action: pullImage,
+			},
+			{
+				Name:      "load",
+				Usage:     "Load an image from an OCI image layout directory or a docker save tarball",
+				ArgsUsage: "<path>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Name to store the image under instead of the tag in the archive",
+					},
+				},
+				Action: loadImage,
+			},
+			{
+				Name:      "import",
+				Usage:     "Import a root filesystem tarball (.tar, .tar.gz, .tar.xz, .tar.zst) as an image",
+				ArgsUsage: "<tarball> <name>",
+				Action:    importImage,
+			},
+			{
+				Name:    "ls",
+				Aliases: []string{"list"},
+				Usage:   "List installed images",
+				Action:  listImages,
+			},
+			{
+				Name:      "rm",
+				Usage:     "Remove an image no container uses",
+				ArgsUsage: "<name|digest>",
+				Action:    removeImage,
+			},
+			{
+				Name:      "default",
+				Usage:     "Show or set the image new containers use without --image",
+				ArgsUsage: "[name|digest|embedded]",
+				Action:    defaultImage,
+			},
+		},
+	}
+}
+
+// inImageUserNS re-runs the current command inside the container user namespace unless it already
+// runs there, so unpacked files are owned by the ids containers see. It reports whether it did.
+func inImageUserNS() (bool, error) {
+	if namespace.InUserNS() {
+		return false, nil
+	}
+	return true, namespace.RunInUserNS(os.Args[1:])
+}
+
+// pullImage fetches an image from its registry into the image store
+func pullImage(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("usage: image pull <reference>")
+	}
+	if _, err := image.ParseReference(cmd.Args().First()); err != nil {
+		return err
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+
+	color.New(color.FgYellow, color.Bold).Printf("🏺 Pulling %s\n", cmd.Args().First())
+	img, err := store.Pull(cmd.Args().First(), cmd.Bool("insecure"))
+	if err != nil {
+		return err
+	}
+	printImage(img)
+	return nil
+}
+
+// loadImage imports an image archive from disk into the image store
+func loadImage(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("usage: image load <path>")
+	}
+	if _, err := os.Stat(cmd.Args().First()); err != nil {
+		return err
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+
+	color.New(color.FgYellow, color.Bold).Printf("🏺 Loading %s\n", cmd.Args().First())
+	img, err := store.Load(cmd.Args().First(), cmd.String("name"))
+	if err != nil {
+		return err
+	}
+	printImage(img)
+	return nil
+}
+
+// importImage stores a distro rootfs tarball as an image
+func importImage(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 2 {
+		return fmt.Errorf("usage: image import <tarball> <name>")
+	}
+	if cmd.Args().Get(1) == "" {
+		return fmt.Errorf("an image name is required")
+	}
+	tarball, err := filepath.Abs(cmd.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(tarball); err != nil {
+		return err
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+
+	color.New(color.FgYellow, color.Bold).Printf("🏺 Importing %s\n", tarball)
+	img, err := store.Import(tarball, cmd.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	printImage(img)
+	return nil
+}
+
+// listImages prints a table of the installed images, the default marked with *
+func listImages(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+	images, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	defaultName := store.Default()
+	if defaultName == "" {
+		defaultName = image.EmbeddedImage
+	}
+	mark := func(name string) string {
+		if name == defaultName {
+			return "*"
+		}
+		return " "
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  NAME\tDIGEST\tSOURCE\tSIZE\tCREATED")
+	fmt.Fprintf(w, "%s %s\t-\tembedded\t-\t-\n", mark(image.EmbeddedImage), image.EmbeddedImage)
+	for _, img := range images {
+		fmt.Fprintf(w, "%s %s\t%s\t%s\t%s\t%s\n", mark(img.Name), img.Name, shortID(img.Digest), img.Source,
+			runConfig.FormatSize(img.Size), img.Created.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+// removeImage deletes an image after checking no container was created from it
+func removeImage(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("usage: image rm <name|digest>")
+	}
+
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+	img, err := store.Resolve(cmd.Args().First())
+	if err != nil {
+		return err
+	}
+	// Layers hold files of other users, only removable from the user namespace
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	// The containers are checked with the store locked, so none can be created from the image meanwhile
+	inUse := func(img *image.Image) error {
+		containers, err := runConfig.ListContainers()
+		if err != nil {
+			return err
+		}
+		var users []string
+		for _, state := range containers {
+			if state.Image == img.Name {
+				users = append(users, state.Name)
+			}
+		}
+		if len(users) > 0 {
+			sort.Strings(users)
+			return fmt.Errorf("image %s is used by %s", img.Name, strings.Join(users, ", "))
+		}
+		return nil
+	}
+	if err := store.Remove(img.Name, inUse); err != nil {
+		return err
+	}
+	color.New(color.FgGreen).Printf("✅ Removed image %s\n", img.Name)
+	return nil
+}
+
+// defaultImage prints the default image or changes it
+func defaultImage(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+
+	if cmd.Args().Len() == 0 {
+		name := store.Default()
+		if name == "" {
+			name = image.EmbeddedImage
+		}
+		fmt.Println(name)
+		return nil
+	}
+
+	name := cmd.Args().First()
+	if name != image.EmbeddedImage {
+		img, err := store.Resolve(name)
+		if err != nil {
+			return err
+		}
+		name = img.Name
+	}
+
+	stored := name
+	if stored == image.EmbeddedImage {
+		stored = ""
+	}
+	if err := store.SetDefault(stored); err != nil {
+		return fmt.Errorf("failed to set default image: %w", err)
+	}
+	color.New(color.FgGreen).Printf("✅ New containers now use %s\n", name)
+	return nil
+}
+
+// shortID trims a digest for tables
+func shortID(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
+
+// printImage shows the name, digest and default command of an image
+func printImage(img *image.Image) {
+	color.New(color.FgGreen).Printf("✅ Stored image %s\n", img.Name)
+	color.New(color.FgCyan).Printf("    Digest: %s\n", img.Digest)
+	color.New(color.FgCyan).Printf("    Layers: %d\n", len(img.Layers))
+	color.New(color.FgCyan).Printf("    Size: %s\n", runConfig.FormatSize(img.Size))
+	if len(img.Config.Entrypoint) > 0 {
+		color.New(color.FgCyan).Printf("    Entrypoint: %s\n", strings.Join(img.Config.Entrypoint, " "))
+	}
+	if len(img.Config.Cmd) > 0 {
+		color.New(color.FgCyan).Printf("    Cmd: %s\n", strings.Join(img.Config.Cmd, " "))
+	}
+	if img.Config.WorkingDir != "" {
+		color.New(color.FgCyan).Printf("    WorkingDir: %s\n", img.Config.WorkingDir)
+	}
+}
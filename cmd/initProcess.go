@@ -2,39 +2,30 @@ package main
 
 import (
 	"embed"
-	"fmt"
 	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/image"
 	"github.com/Simeon2001/AlpineCell/namespace"
 	"github.com/Simeon2001/AlpineCell/systemd"
+	"github.com/Simeon2001/AlpineCell/volume"
+	"github.com/fatih/color"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-// mbToBytes converts a value in megabytes (mb) to bytes and returns it as a string.
-func mbToBytes(mb int) string {
-	bytes := mb * 1024 * 1024
-	return fmt.Sprintf("%d", bytes)
-}
-
 func InitProcess(file, rootfs *embed.FS, config *runConfig.RunConfig) {
 
-	var cwd string
-	if config.MountBool {
-		cwd = config.Mounts
-	} else {
-		cwd = config.CopyMounts
-	}
+	cwd := config.ProjectDir()
 
 	uniqueID, exist, err := getOrCreateUniqueID(cwd)
 	if err != nil {
 		must("Generating uniqueID err: ", err)
 	}
 	// log.Printf("here the path you want to copy, uniqueID, exist: %s, %v, %v\n", cwd, uniqueID, exist)
-	containerName := "otalacon-" + uniqueID
-	memoryAllocoy := mbToBytes(config.MemoryLimit)
+	containerName := runConfig.ContainerPrefix + uniqueID
 
-	err, boolValue, _ := systemd.Manager(containerName, memoryAllocoy)
+	err, boolValue, cgroupPath := systemd.Manager(containerName, config.CgroupParent, config.CgroupDelegate, config.Resources)
 	if err != nil {
 		if boolValue == true {
 			InitProcess(file, rootfs, config)
@@ -42,21 +33,99 @@ func InitProcess(file, rootfs *embed.FS, config *runConfig.RunConfig) {
 			must("systemd error", err)
 		}
 	}
-	// log.Printf("your cgroup Path: %s\n", cgroupPath)
 	configData, err := loadConfig(file)
 	if err != nil {
 		must("Loading config err: ", err)
 	}
 
-	containerPath, containerConfigPath, configJSONData, err := namespace.SetupContainerEnvironment(containerName, configData, exist, rootfs)
+	var lowerDirs []string
+	if config.Image != "" {
+		lowerDirs, err = imageLowerDirs(config.Image)
+		if err != nil {
+			must("Loading image layers err: ", err)
+		}
+	}
+
+	containerPath, containerConfigPath, configJSONData, err := namespace.SetupContainerEnvironment(containerName, configData, exist, rootfs, lowerDirs)
 	if err != nil {
 		must("Setting up container environment err: ", err)
 	}
 	config.SetContainerConfig(uniqueID, containerPath, containerConfigPath)
+	config.ContainerConfig.CgroupPath = cgroupPath
+
+	if err := saveContainerState(config, containerName, cwd, cgroupPath); err != nil {
+		must("Saving container state err: ", err)
+	}
+
 	namespace.Stage1UserNS(config, configJSONData)
 
 }
 
+// saveContainerState records the container's resources and paths, keeping the creation time of reused containers
+func saveContainerState(config *runConfig.RunConfig, containerName, projectDir, cgroupPath string) error {
+	state, err := runConfig.LoadState(config.ContainerConfig.ContainerConfigPath)
+	created := err != nil
+	if created {
+		state = &runConfig.ContainerState{Created: time.Now()}
+	}
+
+	state.ID = config.ContainerConfig.ContainerID
+	state.Name = containerName
+	state.ProjectDir = projectDir
+	state.LastRun = time.Now()
+	state.CgroupPath = cgroupPath
+	state.CgroupParent = config.CgroupParent
+	state.CgroupDelegate = config.CgroupDelegate
+	state.Resources = config.Resources
+	state.StorageSize = config.StorageSize
+	state.Ephemeral = config.Ephemeral
+	state.StoragePath = config.ContainerConfig.ContainerPath
+	state.DevSize = config.DevSize
+	state.ShmSize = config.ShmSize
+	state.Tmpfs = config.Tmpfs
+	state.Volumes = config.Volumes
+	state.Cache = config.CacheDir != ""
+	state.Image = config.Image
+
+	save := func() error {
+		// A new container, or one created before containers held layer references, takes them now
+		if len(state.Layers) == 0 {
+			paths, err := readContainerPaths(config.ContainerConfig.ContainerConfigPath)
+			if err != nil {
+				return err
+			}
+			store, err := image.NewStore()
+			if err != nil {
+				return err
+			}
+			imageName := ""
+			if created {
+				imageName = state.Image
+			}
+			return store.RetainContainerLayers(imageName, paths.Lowers, func(digests []string) error {
+				state.Layers = digests
+				return runConfig.SaveState(config.ContainerConfig.ContainerConfigPath, state)
+			})
+		}
+		return runConfig.SaveState(config.ContainerConfig.ContainerConfigPath, state)
+	}
+
+	// Missing volumes are created and the state recorded under the volume store lock,
+	// so volume rm cannot remove a volume this container is about to attach
+	volumes, err := volume.NewStore()
+	if err != nil {
+		return err
+	}
+	createdVolumes, err := volumes.Attach(config.Volumes, save)
+	if err != nil {
+		return err
+	}
+	for _, name := range createdVolumes {
+		color.New(color.FgGreen).Printf("✅ Created volume %s\n", name)
+	}
+	return nil
+}
+
 // loadConfig loads the config file from the filesystem and returns the data as a byte slice.
 func loadConfig(configFile *embed.FS) (*[]byte, error) {
 	data, err := configFile.ReadFile("config.json")
@@ -101,3 +170,16 @@ func getOrCreateUniqueID(cwd string) (string, bool, error) {
 		return "", false, err
 	}
 }
+
+// imageLowerDirs returns the overlay lowerdirs of a stored image, topmost first
+func imageLowerDirs(name string) ([]string, error) {
+	store, err := image.NewStore()
+	if err != nil {
+		return nil, err
+	}
+	img, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return store.LowerDirs(img)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/isolator"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"github.com/Simeon2001/AlpineCell/systemd"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// inspectReport is the stored container state plus usage computed when inspecting
+type inspectReport struct {
+	*runConfig.ContainerState
+	StorageUsed uint64 `json:"storageUsed"`
+	// EphemeralUsed is what the current run of an --ephemeral container wrote to its tmpfs layer
+	EphemeralUsed uint64 `json:"ephemeralUsed,omitempty"`
+}
+
+// loadContainerArg resolves the container named by the single command argument and loads its state
+func loadContainerArg(cmd *cli.Command) (string, *runConfig.ContainerState, error) {
+	if cmd.Args().Len() != 1 {
+		return "", nil, fmt.Errorf("usage: otala-box %s <container-id>", cmd.Name)
+	}
+
+	containerConfigPath, err := runConfig.FindContainer(cmd.Args().First())
+	if err != nil {
+		return "", nil, err
+	}
+
+	state, err := runConfig.LoadState(containerConfigPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load container state: %w", err)
+	}
+	return containerConfigPath, state, nil
+}
+
+// upperUsage returns the space used by a container's persistent writable layer, or by its full copy
+// when it runs on the vfs storage driver
+func upperUsage(state *runConfig.ContainerState) uint64 {
+	if state.StoragePath == "" {
+		return 0
+	}
+	upper := filepath.Join(state.StoragePath, "upper")
+	if vfsPath := isolator.VFSPath(upper); dirExists(vfsPath) {
+		upper = vfsPath
+	}
+	used, _ := utils.DirSize(upper)
+	return used
+}
+
+// ephemeralUsage returns the space used in the tmpfs layer of a running --ephemeral container. That
+// tmpfs only exists in the container's mount namespace, but an overlay reports the filesystem of its
+// upper layer, so statfs on the root of a process inside the container measures it.
+func ephemeralUsage(state *runConfig.ContainerState) (uint64, bool) {
+	if !state.Ephemeral || state.CgroupPath == "" {
+		return 0, false
+	}
+	var hostRoot unix.Stat_t
+	if err := unix.Stat("/", &hostRoot); err != nil {
+		return 0, false
+	}
+
+	var used uint64
+	found := false
+	_ = filepath.WalkDir(state.CgroupPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		procs, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+		if err != nil {
+			return nil
+		}
+		for _, pid := range strings.Fields(string(procs)) {
+			// The runtime itself shares the scope but still sees the host root
+			root := filepath.Join("/proc", pid, "root")
+			var rootStat unix.Stat_t
+			if err := unix.Stat(root, &rootStat); err != nil || rootStat.Dev == hostRoot.Dev {
+				continue
+			}
+			var stats unix.Statfs_t
+			if err := unix.Statfs(root, &stats); err != nil {
+				continue
+			}
+			used = (stats.Blocks - stats.Bfree) * uint64(stats.Bsize)
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return used, found
+}
+
+// dirExists reports whether path is an existing directory
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// inspectContainer prints the stored state of a container as JSON
+func inspectContainer(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	_, state, err := loadContainerArg(cmd)
+	if err != nil {
+		return err
+	}
+
+	report := inspectReport{
+		ContainerState: state,
+		StorageUsed:    upperUsage(state),
+	}
+	report.EphemeralUsed, _ = ephemeralUsage(state)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// containerStats prints live cgroup usage of a running container and the size of its writable layer
+func containerStats(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	_, state, err := loadContainerArg(cmd)
+	if err != nil {
+		return err
+	}
+
+	color.New(color.FgYellow, color.Bold).Printf("📊 %s\n", state.Name)
+	if stats, err := systemd.ReadStats(state.CgroupPath); err == nil {
+		printStats(stats)
+	} else {
+		color.New(color.FgYellow).Println("    Container is not running")
+	}
+
+	fmt.Printf("    Storage:     %s, not limited\n", runConfig.FormatSize(upperUsage(state)))
+	if ephemeral, running := ephemeralUsage(state); running {
+		if state.StorageSize != 0 {
+			fmt.Printf("    Ephemeral:   %s of %s, discarded on exit\n",
+				runConfig.FormatSize(ephemeral), runConfig.FormatSize(state.StorageSize))
+		} else {
+			fmt.Printf("    Ephemeral:   %s, discarded on exit\n", runConfig.FormatSize(ephemeral))
+		}
+	}
+	return nil
+}
@@ -4,8 +4,13 @@ import (
 	"context"
 	"embed"
 	"fmt"
+	"github.com/Simeon2001/AlpineCell/cache"
 	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/image"
 	"github.com/Simeon2001/AlpineCell/isolator"
+	"github.com/Simeon2001/AlpineCell/namespace"
+	"github.com/Simeon2001/AlpineCell/security"
+	"github.com/Simeon2001/AlpineCell/systemd"
 	"github.com/fatih/color"
 	"github.com/urfave/cli/v3"
 	"log"
@@ -28,6 +33,12 @@ func main() {
 		return
 	}
 
+	// Image store changes re-run themselves inside the container user namespace
+	if len(os.Args) > 1 && os.Args[1] == namespace.UserNSCommand {
+		must("entering user namespace", namespace.EnterUserNS())
+		os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+	}
+
 	cmd := &cli.Command{
 		Name:  "otala-box",
 		Usage: "Container runtime guided by Obatala's principles of purity and wise isolation 🏺",
@@ -44,7 +55,7 @@ func main() {
 			{
 				Name:  "run",
 				Usage: "Run a container with specified configuration",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.BoolFlag{
 						Name:    "net",
 						Aliases: []string{"n"},
@@ -54,7 +65,7 @@ func main() {
 					&cli.IntFlag{
 						Name:    "memory-limit",
 						Aliases: []string{"ml"},
-						Usage:   "Memory limit in MB (e.g., 100)",
+						Usage:   "Memory limit in MB (e.g., 100), superseded by --memory",
 						Value:   100,
 					},
 					&cli.StringFlag{
@@ -68,11 +79,23 @@ func main() {
 						Aliases: []string{"cp"},
 						Usage:   "Copy directories into container (host paths only)",
 					},
+					&cli.StringSliceFlag{
+						Name:  "copy-exclude",
+						Usage: "Leave paths matching a .gitignore style pattern out of --copy, on top of the project's .otalaignore (repeatable)",
+					},
+					&cli.BoolFlag{
+						Name:  "copy-back",
+						Usage: "Apply the files the container created, changed or deleted in its --copy back to the host when it exits",
+					},
 					&cli.StringFlag{
 						Name:    "mount",
 						Aliases: []string{"m"},
 						Usage:   "Mount directories into container (host paths only)",
 					},
+					&cli.StringFlag{
+						Name:  "overlay-mount",
+						Usage: "Mount a directory copy-on-write: the container can change it, the changes stay in its storage and the host directory is left untouched",
+					},
 					&cli.StringFlag{
 						Name:     "language",
 						Aliases:  []string{"l"},
@@ -94,15 +117,192 @@ func main() {
 						Aliases: []string{"a"},
 						Usage:   "Arguments to pass to the script (e.g., --args 15 --args 8)",
 					},
+					&cli.StringSliceFlag{
+						Name:  "ulimit",
+						Usage: "Resource limit override as name=soft:hard (e.g., --ulimit nofile=1024:2048)",
+					},
+					&cli.StringFlag{
+						Name:  "image",
+						Usage: "Image name or digest to use as the container's rootfs, \"embedded\" for the built-in Alpine",
+					},
+					&cli.StringFlag{
+						Name:  "cgroup-parent",
+						Usage: "Systemd slice to place the container in",
+						Value: systemd.DefaultSlice,
+					},
+					&cli.BoolFlag{
+						Name:  "cgroup-delegate",
+						Usage: "Give the container a writable cgroup subtree it can manage itself",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "ephemeral",
+						Usage: "Keep this run's changes in a RAM-backed layer that is discarded on exit",
+					},
+					&cli.StringFlag{
+						Name:  "storage-size",
+						Usage: "Size limit of the --ephemeral writable layer (e.g., 2g), requires --ephemeral; the persistent writable layer of a container is not limited",
+					},
+					&cli.StringFlag{
+						Name:  "storage-driver",
+						Usage: "Storage driver for the rootfs: overlay, fuse-overlayfs or vfs (probed when not set)",
+					},
+					&cli.StringFlag{
+						Name:  "dev-size",
+						Usage: "Size of /dev (e.g., 128m)",
+						Value: "65536k",
+					},
+					&cli.StringFlag{
+						Name:  "shm-size",
+						Usage: "Size of /dev/shm (e.g., 1g)",
+						Value: "64000k",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tmpfs",
+						Usage: "Mount a tmpfs as /path[:size=..,mode=..,noexec], repeatable",
+					},
+					&cli.StringSliceFlag{
+						Name:  "volume",
+						Usage: "Attach a named volume as name:/path[:ro], created if it does not exist yet (repeatable)",
+					},
+					&cli.BoolFlag{
+						Name:  "cache",
+						Usage: "Share pip, npm, yarn, Go module and apk download caches with other containers",
+					},
+					&cli.StringFlag{
+						Name:  "stats-file",
+						Usage: "Write the container's resource usage summary to this JSON file on exit",
+					},
 					&cli.BoolFlag{
 						Name:    "delete",
 						Aliases: []string{"d"},
 						Usage:   "Delete container when execution is complete",
 						Value:   false,
 					},
-				},
+				}, resourceFlags()...),
 				Action: runContainer,
 			},
+			{
+				Name:      "update",
+				Usage:     "Change the resource limits of a container, applied live when it is running",
+				ArgsUsage: "<container-id>",
+				Flags:     resourceFlags(),
+				Action:    updateContainer,
+			},
+			sliceCommand(),
+			imageCommand(),
+			{
+				Name:      "stats",
+				Usage:     "Show live resource and storage usage of a container",
+				ArgsUsage: "<container-id>",
+				Action:    containerStats,
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Show the stored state of a container",
+				ArgsUsage: "<container-id>",
+				Action:    inspectContainer,
+			},
+			{
+				Name:      "commit",
+				Usage:     "Save the changes made in a container as a new image",
+				ArgsUsage: "<container-id> <image-name>",
+				Action:    commitContainer,
+			},
+			{
+				Name:      "build",
+				Usage:     "Build an image from the FROM, RUN, COPY, ENV, WORKDIR and CMD instructions of an Otalafile",
+				ArgsUsage: "[context]",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "Otalafile to build (default: Otalafile in the context)",
+					},
+					&cli.StringFlag{
+						Name:    "tag",
+						Aliases: []string{"t"},
+						Usage:   "Name of the image to build",
+					},
+					&cli.BoolFlag{
+						Name:  "no-cache",
+						Usage: "Run every step again instead of reusing cached results",
+					},
+					&cli.BoolFlag{
+						Name:    "net",
+						Aliases: []string{"n"},
+						Usage:   "Give RUN steps pasta networking",
+						Value:   true,
+					},
+					&cli.StringFlag{
+						Name:  "cgroup-parent",
+						Usage: "Systemd slice to place RUN steps in",
+						Value: systemd.DefaultSlice,
+					},
+					&cli.StringFlag{
+						Name:  "shm-size",
+						Usage: "Size of /dev/shm in RUN steps (e.g., 1g)",
+						Value: "64000k",
+					},
+				}, resourceFlags()...),
+				Action: buildImage,
+			},
+			{
+				Name:   "build-step",
+				Hidden: true,
+				Action: buildStep,
+			},
+			{
+				Name:   "build-commit",
+				Hidden: true,
+				Action: buildCommit,
+			},
+			{
+				Name:      "reset",
+				Usage:     "Discard the changes made in a container, back to its image",
+				ArgsUsage: "<container-id>",
+				Action:    resetContainer,
+			},
+			snapshotCommand(),
+			volumeCommand(),
+			cacheCommand(),
+			systemCommand(),
+			{
+				Name:      "sync",
+				Usage:     "Apply the changes a container made to its --copy of the project back to the host",
+				ArgsUsage: "<container-id>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only list the changes and conflicts",
+					},
+					&cli.BoolFlag{
+						Name:   "exited",
+						Usage:  "Set by run --copy-back, whose container has exited but is not cleaned up yet",
+						Hidden: true,
+					},
+				},
+				Action: syncContainer,
+			},
+			{
+				Name:      "diff",
+				Usage:     "List what a container changed in the project it ran on with --overlay-mount",
+				ArgsUsage: "<container-id>",
+				Action:    diffContainer,
+			},
+			{
+				Name:      "export",
+				Usage:     "Write the container's filesystem as a flat tarball",
+				ArgsUsage: "<container-id>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Tarball to write (e.g., rootfs.tar)",
+					},
+				},
+				Action: exportContainer,
+			},
 			{
 				Name:  "version",
 				Usage: "Show version information",
@@ -135,17 +335,126 @@ func runContainer(ctx context.Context, cmd *cli.Command) error {
 		Command:        cmd.String("command"),
 		ConfigPath:     cmd.String("config"),
 		CopyMounts:     cmd.String("copy"),
+		CopyExclude:    cmd.StringSlice("copy-exclude"),
+		CopyBack:       cmd.Bool("copy-back"),
 		Mounts:         cmd.String("mount"),
+		OverlayMount:   cmd.String("overlay-mount"),
 		Args:           cmd.StringSlice("args"),
+		Ulimits:        cmd.StringSlice("ulimit"),
+		StatsFile:      cmd.String("stats-file"),
+		CgroupParent:   cmd.String("cgroup-parent"),
+		CgroupDelegate: cmd.Bool("cgroup-delegate"),
 		DeleteWhenDone: cmd.Bool("delete"),
 	}
 
-	// If neither copy nor mount is specified, default to copy current directory
-	if len(config.CopyMounts) == 0 && len(config.Mounts) == 0 {
+	// If no copy or mount is specified, default to copy current directory
+	if len(config.CopyMounts) == 0 && len(config.Mounts) == 0 && len(config.OverlayMount) == 0 {
 		config.CopyMounts = cwd
 		config.MountBool = false
 	}
 
+	// Start from the stored limits of an existing container, then apply the flags given
+	stored, found := storedState(config.ProjectDir())
+	var baseResources runConfig.Resources
+	if found {
+		baseResources = stored.Resources
+	}
+	if baseResources.Memory == 0 || cmd.IsSet("memory-limit") {
+		baseResources.Memory = uint64(config.MemoryLimit) * 1024 * 1024
+	}
+	config.Resources, err = parseResources(cmd, baseResources)
+	if err != nil {
+		return fmt.Errorf("configuration validation failed: %w", err)
+	}
+
+	config.Ephemeral = cmd.Bool("ephemeral")
+	if cmd.IsSet("storage-size") {
+		// A user namespace cannot mount a block device, so the only limit available is a tmpfs
+		if !config.Ephemeral {
+			return fmt.Errorf("configuration validation failed: --storage-size requires --ephemeral, the persistent writable layer of a container cannot be limited")
+		}
+		config.StorageSize, err = runConfig.ParseSize(cmd.String("storage-size"))
+		if err != nil {
+			return fmt.Errorf("configuration validation failed: --storage-size: %w", err)
+		}
+		if config.StorageSize == 0 {
+			return fmt.Errorf("configuration validation failed: --storage-size must be greater than zero")
+		}
+	}
+
+	config.StorageDriver = cmd.String("storage-driver")
+	if err := runConfig.ValidateStorageDriver(config.StorageDriver); err != nil {
+		return fmt.Errorf("configuration validation failed: %w", err)
+	}
+
+	config.DevSize, err = runConfig.ParseSize(cmd.String("dev-size"))
+	if err != nil || config.DevSize == 0 {
+		return fmt.Errorf("configuration validation failed: invalid --dev-size %q", cmd.String("dev-size"))
+	}
+
+	config.ShmSize, err = runConfig.ParseSize(cmd.String("shm-size"))
+	if err != nil || config.ShmSize == 0 {
+		return fmt.Errorf("configuration validation failed: invalid --shm-size %q", cmd.String("shm-size"))
+	}
+
+	seenTmpfs := make(map[string]bool)
+	for _, spec := range cmd.StringSlice("tmpfs") {
+		mount, err := runConfig.ParseTmpfs(spec)
+		if err != nil {
+			return fmt.Errorf("configuration validation failed: %w", err)
+		}
+		if seenTmpfs[mount.Destination] {
+			return fmt.Errorf("configuration validation failed: duplicate tmpfs destination %s", mount.Destination)
+		}
+		seenTmpfs[mount.Destination] = true
+		config.Tmpfs = append(config.Tmpfs, mount)
+	}
+
+	// Volumes are only looked up here, missing ones are created once the container starts
+	seenVolumes := make(map[string]bool)
+	for _, spec := range cmd.StringSlice("volume") {
+		mount, err := runConfig.ParseVolume(spec)
+		if err != nil {
+			return fmt.Errorf("configuration validation failed: %w", err)
+		}
+		if seenVolumes[mount.Destination] || seenTmpfs[mount.Destination] {
+			return fmt.Errorf("configuration validation failed: duplicate mount destination %s", mount.Destination)
+		}
+		seenVolumes[mount.Destination] = true
+		config.Volumes = append(config.Volumes, mount)
+	}
+
+	if cmd.Bool("cache") {
+		if config.CacheDir, err = cache.Root(); err != nil {
+			return err
+		}
+	}
+
+	// An existing container keeps the image it was created from, a new one gets the default image
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+	config.Image = cmd.String("image")
+	if config.Image == "" {
+		if found {
+			config.Image = stored.Image
+		} else {
+			config.Image = store.Default()
+		}
+	}
+	if config.Image == image.EmbeddedImage {
+		config.Image = ""
+	}
+	if config.Image != "" {
+		img, err := store.Resolve(config.Image)
+		if err != nil {
+			return fmt.Errorf("configuration validation failed: %w", err)
+		}
+		config.Image = img.Name
+		config.ImageConfig = img.Config
+	}
+
 	// Validate inputs
 	if err = validateConfig(&config); err != nil {
 		return fmt.Errorf("configuration validation failed: %w", err)
@@ -158,7 +467,31 @@ func runContainer(ctx context.Context, cmd *cli.Command) error {
 	} else {
 		color.New(color.FgYellow).Printf("    Network: networking disabled\n")
 	}
-	color.New(color.FgCyan).Printf("    Memory Limit: %dMB\n", config.MemoryLimit)
+	color.New(color.FgCyan).Printf("    Memory Limit: %s\n", runConfig.FormatSize(config.Resources.Memory))
+	if config.Resources.MemoryHigh != 0 {
+		color.New(color.FgCyan).Printf("    Memory High: %s\n", runConfig.FormatSize(config.Resources.MemoryHigh))
+	}
+	if config.Resources.MemoryReservation != 0 {
+		color.New(color.FgCyan).Printf("    Memory Reservation: %s\n", runConfig.FormatSize(config.Resources.MemoryReservation))
+	}
+	if config.Resources.CPUs != 0 {
+		color.New(color.FgCyan).Printf("    CPUs: %g\n", config.Resources.CPUs)
+	}
+	if config.Resources.PidsLimit != 0 {
+		color.New(color.FgCyan).Printf("    Pids Limit: %d\n", config.Resources.PidsLimit)
+	}
+	switch {
+	case config.Resources.MemorySwap == runConfig.SwapUnlimited:
+		color.New(color.FgCyan).Printf("    Swap: unlimited\n")
+	case config.Resources.SwapMax() != 0:
+		color.New(color.FgCyan).Printf("    Swap: %s\n", runConfig.FormatSize(config.Resources.SwapMax()))
+	default:
+		color.New(color.FgCyan).Printf("    Swap: disabled\n")
+	}
+
+	if config.Image != "" {
+		color.New(color.FgCyan).Printf("    Image: %s\n", config.Image)
+	}
 
 	if config.Language != "" {
 		color.New(color.FgCyan).Printf("    Language: %s\n", config.Language)
@@ -182,10 +515,60 @@ func runContainer(ctx context.Context, cmd *cli.Command) error {
 		color.New(color.FgCyan).Printf("    Copy Mounts: %s\n", config.CopyMounts)
 	}
 
+	if len(config.CopyExclude) > 0 {
+		color.New(color.FgCyan).Printf("    Copy Exclude: %s\n", strings.Join(config.CopyExclude, " "))
+	}
+
+	if config.CopyBack {
+		color.New(color.FgCyan).Printf("    Copy Back: enabled\n")
+	}
+
 	if config.Mounts != "" {
 		color.New(color.FgCyan).Printf("    Mounts: %s\n", config.Mounts)
 	}
 
+	if config.OverlayMount != "" {
+		color.New(color.FgCyan).Printf("    Overlay Mount: %s\n", config.OverlayMount)
+	}
+
+	if len(config.Ulimits) > 0 {
+		color.New(color.FgCyan).Printf("    Ulimits: %s\n", strings.Join(config.Ulimits, " "))
+	}
+
+	color.New(color.FgCyan).Printf("    Cgroup Parent: %s\n", config.CgroupParent)
+	if config.CgroupDelegate {
+		color.New(color.FgCyan).Printf("    Cgroup Delegation: enabled\n")
+	}
+
+	if config.Ephemeral {
+		color.New(color.FgCyan).Printf("    Ephemeral: changes are discarded on exit\n")
+	}
+	if config.StorageSize != 0 {
+		color.New(color.FgCyan).Printf("    Ephemeral Size: %s\n", runConfig.FormatSize(config.StorageSize))
+	}
+
+	if config.StorageDriver != "" {
+		color.New(color.FgCyan).Printf("    Storage Driver: %s\n", config.StorageDriver)
+	}
+
+	color.New(color.FgCyan).Printf("    Dev Size: %s\n", runConfig.FormatSize(config.DevSize))
+	color.New(color.FgCyan).Printf("    Shm Size: %s\n", runConfig.FormatSize(config.ShmSize))
+	for _, mount := range config.Tmpfs {
+		color.New(color.FgCyan).Printf("    Tmpfs: %s\n", mount)
+	}
+
+	for _, mount := range config.Volumes {
+		color.New(color.FgCyan).Printf("    Volume: %s\n", mount)
+	}
+
+	if config.CacheDir != "" {
+		color.New(color.FgCyan).Printf("    Cache: shared from %s\n", config.CacheDir)
+	}
+
+	if config.StatsFile != "" {
+		color.New(color.FgCyan).Printf("    Stats File: %s\n", config.StatsFile)
+	}
+
 	if config.DeleteWhenDone {
 		color.New(color.FgRed).Printf("    Delete when done: enabled\n")
 	} else {
@@ -212,20 +595,29 @@ func validateConfig(config *runConfig.RunConfig) error {
 		return fmt.Errorf("cannot specify both --script and --command, choose one")
 	}
 
-	if config.Script == "" && config.Command == "" {
+	if config.Script == "" && config.Command == "" && !config.ImageConfig.HasDefaultCommand() {
 		return fmt.Errorf("must specify either --script or --command")
 	}
 
-	// Must specify either copy or mount, but not both
+	// Must specify exactly one of copy, mount and overlay mount
 	hasCopy := config.CopyMounts != ""
 	hasMount := config.Mounts != ""
+	hasOverlay := config.OverlayMount != ""
+
+	if !hasCopy && !hasMount && !hasOverlay {
+		return fmt.Errorf("must specify either --copy, --mount or --overlay-mount")
+	}
 
-	if !hasCopy && !hasMount {
-		return fmt.Errorf("must specify either --copy or --mount")
+	if (hasCopy && hasMount) || (hasCopy && hasOverlay) || (hasMount && hasOverlay) {
+		return fmt.Errorf("cannot combine --copy, --mount and --overlay-mount, choose one")
 	}
 
-	if hasCopy && hasMount {
-		return fmt.Errorf("cannot use both --copy and --mount flags together, choose one")
+	if len(config.CopyExclude) > 0 && !hasCopy {
+		return fmt.Errorf("--copy-exclude only applies to --copy")
+	}
+
+	if config.CopyBack && !hasCopy {
+		return fmt.Errorf("--copy-back only applies to --copy")
 	}
 
 	// Validate copy mounts (host paths only)
@@ -252,6 +644,24 @@ func validateConfig(config *runConfig.RunConfig) error {
 		copyOrMountPath = config.Mounts
 	}
 
+	// Validate overlay mount paths (host paths only)
+	if config.OverlayMount != "" {
+		if !filepath.IsAbs(config.OverlayMount) {
+			return fmt.Errorf("overlay mount path must be absolute: %s", config.OverlayMount)
+		}
+		if info, err := os.Stat(config.OverlayMount); err != nil || !info.IsDir() {
+			return fmt.Errorf("overlay mount path is not a directory: %s", config.OverlayMount)
+		}
+		if strings.ContainsAny(config.OverlayMount, ",:") {
+			return fmt.Errorf("overlay mount path cannot contain ',' or ':': %s", config.OverlayMount)
+		}
+		if config.StorageDriver == runConfig.StorageDriverVFS {
+			return fmt.Errorf("--overlay-mount needs an overlay storage driver, not %s", runConfig.StorageDriverVFS)
+		}
+		config.MountBool = false
+		copyOrMountPath = config.OverlayMount
+	}
+
 	// If using script, validate script file exists and language is provided
 	if config.Script != "" {
 		fullScriptPath := filepath.Join(copyOrMountPath, config.Script)
@@ -278,9 +688,133 @@ func validateConfig(config *runConfig.RunConfig) error {
 		}
 	}
 
+	if err := config.Resources.Validate(); err != nil {
+		return err
+	}
+
+	if err := systemd.ValidateSlice(config.CgroupParent); err != nil {
+		return err
+	}
+
+	// The stats file is written by the parent after exit, resolve it against the invoking directory
+	if config.StatsFile != "" {
+		statsFile, err := filepath.Abs(config.StatsFile)
+		if err != nil {
+			return fmt.Errorf("invalid stats file path: %w", err)
+		}
+		if _, err := os.Stat(filepath.Dir(statsFile)); err != nil {
+			return fmt.Errorf("stats file directory does not exist: %s", filepath.Dir(statsFile))
+		}
+		config.StatsFile = statsFile
+	}
+
+	// Validate ulimit overrides against the limits this process can actually grant
+	for _, spec := range config.Ulimits {
+		rlimit, err := security.ParseUlimit(spec)
+		if err != nil {
+			return err
+		}
+		if err := security.ValidateRlimit(rlimit); err != nil {
+			return fmt.Errorf("invalid ulimit %q: %w", spec, err)
+		}
+	}
+
 	return nil
 }
 
+// resourceFlags returns the cgroup limit flags shared by run and update
+func resourceFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "memory",
+			Usage: "Memory limit with unit suffix (e.g., 512m, 2g)",
+		},
+		&cli.StringFlag{
+			Name:  "memory-swap",
+			Usage: "Total memory plus swap limit (e.g., 1g), -1 for unlimited swap; no swap when unset",
+		},
+		&cli.StringFlag{
+			Name:  "memory-reservation",
+			Usage: "Memory protected from reclaim, systemd MemoryLow (e.g., 256m)",
+		},
+		&cli.StringFlag{
+			Name:  "memory-high",
+			Usage: "Memory throttling threshold, systemd MemoryHigh (e.g., 400m)",
+		},
+		&cli.FloatFlag{
+			Name:  "cpus",
+			Usage: "Number of CPUs the container may use (e.g., 1.5)",
+		},
+		&cli.Uint64Flag{
+			Name:  "pids-limit",
+			Usage: "Maximum number of processes in the container",
+		},
+	}
+}
+
+// parseResources applies the resource flags that were set on top of base, accepting unit suffixes
+func parseResources(cmd *cli.Command, base runConfig.Resources) (runConfig.Resources, error) {
+	resources := base
+
+	sizeFlags := []struct {
+		name   string
+		target *uint64
+	}{
+		{"memory", &resources.Memory},
+		{"memory-reservation", &resources.MemoryReservation},
+		{"memory-high", &resources.MemoryHigh},
+	}
+	for _, flag := range sizeFlags {
+		if !cmd.IsSet(flag.name) {
+			continue
+		}
+		size, err := runConfig.ParseSize(cmd.String(flag.name))
+		if err != nil {
+			return resources, fmt.Errorf("--%s: %w", flag.name, err)
+		}
+		*flag.target = size
+	}
+
+	if cmd.IsSet("memory-swap") {
+		if swap := cmd.String("memory-swap"); swap == "-1" {
+			resources.MemorySwap = runConfig.SwapUnlimited
+		} else {
+			size, err := runConfig.ParseSize(swap)
+			if err != nil {
+				return resources, fmt.Errorf("--memory-swap: %w", err)
+			}
+			resources.MemorySwap = int64(size)
+		}
+	}
+
+	if cmd.IsSet("cpus") {
+		resources.CPUs = cmd.Float("cpus")
+	}
+	if cmd.IsSet("pids-limit") {
+		resources.PidsLimit = cmd.Uint64("pids-limit")
+	}
+
+	return resources, nil
+}
+
+// storedState loads the state recorded for the container of a project directory,
+// so a rerun keeps limits changed with update and the image it was created from
+func storedState(projectDir string) (*runConfig.ContainerState, bool) {
+	data, err := os.ReadFile(filepath.Join(projectDir, ".otalarunc-config"))
+	if err != nil {
+		return nil, false
+	}
+	containerConfigPath, err := runConfig.FindContainer(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, false
+	}
+	state, err := runConfig.LoadState(containerConfigPath)
+	if err != nil {
+		return nil, false
+	}
+	return state, true
+}
+
 func executeContainer(config *runConfig.RunConfig) error {
 
 	color.New(color.FgGreen, color.Bold).Println("🚀 Container starting...")
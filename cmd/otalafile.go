@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// buildInstruction is one instruction of an Otalafile, continuation lines joined
+type buildInstruction struct {
+	Line    int
+	Command string
+	Args    string
+}
+
+// String returns the instruction as it takes part in the build cache key
+func (i buildInstruction) String() string {
+	return i.Command + " " + i.Args
+}
+
+// buildCommands are the instructions an Otalafile may use
+var buildCommands = map[string]bool{
+	"FROM":    true,
+	"RUN":     true,
+	"COPY":    true,
+	"ENV":     true,
+	"WORKDIR": true,
+	"CMD":     true,
+}
+
+// parseOtalafile reads the instructions of an Otalafile. Blank lines and lines starting with #
+// are skipped and a line ending in a backslash continues on the next one.
+func parseOtalafile(filePath string) ([]buildInstruction, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var instructions []buildInstruction
+	var current strings.Builder
+	start := 0
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			start = lineNo
+		} else {
+			current.WriteByte(' ')
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSpace(strings.TrimSuffix(line, "\\")))
+			continue
+		}
+		current.WriteString(line)
+
+		instruction, err := parseInstruction(start, current.String())
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, instruction)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() != 0 {
+		return nil, fmt.Errorf("line %d: continuation at the end of the file", start)
+	}
+
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("%s has no instructions", filePath)
+	}
+	if instructions[0].Command != "FROM" {
+		return nil, fmt.Errorf("line %d: the first instruction must be FROM", instructions[0].Line)
+	}
+	for _, instruction := range instructions[1:] {
+		if instruction.Command == "FROM" {
+			return nil, fmt.Errorf("line %d: only one FROM is supported", instruction.Line)
+		}
+	}
+	return instructions, nil
+}
+
+// parseInstruction splits a joined line into its upper-cased command and arguments
+func parseInstruction(lineNo int, line string) (buildInstruction, error) {
+	command, args := cutSpace(line)
+	instruction := buildInstruction{
+		Line:    lineNo,
+		Command: strings.ToUpper(command),
+		Args:    strings.TrimSpace(args),
+	}
+	if !buildCommands[instruction.Command] {
+		return instruction, fmt.Errorf("line %d: unknown instruction %s", lineNo, command)
+	}
+	if instruction.Args == "" {
+		return instruction, fmt.Errorf("line %d: %s needs arguments", lineNo, instruction.Command)
+	}
+	return instruction, nil
+}
+
+// cutSpace splits s around the first run of whitespace
+func cutSpace(s string) (string, string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+}
+
+// commandArgv returns the argument vector of a RUN or CMD: the JSON array of the exec form, or
+// the shell form run by /bin/sh -c
+func commandArgv(instruction buildInstruction) ([]string, error) {
+	if !strings.HasPrefix(instruction.Args, "[") {
+		return []string{"/bin/sh", "-c", instruction.Args}, nil
+	}
+	var argv []string
+	if err := json.Unmarshal([]byte(instruction.Args), &argv); err != nil || len(argv) == 0 {
+		return nil, fmt.Errorf("line %d: %s expects a non-empty JSON array of strings", instruction.Line, instruction.Command)
+	}
+	return argv, nil
+}
+
+// copyArgs returns the sources and destination of a COPY, in the JSON or the space separated form
+func copyArgs(instruction buildInstruction) ([]string, string, error) {
+	var words []string
+	if strings.HasPrefix(instruction.Args, "[") {
+		if err := json.Unmarshal([]byte(instruction.Args), &words); err != nil {
+			return nil, "", fmt.Errorf("line %d: COPY expects a JSON array of strings", instruction.Line)
+		}
+	} else {
+		var err error
+		if words, err = splitWords(instruction.Args); err != nil {
+			return nil, "", fmt.Errorf("line %d: %v", instruction.Line, err)
+		}
+	}
+	if len(words) > 0 && strings.HasPrefix(words[0], "--") {
+		return nil, "", fmt.Errorf("line %d: COPY option %s is not supported", instruction.Line, words[0])
+	}
+	if len(words) < 2 {
+		return nil, "", fmt.Errorf("line %d: COPY needs at least one source and a destination", instruction.Line)
+	}
+	return words[:len(words)-1], words[len(words)-1], nil
+}
+
+// envArgs returns the KEY=value pairs of an ENV, given as KEY=value pairs or as a single KEY value
+func envArgs(instruction buildInstruction) ([]string, error) {
+	words, err := splitWords(instruction.Args)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", instruction.Line, err)
+	}
+	if !strings.Contains(words[0], "=") {
+		key, value := cutSpace(instruction.Args)
+		if value = strings.TrimSpace(value); value == "" {
+			return nil, fmt.Errorf("line %d: ENV %s needs a value, use ENV %s=\"\" for an empty one", instruction.Line, key, key)
+		}
+		return []string{key + "=" + value}, nil
+	}
+	for _, word := range words {
+		if key, _, ok := strings.Cut(word, "="); !ok || key == "" {
+			return nil, fmt.Errorf("line %d: ENV expects KEY=value pairs, got %q", instruction.Line, word)
+		}
+	}
+	return words, nil
+}
+
+// setEnv replaces the value of a variable in env or adds it
+func setEnv(env []string, pair string) []string {
+	key, _, _ := strings.Cut(pair, "=")
+	for i, existing := range env {
+		if strings.HasPrefix(existing, key+"=") {
+			updated := append([]string(nil), env...)
+			updated[i] = pair
+			return updated
+		}
+	}
+	return append(append([]string(nil), env...), pair)
+}
+
+// workDir resolves the WORKDIR argument against the current working directory
+func workDir(current, dir string) string {
+	if path.IsAbs(dir) {
+		return path.Clean(dir)
+	}
+	if current == "" {
+		current = "/"
+	}
+	return path.Join(current, dir)
+}
+
+// splitWords splits on spaces outside quotes, honouring backslash escapes
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
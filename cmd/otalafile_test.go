@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeOtalafile writes content to an Otalafile in a temporary directory and returns its path
+func writeOtalafile(t *testing.T, content string) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), "Otalafile")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestParseOtalafile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    []buildInstruction
+		err     string
+	}{
+		{
+			name:    "comments and blank lines",
+			content: "# base\n\nFROM alpine\n  # indented comment\nrun echo hi\n",
+			want: []buildInstruction{
+				{Line: 3, Command: "FROM", Args: "alpine"},
+				{Line: 5, Command: "RUN", Args: "echo hi"},
+			},
+		},
+		{
+			name:    "continuation lines",
+			content: "FROM alpine\nRUN apk add \\\n    curl \\\n    git\nCMD [\"sh\"]\n",
+			want: []buildInstruction{
+				{Line: 1, Command: "FROM", Args: "alpine"},
+				{Line: 2, Command: "RUN", Args: "apk add curl git"},
+				{Line: 5, Command: "CMD", Args: `["sh"]`},
+			},
+		},
+		{
+			name:    "comment inside a continuation",
+			content: "FROM alpine\nRUN echo a \\\n# skipped\n  b\n",
+			want: []buildInstruction{
+				{Line: 1, Command: "FROM", Args: "alpine"},
+				{Line: 2, Command: "RUN", Args: "echo a b"},
+			},
+		},
+		{
+			name:    "tab after the instruction",
+			content: "FROM\talpine\nRUN\t\techo hi\n",
+			want: []buildInstruction{
+				{Line: 1, Command: "FROM", Args: "alpine"},
+				{Line: 2, Command: "RUN", Args: "echo hi"},
+			},
+		},
+		{name: "empty file", content: "# nothing\n", err: "has no instructions"},
+		{name: "FROM missing", content: "RUN true\n", err: "line 1: the first instruction must be FROM"},
+		{name: "second FROM", content: "FROM a\nRUN true\nFROM b\n", err: "line 3: only one FROM is supported"},
+		{name: "unknown instruction", content: "FROM a\nEXPOSE 80\n", err: "line 2: unknown instruction EXPOSE"},
+		{name: "missing arguments", content: "FROM a\nWORKDIR\n", err: "line 2: WORKDIR needs arguments"},
+		{name: "continuation at the end", content: "FROM a\nRUN echo \\\n", err: "line 2: continuation at the end of the file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseOtalafile(writeOtalafile(t, tc.content))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error with %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, expected %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "a b\tc", want: []string{"a", "b", "c"}},
+		{in: "  a   b  ", want: []string{"a", "b"}},
+		{in: `"a b" 'c d'`, want: []string{"a b", "c d"}},
+		{in: `a\ b c`, want: []string{"a b", "c"}},
+		{in: `"a \"quoted\" b"`, want: []string{`a "quoted" b`}},
+		{in: `'no \escape'`, want: []string{`no \escape`}},
+		{in: `x"y z"w`, want: []string{"xy zw"}},
+		{in: `""`, want: []string{""}},
+		{in: `"open`, err: true},
+		{in: `'open`, err: true},
+	} {
+		got, err := splitWords(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q (%v), expected %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestEnvArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args string
+		want []string
+		err  string
+	}{
+		{args: "KEY value", want: []string{"KEY=value"}},
+		{args: "KEY a value with spaces", want: []string{"KEY=a value with spaces"}},
+		{args: "KEY\tvalue", want: []string{"KEY=value"}},
+		{args: "KEY=value", want: []string{"KEY=value"}},
+		{args: "A=1 B=2", want: []string{"A=1", "B=2"}},
+		{args: `A="x y" B=z\ w`, want: []string{"A=x y", "B=z w"}},
+		{args: `EMPTY=""`, want: []string{"EMPTY="}},
+		{args: "KEY", err: `line 7: ENV KEY needs a value, use ENV KEY="" for an empty one`},
+		{args: "A=1 B", err: `line 7: ENV expects KEY=value pairs, got "B"`},
+		{args: "A=1 =2", err: `line 7: ENV expects KEY=value pairs, got "=2"`},
+		{args: `A="1`, err: "line 7: unterminated quote"},
+	} {
+		got, err := envArgs(buildInstruction{Line: 7, Command: "ENV", Args: tc.args})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %q (%v)", tc.args, tc.err, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q (%v), expected %q", tc.args, got, err, tc.want)
+		}
+	}
+}
+
+func TestCopyArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args    string
+		sources []string
+		dest    string
+		err     string
+	}{
+		{args: "app.py /app/", sources: []string{"app.py"}, dest: "/app/"},
+		{args: "a b\t/dest", sources: []string{"a", "b"}, dest: "/dest"},
+		{args: `"my file" /dest`, sources: []string{"my file"}, dest: "/dest"},
+		{args: `["a b", "c", "/dest/"]`, sources: []string{"a b", "c"}, dest: "/dest/"},
+		{args: "only", err: "line 3: COPY needs at least one source and a destination"},
+		{args: `["only"]`, err: "line 3: COPY needs at least one source and a destination"},
+		{args: `["a", 1]`, err: "line 3: COPY expects a JSON array of strings"},
+		{args: "--chown=1 a /b", err: "line 3: COPY option --chown=1 is not supported"},
+	} {
+		sources, dest, err := copyArgs(buildInstruction{Line: 3, Command: "COPY", Args: tc.args})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.args, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(sources, tc.sources) || dest != tc.dest {
+			t.Errorf("%s: got %q %q (%v), expected %q %q", tc.args, sources, dest, err, tc.sources, tc.dest)
+		}
+	}
+}
+
+func TestCommandArgv(t *testing.T) {
+	for _, tc := range []struct {
+		args string
+		want []string
+		err  bool
+	}{
+		{args: "echo $HOME && ls", want: []string{"/bin/sh", "-c", "echo $HOME && ls"}},
+		{args: `["python3", "-m", "http.server"]`, want: []string{"python3", "-m", "http.server"}},
+		{args: `[]`, err: true},
+		{args: `["python3", `, err: true},
+		{args: `[1, 2]`, err: true},
+	} {
+		got, err := commandArgv(buildInstruction{Line: 4, Command: "CMD", Args: tc.args})
+		if tc.err {
+			if err == nil || !strings.Contains(err.Error(), "line 4: CMD expects a non-empty JSON array") {
+				t.Errorf("%s: expected a JSON array error, got %q (%v)", tc.args, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q (%v), expected %q", tc.args, got, err, tc.want)
+		}
+	}
+}
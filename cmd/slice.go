@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/systemd"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"sort"
+	"time"
+)
+
+// sliceCommand groups the commands managing the systemd slice containers run in
+func sliceCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "slice",
+		Usage: "Manage the systemd slice that groups containers",
+		Commands: []*cli.Command{
+			{
+				Name:      "configure",
+				Usage:     "Set aggregate limits for all containers in a slice",
+				ArgsUsage: "[slice]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "memory",
+						Usage: "Total memory for all containers in the slice (e.g., 8g)",
+					},
+					&cli.FloatFlag{
+						Name:  "cpus",
+						Usage: "Total number of CPUs for all containers in the slice (e.g., 4)",
+					},
+					&cli.Uint64Flag{
+						Name:  "pids-limit",
+						Usage: "Total number of processes for all containers in the slice",
+					},
+				},
+				Action: configureSlice,
+			},
+			{
+				Name:      "stats",
+				Usage:     "Show aggregate and per-container resource usage of a slice",
+				ArgsUsage: "[slice]",
+				Action:    sliceStats,
+			},
+		},
+	}
+}
+
+// sliceArg returns the slice named on the command line, defaulting to otala.slice
+func sliceArg(cmd *cli.Command) string {
+	if cmd.Args().Len() > 0 {
+		return cmd.Args().First()
+	}
+	return systemd.DefaultSlice
+}
+
+// configureSlice applies MemoryMax, CPUQuota and TasksMax to a slice
+func configureSlice(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	slice := sliceArg(cmd)
+
+	var limits runConfig.Resources
+	if cmd.IsSet("memory") {
+		memory, err := runConfig.ParseSize(cmd.String("memory"))
+		if err != nil {
+			return fmt.Errorf("--memory: %w", err)
+		}
+		limits.Memory = memory
+	}
+	if cmd.Float("cpus") < 0 {
+		return fmt.Errorf("--cpus must not be negative")
+	}
+	limits.CPUs = cmd.Float("cpus")
+	limits.PidsLimit = cmd.Uint64("pids-limit")
+
+	if err := systemd.ConfigureSlice(slice, limits); err != nil {
+		return err
+	}
+
+	color.New(color.FgGreen).Printf("✅ Configured %s\n", slice)
+	return nil
+}
+
+// sliceStats prints the usage of the slice followed by each of its containers
+func sliceStats(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	slice := sliceArg(cmd)
+
+	cgroupPath, stats, err := systemd.SliceStats(slice)
+	if err != nil {
+		return err
+	}
+
+	color.New(color.FgYellow, color.Bold).Printf("📊 %s (%s)\n", slice, cgroupPath)
+	printStats(stats)
+
+	containers, err := runConfig.ListContainers()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	states := make(map[string]*runConfig.ContainerState)
+	for _, state := range containers {
+		if state.CgroupParent == slice {
+			names = append(names, state.Name)
+			states[state.Name] = state
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		containerStats, err := systemd.ReadStats(states[name].CgroupPath)
+		if err != nil {
+			// Scopes only exist while a container is running
+			continue
+		}
+		color.New(color.FgCyan).Printf("\n  %s\n", name)
+		printStats(containerStats)
+	}
+	return nil
+}
+
+// printStats prints resource usage in the same layout as the exit summary
+func printStats(stats *systemd.Stats) {
+	fmt.Printf("    Memory peak: %s\n", runConfig.FormatSize(stats.MemoryPeak))
+	fmt.Printf("    CPU time:    %s (user %s, system %s)\n",
+		time.Duration(stats.CPUUsageUsec)*time.Microsecond,
+		time.Duration(stats.CPUUserUsec)*time.Microsecond,
+		time.Duration(stats.CPUSystemUsec)*time.Microsecond)
+	fmt.Printf("    Pids peak:   %d\n", stats.PidsPeak)
+	fmt.Printf("    IO:          read %s in %d ops, wrote %s in %d ops\n",
+		runConfig.FormatSize(stats.IOReadBytes), stats.IOReadOps, runConfig.FormatSize(stats.IOWriteBytes), stats.IOWriteOps)
+}
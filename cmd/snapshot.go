@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/isolator"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"github.com/Simeon2001/AlpineCell/systemd"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// snapshotsDirName is the directory next to a container's upper layer holding its snapshots
+const snapshotsDirName = "snapshots"
+
+// snapshotNamePattern keeps snapshot names usable as directory names
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// snapshotInfo is kept as snapshot.json next to the saved layer
+type snapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Size    uint64    `json:"size"`
+	// Layer is the directory that was saved, "upper" or "vfs" for the vfs storage driver
+	Layer string `json:"layer"`
+	// Project is set when the changes made to an --overlay-mount project were saved as well
+	Project bool `json:"project,omitempty"`
+}
+
+// snapshotProjectDir holds the --overlay-mount changes inside a snapshot
+const snapshotProjectDir = "project"
+
+// snapshotCommand groups the commands checkpointing a container's writable layer
+func snapshotCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "snapshot",
+		Usage: "Save and restore checkpoints of a container's writable layer and --overlay-mount changes",
+		Commands: []*cli.Command{
+			{
+				Name:      "save",
+				Usage:     "Save the container's writable layer and its --overlay-mount changes under a name",
+				ArgsUsage: "<container-id> <name>",
+				Action:    saveSnapshot,
+			},
+			{
+				Name:      "restore",
+				Usage:     "Replace the container's writable layer and --overlay-mount changes with a saved snapshot",
+				ArgsUsage: "<container-id> <name>",
+				Action:    restoreSnapshot,
+			},
+			{
+				Name:      "ls",
+				Aliases:   []string{"list"},
+				Usage:     "List the snapshots of a container",
+				ArgsUsage: "<container-id>",
+				Action:    listSnapshots,
+			},
+			{
+				Name:      "rm",
+				Usage:     "Delete a snapshot",
+				ArgsUsage: "<container-id> <name>",
+				Action:    removeSnapshot,
+			},
+		},
+	}
+}
+
+// containerRunning reports whether the cgroup of a container still exists
+func containerRunning(state *runConfig.ContainerState) bool {
+	_, err := systemd.ReadStats(state.CgroupPath)
+	return err == nil
+}
+
+// ensureStopped refuses to touch the storage of a running container
+func ensureStopped(state *runConfig.ContainerState) error {
+	if containerRunning(state) {
+		return fmt.Errorf("container %s is running, wait for it to exit first", state.Name)
+	}
+	return nil
+}
+
+// writableLayer returns the name and path of the directory holding a container's changes
+func writableLayer(paths *containerPaths) (string, string) {
+	if vfsPath := isolator.VFSPath(paths.Upper); dirExists(vfsPath) {
+		return "vfs", vfsPath
+	}
+	return "upper", paths.Upper
+}
+
+// snapshotsDir returns where the snapshots of a container live
+func snapshotsDir(paths *containerPaths) string {
+	return filepath.Join(filepath.Dir(paths.Upper), snapshotsDirName)
+}
+
+// loadSnapshots reads the metadata of every snapshot of a container, oldest first
+func loadSnapshots(paths *containerPaths) ([]*snapshotInfo, error) {
+	entries, err := os.ReadDir(snapshotsDir(paths))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*snapshotInfo
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(snapshotsDir(paths), entry.Name(), "snapshot.json"))
+		if err != nil {
+			// Half-written snapshots have no metadata yet
+			continue
+		}
+		var info snapshotInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot %s: %w", entry.Name(), err)
+		}
+		snapshots = append(snapshots, &info)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// snapshotArgs loads the container and checks the snapshot name of a save, restore or rm
+func snapshotArgs(cmd *cli.Command) (*runConfig.ContainerState, *containerPaths, string, error) {
+	if cmd.Args().Len() != 2 {
+		return nil, nil, "", fmt.Errorf("usage: otala-box snapshot %s <container-id> <name>", cmd.Name)
+	}
+	name := cmd.Args().Get(1)
+	if !snapshotNamePattern.MatchString(name) {
+		return nil, nil, "", fmt.Errorf("invalid snapshot name %q, use letters, digits, '.', '_' and '-'", name)
+	}
+
+	containerConfigPath, err := runConfig.FindContainer(cmd.Args().Get(0))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	state, err := runConfig.LoadState(containerConfigPath)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to load container state: %w", err)
+	}
+	paths, err := readContainerPaths(containerConfigPath)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return state, paths, name, nil
+}
+
+// resetContainer discards everything a container changed, back to the pristine image
+func resetContainer(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	containerConfigPath, state, err := loadContainerArg(cmd)
+	if err != nil {
+		return err
+	}
+	if err := ensureStopped(state); err != nil {
+		return err
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	paths, err := readContainerPaths(containerConfigPath)
+	if err != nil {
+		return err
+	}
+	if err := replaceWritableLayer(paths, "", ""); err != nil {
+		return fmt.Errorf("failed to reset %s: %w", state.Name, err)
+	}
+	if err := replaceProjectChanges(paths, false, ""); err != nil {
+		return fmt.Errorf("failed to reset the --overlay-mount changes of %s: %w", state.Name, err)
+	}
+
+	color.New(color.FgGreen).Printf("✅ Reset %s to its image, snapshots were kept\n", state.Name)
+	return nil
+}
+
+// replaceWritableLayer empties the upper, work and vfs directories of a container. When source is
+// set, it is then moved into place as the layer called name.
+func replaceWritableLayer(paths *containerPaths, name, source string) error {
+	for _, dir := range []string{paths.Upper, paths.Work, isolator.VFSPath(paths.Upper)} {
+		if dir == "" {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	if source != "" {
+		target := paths.Upper
+		if name == "vfs" {
+			target = isolator.VFSPath(paths.Upper)
+		}
+		if err := os.Rename(source, target); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []string{paths.Upper, paths.Work} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceProjectChanges empties the --overlay-mount upper and work directories of a container. When
+// restore is set, source is then moved into place as the upper directory.
+func replaceProjectChanges(paths *containerPaths, restore bool, source string) error {
+	projectUpper, _ := isolator.ProjectOverlayPaths(paths.Upper)
+	if err := os.RemoveAll(filepath.Dir(projectUpper)); err != nil {
+		return err
+	}
+	if !restore {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(projectUpper), 0755); err != nil {
+		return err
+	}
+	return os.Rename(source, projectUpper)
+}
+
+// saveSnapshot checkpoints a container's writable layer and the changes to its --overlay-mount
+// project. Files unchanged since the latest snapshot are hardlinked to it, the rest is reflinked or
+// copied: the upper layers themselves are written in place by the container, so they are never
+// shared with a snapshot.
+func saveSnapshot(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	state, paths, name, err := snapshotArgs(cmd)
+	if err != nil {
+		return err
+	}
+	if err := ensureStopped(state); err != nil {
+		return err
+	}
+	target := filepath.Join(snapshotsDir(paths), name)
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("snapshot %s of %s already exists", name, state.Name)
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	layerName, layerPath := writableLayer(paths)
+	if err := os.MkdirAll(layerPath, 0755); err != nil {
+		return err
+	}
+
+	snapshots, err := loadSnapshots(paths)
+	if err != nil {
+		return err
+	}
+	var linkDest, projectLinkDest string
+	for _, previous := range snapshots {
+		if previous.Layer == layerName {
+			linkDest = filepath.Join(snapshotsDir(paths), previous.Name, previous.Layer)
+		}
+		if previous.Project {
+			projectLinkDest = filepath.Join(snapshotsDir(paths), previous.Name, snapshotProjectDir)
+		}
+	}
+
+	staging := filepath.Join(snapshotsDir(paths), ".tmp-"+name)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if err := utils.CopyTree(layerPath, filepath.Join(staging, layerName), utils.CopyOptions{LinkDest: linkDest}); err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+
+	info := snapshotInfo{Name: name, Created: time.Now(), Layer: layerName}
+	info.Size, _ = utils.DirSize(filepath.Join(staging, layerName))
+
+	if projectUpper, _ := isolator.ProjectOverlayPaths(paths.Upper); dirExists(projectUpper) {
+		projectCopy := filepath.Join(staging, snapshotProjectDir)
+		if err := utils.CopyTree(projectUpper, projectCopy, utils.CopyOptions{LinkDest: projectLinkDest}); err != nil {
+			return fmt.Errorf("failed to save the --overlay-mount changes: %w", err)
+		}
+		info.Project = true
+		projectSize, _ := utils.DirSize(projectCopy)
+		info.Size += projectSize
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(staging, "snapshot.json"), data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, target); err != nil {
+		return err
+	}
+
+	color.New(color.FgGreen).Printf("✅ Saved snapshot %s of %s (%s)\n", name, state.Name, runConfig.FormatSize(info.Size))
+	return nil
+}
+
+// restoreSnapshot replaces a container's writable layer with a copy of a snapshot, which stays
+// available to restore again
+func restoreSnapshot(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	state, paths, name, err := snapshotArgs(cmd)
+	if err != nil {
+		return err
+	}
+	if err := ensureStopped(state); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(snapshotsDir(paths), name, "snapshot.json"))
+	if err != nil {
+		return fmt.Errorf("snapshot %s of %s not found", name, state.Name)
+	}
+	var info snapshotInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("failed to parse snapshot %s: %w", name, err)
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	// Copy next to the live layer first, so a failed copy leaves the container as it was
+	staging := filepath.Join(filepath.Dir(paths.Upper), ".restore-"+info.Layer)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := utils.CopyTree(filepath.Join(snapshotsDir(paths), name, info.Layer), staging, utils.CopyOptions{}); err != nil {
+		return fmt.Errorf("failed to copy snapshot %s: %w", name, err)
+	}
+	projectStaging := filepath.Join(filepath.Dir(paths.Upper), ".restore-"+snapshotProjectDir)
+	if err := os.RemoveAll(projectStaging); err != nil {
+		return err
+	}
+	defer os.RemoveAll(projectStaging)
+	if info.Project {
+		if err := utils.CopyTree(filepath.Join(snapshotsDir(paths), name, snapshotProjectDir), projectStaging, utils.CopyOptions{}); err != nil {
+			return fmt.Errorf("failed to copy snapshot %s: %w", name, err)
+		}
+	}
+
+	if err := replaceWritableLayer(paths, info.Layer, staging); err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %w", name, err)
+	}
+	// A snapshot without project changes was taken before any were made, so they are dropped
+	if err := replaceProjectChanges(paths, info.Project, projectStaging); err != nil {
+		return fmt.Errorf("failed to restore the --overlay-mount changes of snapshot %s: %w", name, err)
+	}
+
+	color.New(color.FgGreen).Printf("✅ Restored %s to snapshot %s\n", state.Name, name)
+	return nil
+}
+
+// listSnapshots prints the snapshots of a container
+func listSnapshots(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	containerConfigPath, state, err := loadContainerArg(cmd)
+	if err != nil {
+		return err
+	}
+	paths, err := readContainerPaths(containerConfigPath)
+	if err != nil {
+		return err
+	}
+	snapshots, err := loadSnapshots(paths)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		color.New(color.FgYellow).Printf("No snapshots of %s\n", state.Name)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCREATED\tSIZE")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", snapshot.Name,
+			snapshot.Created.Format("2006-01-02 15:04:05"), runConfig.FormatSize(snapshot.Size))
+	}
+	return tw.Flush()
+}
+
+// removeSnapshot deletes a snapshot of a container
+func removeSnapshot(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	state, paths, name, err := snapshotArgs(cmd)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(snapshotsDir(paths), name)
+	if _, err := os.Stat(target); err != nil {
+		return fmt.Errorf("snapshot %s of %s not found", name, state.Name)
+	}
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return fmt.Errorf("failed to remove snapshot %s: %w", name, err)
+	}
+	color.New(color.FgGreen).Printf("✅ Removed snapshot %s of %s\n", name, state.Name)
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Simeon2001/AlpineCell/image"
+	"github.com/Simeon2001/AlpineCell/isolator"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"path/filepath"
+)
+
+// syncContainer applies what a container created, changed and deleted in its copy of the project
+// to the host project. Paths the host changed since the copy was made are conflicts and left alone.
+func syncContainer(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	containerConfigPath, state, err := loadContainerArg(cmd)
+	if err != nil {
+		return err
+	}
+	if !cmd.Bool("exited") {
+		if err := ensureStopped(state); err != nil {
+			return err
+		}
+	}
+	// Files written by other users in the container are only readable from its user namespace
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	paths, err := readContainerPaths(containerConfigPath)
+	if err != nil {
+		return err
+	}
+	manifest, err := isolator.LoadCopyManifest(paths.Upper)
+	if err != nil {
+		return fmt.Errorf("cannot sync %s: %w", state.Name, err)
+	}
+	_, layerPath := writableLayer(paths)
+	copyDir := filepath.Join(layerPath, isolator.ProjectDirPrefix+state.ID)
+
+	changes, copied, err := isolator.PlanCopyBack(manifest, copyDir)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		color.New(color.FgGreen).Printf("✅ %s has no changes to sync to %s\n", state.Name, manifest.Source)
+		return nil
+	}
+
+	conflicts := printChanges(changes)
+	if cmd.Bool("dry-run") {
+		return nil
+	}
+
+	if err := isolator.CopyBack(manifest, paths.Upper, copyDir, changes, copied); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", state.Name, err)
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("synced %d changes to %s, %d conflicting paths were left alone",
+			len(changes)-conflicts, manifest.Source, conflicts)
+	}
+	color.New(color.FgGreen).Printf("✅ Synced %d changes to %s\n", len(changes), manifest.Source)
+	return nil
+}
+
+// printChanges lists the changes of a sync and returns how many are conflicts
+func printChanges(changes []utils.TreeChange) int {
+	symbols := map[utils.ChangeKind]string{
+		utils.ChangeCreated:  "+",
+		utils.ChangeModified: "~",
+		utils.ChangeDeleted:  "-",
+	}
+	conflicts := 0
+	for _, change := range changes {
+		if change.Conflict {
+			conflicts++
+			color.New(color.FgRed).Printf("  ! %s (%s in the container, changed on the host too)\n", change.Path, change.Kind)
+			continue
+		}
+		fmt.Printf("  %s %s\n", symbols[change.Kind], change.Path)
+	}
+	return conflicts
+}
+
+// diffContainer lists what a container changed in the project it ran on with --overlay-mount,
+// compared with the host directory
+func diffContainer(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	containerConfigPath, state, err := loadContainerArg(cmd)
+	if err != nil {
+		return err
+	}
+	paths, err := readContainerPaths(containerConfigPath)
+	if err != nil {
+		return err
+	}
+	upper, _ := isolator.ProjectOverlayPaths(paths.Upper)
+	if !dirExists(upper) {
+		return fmt.Errorf("%s has not been run with --overlay-mount", state.Name)
+	}
+	// Files written by other users in the container are only readable from its user namespace
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	changes, err := image.UpperChanges(upper, state.ProjectDir)
+	if err != nil {
+		return fmt.Errorf("failed to diff %s: %w", state.Name, err)
+	}
+	if len(changes) == 0 {
+		color.New(color.FgGreen).Printf("✅ %s left %s unchanged\n", state.Name, state.ProjectDir)
+		return nil
+	}
+
+	symbols := map[utils.ChangeKind]string{
+		utils.ChangeCreated:  "A",
+		utils.ChangeModified: "C",
+		utils.ChangeDeleted:  "D",
+	}
+	for _, change := range changes {
+		fmt.Printf("%s %s\n", symbols[change.Kind], change.Path)
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Simeon2001/AlpineCell/cache"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/image"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"github.com/Simeon2001/AlpineCell/volume"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// orphanGrace keeps prune off the directories of a container still being set up, which exist
+// for a moment before its state is written
+const orphanGrace = 10 * time.Minute
+
+// systemCommand groups the commands looking after the disk space otala-box uses
+func systemCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "system",
+		Usage: "Show and reclaim the disk space used by containers, images, volumes and caches",
+		Commands: []*cli.Command{
+			{
+				Name:   "df",
+				Usage:  "Show the space used by images, containers, volumes and caches",
+				Action: diskUsage,
+			},
+			{
+				Name:  "prune",
+				Usage: "Remove stopped containers, the build cache, dangling layers and orphaned storage",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "all",
+						Aliases: []string{"a"},
+						Usage:   "Also remove images no container uses and the built-in rootfs layer",
+					},
+					&cli.DurationFlag{
+						Name:  "until",
+						Usage: "Only remove what was last used longer ago than this, such as 72h",
+					},
+				},
+				Action: pruneSystem,
+			},
+		},
+	}
+}
+
+// containerStorage returns the directory holding a container's writable layer
+func containerStorage(dataDir string, state *runConfig.ContainerState) string {
+	if state.StoragePath != "" {
+		return state.StoragePath
+	}
+	return filepath.Join(dataDir, "storage", state.Name)
+}
+
+// lastUsed returns when a container last ran
+func lastUsed(state *runConfig.ContainerState) time.Time {
+	if state.LastRun.IsZero() {
+		return state.Created
+	}
+	return state.LastRun
+}
+
+// containerLowerDirs returns every lowerdir the containers run on
+func containerLowerDirs(containers map[string]*runConfig.ContainerState) map[string]bool {
+	lowers := make(map[string]bool)
+	for dir := range containers {
+		paths, err := readContainerPaths(dir)
+		if err != nil {
+			continue
+		}
+		for _, lower := range paths.Lowers {
+			lowers[lower] = true
+		}
+	}
+	return lowers
+}
+
+// keptLayers returns the digests of the stored layers the containers run on
+func keptLayers(store *image.Store, lowers map[string]bool) map[string]bool {
+	keep := make(map[string]bool)
+	for lower := range lowers {
+		if digest, err := store.LayerDigest(lower); err == nil {
+			keep[digest] = true
+		}
+	}
+	return keep
+}
+
+// usedImages returns the names of the images containers were created from and the default image
+func usedImages(store *image.Store, containers map[string]*runConfig.ContainerState) map[string]bool {
+	used := make(map[string]bool)
+	for _, state := range containers {
+		if state.Image != "" {
+			used[state.Image] = true
+		}
+	}
+	if name := store.Default(); name != "" {
+		used[name] = true
+	}
+	return used
+}
+
+// orphanedDirs returns the storage and config directories of containers without a state, left by
+// interrupted runs and builds, and the scratch directories of builds. Only what was last changed
+// before is returned.
+func orphanedDirs(dataDir, configDir string, containers map[string]*runConfig.ContainerState, before time.Time) []string {
+	known := make(map[string]bool)
+	for _, state := range containers {
+		known[state.Name] = true
+	}
+
+	var candidates []string
+	if entries, err := os.ReadDir(filepath.Join(dataDir, "storage")); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() && !known[entry.Name()] {
+				candidates = append(candidates, filepath.Join(dataDir, "storage", entry.Name()))
+			}
+		}
+	}
+	if dirs, err := filepath.Glob(filepath.Join(configDir, runConfig.ContainerPrefix+"*")); err == nil {
+		for _, dir := range dirs {
+			if !known[filepath.Base(dir)] {
+				candidates = append(candidates, dir)
+			}
+		}
+	}
+	if entries, err := os.ReadDir(filepath.Join(dataDir, "build")); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				candidates = append(candidates, filepath.Join(dataDir, "build", entry.Name()))
+			}
+		}
+	}
+	return changedBefore(candidates, before)
+}
+
+// legacyRootfs returns the rootfs directories extracted before the layer store that no container
+// runs on anymore and were last changed before
+func legacyRootfs(dataDir string, lowers map[string]bool, before time.Time) []string {
+	entries, err := os.ReadDir(filepath.Join(dataDir, "rootfs"))
+	if err != nil {
+		return nil
+	}
+	var unused []string
+	for _, entry := range entries {
+		dir := filepath.Join(dataDir, "rootfs", entry.Name())
+		inUse := false
+		for lower := range lowers {
+			if lower == dir || strings.HasPrefix(lower, dir+string(filepath.Separator)) {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			unused = append(unused, dir)
+		}
+	}
+	return changedBefore(unused, before)
+}
+
+// changedBefore keeps the paths last modified before a time
+func changedBefore(paths []string, before time.Time) []string {
+	var kept []string
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err == nil && info.ModTime().Before(before) {
+			kept = append(kept, path)
+		}
+	}
+	sort.Strings(kept)
+	return kept
+}
+
+// diskUsage prints how much space each kind of data takes up and how much prune could free
+func diskUsage(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	dataDir, configDir, err := runConfig.RuntimePaths()
+	if err != nil {
+		return err
+	}
+	containers, err := runConfig.ListContainers()
+	if err != nil {
+		return err
+	}
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+	lowers := containerLowerDirs(containers)
+	usage, err := store.DiskUsage(keptLayers(store, lowers), usedImages(store, containers))
+	if err != nil {
+		return err
+	}
+
+	running := 0
+	var containerSize, containerReclaimable uint64
+	for _, state := range containers {
+		size, _ := utils.DirSize(containerStorage(dataDir, state))
+		containerSize += size
+		if containerRunning(state) {
+			running++
+		} else {
+			containerReclaimable += size
+		}
+	}
+	leftovers := orphanedDirs(dataDir, configDir, containers, time.Now().Add(-orphanGrace))
+	for _, dir := range append(leftovers, legacyRootfs(dataDir, lowers, time.Now())...) {
+		size, _ := utils.DirSize(dir)
+		containerSize += size
+		containerReclaimable += size
+	}
+
+	volumes, err := volume.NewStore()
+	if err != nil {
+		return err
+	}
+	vols, err := volumes.List()
+	if err != nil {
+		return err
+	}
+	activeVolumes := 0
+	var volumeSize, volumeReclaimable uint64
+	for _, vol := range vols {
+		size, _ := utils.DirSize(vol.Path)
+		volumeSize += size
+		if users, _ := volume.Users(vol.Name); len(users) > 0 {
+			activeVolumes++
+		} else {
+			volumeReclaimable += size
+		}
+	}
+
+	root, err := cache.Root()
+	if err != nil {
+		return err
+	}
+	caches := cache.List(root)
+	inUse := cache.InUse(root)
+	activeCaches := 0
+	var cacheSize, cacheReclaimable uint64
+	for _, usage := range caches {
+		cacheSize += usage.Size
+		if inUse {
+			activeCaches++
+		} else {
+			cacheReclaimable += usage.Size
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE")
+	row := func(kind string, total, active int, size, reclaimable uint64) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", kind, total, active, runConfig.FormatSize(size), runConfig.FormatSize(reclaimable))
+	}
+	row("Images", usage.Images, usage.ActiveImages, usage.ImageSize, usage.ImageReclaimable)
+	row("Containers", len(containers), running, containerSize, containerReclaimable)
+	row("Volumes", len(vols), activeVolumes, volumeSize, volumeReclaimable)
+	row("Caches", len(caches), activeCaches, cacheSize, cacheReclaimable)
+	row("Build cache", usage.BuildSteps, 0, usage.BuildCacheSize, usage.BuildCacheSize)
+	return w.Flush()
+}
+
+// removeContainer deletes a stopped container's storage and config, and the ID file in its
+// project directory so the next run there starts a new container. It returns the space freed.
+func removeContainer(store *image.Store, dataDir, containerConfigPath string, state *runConfig.ContainerState) (uint64, error) {
+	storage := containerStorage(dataDir, state)
+	size, _ := utils.DirSize(storage)
+	if err := os.RemoveAll(storage); err != nil {
+		return 0, fmt.Errorf("failed to remove storage of %s: %w", state.Name, err)
+	}
+	// The state goes last, so a container removed halfway is still found by the next prune
+	if err := os.RemoveAll(containerConfigPath); err != nil {
+		return size, fmt.Errorf("failed to remove config of %s: %w", state.Name, err)
+	}
+	if err := store.ReleaseContainerLayers(state.Layers); err != nil {
+		return size, fmt.Errorf("failed to release layers of %s: %w", state.Name, err)
+	}
+	if state.ProjectDir != "" {
+		idFile := filepath.Join(state.ProjectDir, ".otalarunc-config")
+		if data, err := os.ReadFile(idFile); err == nil && strings.TrimSpace(string(data)) == state.ID {
+			if err := os.Remove(idFile); err != nil {
+				log.Printf("[⚠️] Failed to remove %s: %v", idFile, err)
+			}
+		}
+	}
+	return size, nil
+}
+
+// pruneSystem removes stopped containers, the build cache, dangling layers and directories no
+// container state accounts for, and with --all the images no container uses
+func pruneSystem(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 0 {
+		return fmt.Errorf("usage: otala-box system prune [--all] [--until <duration>]")
+	}
+	if cmd.Duration("until") < 0 {
+		return fmt.Errorf("--until must not be negative")
+	}
+	// Container layers hold files of other users, only removable from the user namespace
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+	cutoff := time.Now().Add(-cmd.Duration("until"))
+
+	dataDir, configDir, err := runConfig.RuntimePaths()
+	if err != nil {
+		return err
+	}
+	store, err := image.NewStore()
+	if err != nil {
+		return err
+	}
+	layersBefore, _ := utils.DirSize(filepath.Join(dataDir, "layers"))
+	var freed uint64
+
+	containers, err := runConfig.ListContainers()
+	if err != nil {
+		return err
+	}
+	dirs := make([]string, 0, len(containers))
+	for dir := range containers {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	removedContainers := 0
+	for _, dir := range dirs {
+		state := containers[dir]
+		if containerRunning(state) || lastUsed(state).After(cutoff) {
+			continue
+		}
+		size, err := removeContainer(store, dataDir, dir, state)
+		freed += size
+		if err != nil {
+			return err
+		}
+		delete(containers, dir)
+		removedContainers++
+		fmt.Printf("Removed container %s (%s)\n", state.Name, state.ProjectDir)
+	}
+
+	// A build's containers have no state until they are done, so they only look orphaned
+	before := cutoff
+	if grace := time.Now().Add(-orphanGrace); grace.Before(before) {
+		before = grace
+	}
+	lowers := containerLowerDirs(containers)
+	leftovers := legacyRootfs(dataDir, lowers, cutoff)
+	if release, err := lockBuilds(dataDir, true); err != nil {
+		log.Printf("[⚠️] A build is running, leaving directories of containers without a state alone")
+	} else {
+		leftovers = append(leftovers, orphanedDirs(dataDir, configDir, containers, before)...)
+		defer release()
+	}
+	for _, dir := range leftovers {
+		size, _ := utils.DirSize(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", dir, err)
+		}
+		freed += size
+		fmt.Printf("Removed orphaned %s\n", dir)
+	}
+
+	steps, err := store.PruneBuildCache(cutoff)
+	if err != nil {
+		return err
+	}
+
+	keep := keptLayers(store, lowers)
+	removedImages := 0
+	if cmd.Bool("all") {
+		used := usedImages(store, containers)
+		images, err := store.List()
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			if used[img.Name] || img.Created.After(cutoff) || anyKept(img.Layers, keep) {
+				continue
+			}
+			if err := store.Remove(img.Name, nil); err != nil {
+				return err
+			}
+			removedImages++
+			fmt.Printf("Removed image %s\n", img.Name)
+		}
+	}
+
+	layers, err := store.PruneLayers(keep, cmd.Bool("all"), cutoff)
+	if err != nil {
+		return err
+	}
+	if layersAfter, _ := utils.DirSize(filepath.Join(dataDir, "layers")); layersAfter < layersBefore {
+		freed += layersBefore - layersAfter
+	}
+
+	color.New(color.FgGreen).Printf("✅ Removed %d containers, %d images, %d build cache entries and %d dangling layers, reclaimed %s\n",
+		removedContainers, removedImages, steps, layers, runConfig.FormatSize(freed))
+	return nil
+}
+
+// anyKept reports whether a container runs on one of the layers
+func anyKept(layers []string, keep map[string]bool) bool {
+	for _, digest := range layers {
+		if keep[digest] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/systemd"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+)
+
+// updateContainer changes the resource limits of a container. Running containers get the new
+// limits applied to their scope immediately; either way they are stored for the next run.
+func updateContainer(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	containerConfigPath, state, err := loadContainerArg(cmd)
+	if err != nil {
+		return err
+	}
+
+	resources, err := parseResources(cmd, state.Resources)
+	if err != nil {
+		return err
+	}
+	if err := resources.Validate(); err != nil {
+		return err
+	}
+
+	running, err := systemd.UpdateResources(state.Name, state.CgroupPath, resources)
+	if err != nil {
+		return fmt.Errorf("failed to update running container: %w", err)
+	}
+
+	state.Resources = resources
+	if err := runConfig.SaveState(containerConfigPath, state); err != nil {
+		return err
+	}
+
+	if running {
+		color.New(color.FgGreen).Printf("✅ Updated limits of running container %s\n", state.Name)
+	} else {
+		color.New(color.FgYellow).Printf("Container %s is not running, new limits apply on its next run\n", state.Name)
+	}
+	return nil
+}
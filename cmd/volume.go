@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"github.com/Simeon2001/AlpineCell/volume"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// volumeCommand groups the commands managing named volumes
+func volumeCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "volume",
+		Usage: "Manage named volumes that keep data outside containers",
+		Commands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     "Create an empty volume",
+				ArgsUsage: "<name>",
+				Action:    createVolume,
+			},
+			{
+				Name:    "ls",
+				Aliases: []string{"list"},
+				Usage:   "List volumes and the containers using them",
+				Action:  listVolumes,
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Show where a volume is kept, its size and the containers using it",
+				ArgsUsage: "<name>",
+				Action:    inspectVolume,
+			},
+			{
+				Name:      "rm",
+				Usage:     "Remove a volume and its data, when no container uses it",
+				ArgsUsage: "<name>",
+				Action:    removeVolume,
+			},
+		},
+	}
+}
+
+// volumeReport is what volume inspect prints
+type volumeReport struct {
+	*volume.Volume
+	Mountpoint string   `json:"mountpoint"`
+	Size       uint64   `json:"size"`
+	UsedBy     []string `json:"usedBy"`
+}
+
+// createVolume makes a new empty volume
+func createVolume(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("usage: volume create <name>")
+	}
+	store, err := volume.NewStore()
+	if err != nil {
+		return err
+	}
+	vol, err := store.Create(cmd.Args().First())
+	if err != nil {
+		return err
+	}
+	color.New(color.FgGreen).Printf("✅ Created volume %s\n", vol.Name)
+	return nil
+}
+
+// listVolumes prints every volume with its size and users
+func listVolumes(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	store, err := volume.NewStore()
+	if err != nil {
+		return err
+	}
+	volumes, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tUSED BY\tCREATED")
+	for _, vol := range volumes {
+		users, err := volume.Users(vol.Name)
+		if err != nil {
+			return err
+		}
+		usedBy := "-"
+		if len(users) > 0 {
+			usedBy = strings.Join(users, ", ")
+		}
+		size, _ := utils.DirSize(vol.Path)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", vol.Name, runConfig.FormatSize(size), usedBy, vol.Created.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+// inspectVolume prints a volume as JSON
+func inspectVolume(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("usage: volume inspect <name>")
+	}
+	store, err := volume.NewStore()
+	if err != nil {
+		return err
+	}
+	vol, err := store.Get(cmd.Args().First())
+	if err != nil {
+		return err
+	}
+	users, err := volume.Users(vol.Name)
+	if err != nil {
+		return err
+	}
+	size, _ := utils.DirSize(vol.Path)
+
+	report := volumeReport{Volume: vol, Mountpoint: vol.Path, Size: size, UsedBy: users}
+	if report.UsedBy == nil {
+		report.UsedBy = []string{}
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// removeVolume deletes a volume after checking no container attaches it
+func removeVolume(ctx context.Context, cmd *cli.Command) error {
+	_ = ctx
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("usage: volume rm <name>")
+	}
+	name := cmd.Args().First()
+	store, err := volume.NewStore()
+	if err != nil {
+		return err
+	}
+	if _, err := store.Get(name); err != nil {
+		return err
+	}
+	// Files written by other users in a container are only removable from its user namespace
+	if reexecuted, err := inImageUserNS(); reexecuted {
+		return err
+	}
+
+	if err := store.Remove(name); err != nil {
+		return err
+	}
+	color.New(color.FgGreen).Printf("✅ Removed volume %s\n", name)
+	return nil
+}
@@ -3,15 +3,33 @@ package config
 type RunConfig struct {
 	Network         bool // true = pasta networking, false = no networking
 	DeleteWhenDone  bool // DeleteWhenDone specifies whether the container's resources should be removed upon completion of its execution.
-	MemoryLimit     int  // MemoryLimit in MB
+	MemoryLimit     int  // MemoryLimit in MB, superseded by Resources.Memory
 	ConfigPath      string
-	CopyMounts      string // host paths to copy into container
-	Mounts          string // host paths to mount into container
-	MountBool       bool   // MountBool indicates whether to use mount-based path handling in the container runtime.
+	CopyMounts      string   // host paths to copy into container
+	CopyExclude     []string // .gitignore style patterns left out of the copy, after the project's .otalaignore
+	CopyBack        bool     // apply the changes made to the copy back to the host on exit
+	Mounts          string   // host paths to mount into container
+	OverlayMount    string   // host path mounted as an overlay lowerdir, with the container's changes kept in storage
+	MountBool       bool     // MountBool indicates whether to use mount-based path handling in the container runtime.
 	Language        string
-	Script          string   // file path to script
-	Command         string   // direct command to execute
-	Args            []string // arguments to pass to the script/command
+	Script          string        // file path to script
+	Command         string        // direct command to execute
+	Args            []string      // arguments to pass to the script/command
+	Ulimits         []string      // rlimit overrides in name=soft:hard form, applied on top of config.json
+	Resources       Resources     // cgroup limits for the container's scope
+	StatsFile       string        // optional path where the exit resource usage is written as JSON
+	CgroupParent    string        // systemd slice the container's scope is placed in
+	CgroupDelegate  bool          // delegate a writable cgroup subtree to the container
+	StorageSize     uint64        // size limit of the ephemeral writable layer in bytes, 0 for unlimited
+	Ephemeral       bool          // keep the run's changes in a tmpfs layer discarded on exit
+	StorageDriver   string        // driver assembling the rootfs, empty to probe for one
+	DevSize         uint64        // size of /dev in bytes
+	ShmSize         uint64        // size of /dev/shm in bytes
+	Tmpfs           []TmpfsMount  // extra tmpfs mounts requested with --tmpfs
+	Volumes         []VolumeMount // named volumes requested with --volume
+	CacheDir        string        // host directory of the package manager caches shared with --cache, empty when off
+	Image           string        // stored image used as the rootfs, empty for the embedded Alpine
+	ImageConfig     ImageConfig   // Env, WorkingDir and default command of the image
 	ContainerConfig ContainerConfig
 }
 
@@ -19,6 +37,7 @@ type ContainerConfig struct {
 	ContainerID         string
 	ContainerPath       string
 	ContainerConfigPath string
+	CgroupPath          string
 }
 
 // SetContainerConfig sets the container ID, container path, and configuration path in the ContainerConfig struct.
@@ -27,3 +46,28 @@ func (r *RunConfig) SetContainerConfig(id, conPath, configPath string) {
 	r.ContainerConfig.ContainerPath = conPath
 	r.ContainerConfig.ContainerConfigPath = configPath
 }
+
+// ProjectDir returns the host directory given with --copy, --mount or --overlay-mount
+func (r *RunConfig) ProjectDir() string {
+	switch {
+	case r.Mounts != "":
+		return r.Mounts
+	case r.OverlayMount != "":
+		return r.OverlayMount
+	}
+	return r.CopyMounts
+}
+
+// ImageConfig is the runtime configuration an image ships with (its Env, WorkingDir, Entrypoint and Cmd)
+type ImageConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+}
+
+// HasDefaultCommand reports whether the image defines something to run without --command or --script
+func (i ImageConfig) HasDefaultCommand() bool {
+	return len(i.Entrypoint) > 0 || len(i.Cmd) > 0
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultShmSize matches the size /dev/shm has always been mounted with
+const DefaultShmSize uint64 = 64000 * 1024
+
+// DefaultDevSize matches the size /dev has always been mounted with
+const DefaultDevSize uint64 = 65536 * 1024
+
+// TmpfsMount is a tmpfs requested with --tmpfs /path[:size=..,mode=..,noexec]
+type TmpfsMount struct {
+	Destination string `json:"destination"`
+	Size        uint64 `json:"size"` // 0 leaves the kernel default of half the RAM
+	Mode        uint32 `json:"mode"`
+	NoExec      bool   `json:"noexec"`
+	ReadOnly    bool   `json:"readonly"`
+}
+
+// reservedMountPrefixes are mounted by the runtime itself and cannot take a user tmpfs
+var reservedMountPrefixes = []string{"/proc", "/sys", "/dev"}
+
+// ParseTmpfs parses a --tmpfs flag value
+func ParseTmpfs(spec string) (TmpfsMount, error) {
+	destination, options, _ := strings.Cut(spec, ":")
+	mount := TmpfsMount{Destination: filepath.Clean(destination), Mode: 01777}
+
+	if !filepath.IsAbs(destination) || mount.Destination == "/" {
+		return TmpfsMount{}, fmt.Errorf("invalid tmpfs %q: destination must be an absolute path other than /", spec)
+	}
+	for _, prefix := range reservedMountPrefixes {
+		if mount.Destination == prefix || strings.HasPrefix(mount.Destination, prefix+"/") {
+			return TmpfsMount{}, fmt.Errorf("invalid tmpfs %q: %s is managed by the runtime", spec, prefix)
+		}
+	}
+
+	if options == "" {
+		return mount, nil
+	}
+	for _, option := range strings.Split(options, ",") {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "size":
+			size, err := ParseSize(value)
+			if err != nil || size == 0 {
+				return TmpfsMount{}, fmt.Errorf("invalid tmpfs %q: bad size %q", spec, value)
+			}
+			mount.Size = size
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 07777 {
+				return TmpfsMount{}, fmt.Errorf("invalid tmpfs %q: bad mode %q, expected octal like 1777", spec, value)
+			}
+			mount.Mode = uint32(mode)
+		case "noexec":
+			mount.NoExec = true
+		case "exec":
+			mount.NoExec = false
+		case "ro":
+			mount.ReadOnly = true
+		case "rw":
+			mount.ReadOnly = false
+		default:
+			return TmpfsMount{}, fmt.Errorf("invalid tmpfs %q: unknown option %q", spec, option)
+		}
+	}
+	return mount, nil
+}
+
+// String formats the mount back into --tmpfs syntax for display
+func (t TmpfsMount) String() string {
+	options := []string{fmt.Sprintf("mode=%o", t.Mode)}
+	if t.Size != 0 {
+		options = append(options, fmt.Sprintf("size=%s", FormatSize(t.Size)))
+	}
+	if t.NoExec {
+		options = append(options, "noexec")
+	}
+	if t.ReadOnly {
+		options = append(options, "ro")
+	}
+	return t.Destination + ":" + strings.Join(options, ",")
+}
+
+// VolumeMount attaches a named volume, requested with --volume name:/path[:ro]
+type VolumeMount struct {
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readonly"`
+	// Source is the host directory holding the volume's data, filled in when the container starts
+	Source string `json:"source,omitempty"`
+}
+
+// volumeNamePattern is what a volume name may look like, it names a directory in the data dir
+var volumeNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ValidateVolumeName checks that name can be used for a volume
+func ValidateVolumeName(name string) error {
+	if !volumeNamePattern.MatchString(name) || len(name) > 128 {
+		return fmt.Errorf("invalid volume name %q: use letters, digits, '_', '.' and '-', starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// ParseVolume parses a --volume flag value
+func ParseVolume(spec string) (VolumeMount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return VolumeMount{}, fmt.Errorf("invalid volume %q: expected name:/path[:ro]", spec)
+	}
+	if err := ValidateVolumeName(parts[0]); err != nil {
+		return VolumeMount{}, err
+	}
+	mount := VolumeMount{Name: parts[0], Destination: filepath.Clean(parts[1])}
+
+	if !filepath.IsAbs(parts[1]) || mount.Destination == "/" {
+		return VolumeMount{}, fmt.Errorf("invalid volume %q: destination must be an absolute path other than /", spec)
+	}
+	for _, prefix := range reservedMountPrefixes {
+		if mount.Destination == prefix || strings.HasPrefix(mount.Destination, prefix+"/") {
+			return VolumeMount{}, fmt.Errorf("invalid volume %q: %s is managed by the runtime", spec, prefix)
+		}
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			mount.ReadOnly = true
+		case "rw":
+		default:
+			return VolumeMount{}, fmt.Errorf("invalid volume %q: unknown option %q, expected ro or rw", spec, parts[2])
+		}
+	}
+	return mount, nil
+}
+
+// String formats the mount back into --volume syntax for display
+func (v VolumeMount) String() string {
+	if v.ReadOnly {
+		return v.Name + ":" + v.Destination + ":ro"
+	}
+	return v.Name + ":" + v.Destination
+}
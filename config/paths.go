@@ -0,0 +1,30 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// RuntimePaths returns the paths for the runtime data and config directories.
+func RuntimePaths() (string, string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+
+	// Data directory (for rootfs, storage)
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		dataDir = filepath.Join(homeDir, ".local", "share")
+	}
+	runtimeDataDir := filepath.Join(dataDir, "otala-runc")
+
+	// Config directory (for config.json)
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		configDir = filepath.Join(homeDir, ".config")
+	}
+	runtimeConfigDir := filepath.Join(configDir, "otala-runc")
+
+	return runtimeDataDir, runtimeConfigDir, nil
+}
@@ -0,0 +1,52 @@
+package config
+
+import "fmt"
+
+// SwapUnlimited is the MemorySwap value meaning swap is not limited
+const SwapUnlimited int64 = -1
+
+// Resources holds the cgroup limits applied to the container's systemd scope.
+// Zero values mean "not set" and leave the systemd default in place.
+type Resources struct {
+	Memory            uint64  `json:"memory"`            // MemoryMax in bytes
+	MemorySwap        int64   `json:"memorySwap"`        // memory + swap in bytes (docker semantics), -1 for unlimited, 0 for no swap
+	MemoryReservation uint64  `json:"memoryReservation"` // MemoryLow in bytes
+	MemoryHigh        uint64  `json:"memoryHigh"`        // MemoryHigh in bytes
+	CPUs              float64 `json:"cpus"`              // CPU quota in number of CPUs, e.g. 1.5
+	PidsLimit         uint64  `json:"pidsLimit"`         // TasksMax
+}
+
+// SwapMax returns the MemorySwapMax value for systemd, which counts swap only
+func (r Resources) SwapMax() uint64 {
+	switch {
+	case r.MemorySwap == SwapUnlimited:
+		return ^uint64(0)
+	case r.MemorySwap <= 0 || uint64(r.MemorySwap) <= r.Memory:
+		return 0
+	default:
+		return uint64(r.MemorySwap) - r.Memory
+	}
+}
+
+// Validate checks the memory settings are consistent with each other
+func (r Resources) Validate() error {
+	if r.Memory == 0 {
+		return fmt.Errorf("memory limit must be greater than zero")
+	}
+	if r.MemoryHigh != 0 && r.MemoryHigh > r.Memory {
+		return fmt.Errorf("--memory-high (%s) cannot exceed --memory (%s)", FormatSize(r.MemoryHigh), FormatSize(r.Memory))
+	}
+	if r.MemoryReservation != 0 && r.MemoryReservation > r.Memory {
+		return fmt.Errorf("--memory-reservation (%s) cannot exceed --memory (%s)", FormatSize(r.MemoryReservation), FormatSize(r.Memory))
+	}
+	if r.MemoryReservation != 0 && r.MemoryHigh != 0 && r.MemoryReservation > r.MemoryHigh {
+		return fmt.Errorf("--memory-reservation (%s) cannot exceed --memory-high (%s)", FormatSize(r.MemoryReservation), FormatSize(r.MemoryHigh))
+	}
+	if r.CPUs < 0 {
+		return fmt.Errorf("--cpus must not be negative")
+	}
+	if r.MemorySwap != 0 && r.MemorySwap != SwapUnlimited && uint64(r.MemorySwap) < r.Memory {
+		return fmt.Errorf("--memory-swap (%s) must be at least --memory (%s), it includes the memory limit", FormatSize(uint64(r.MemorySwap)), FormatSize(r.Memory))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ContainerPrefix is prepended to a container's unique ID to form its name
+const ContainerPrefix = "otalacon-"
+
+// stateFileName is the file inside the container's config directory holding its state
+const stateFileName = "state.json"
+
+// ContainerState is what we persist about a container next to its config.json
+type ContainerState struct {
+	ID             string        `json:"id"`
+	Name           string        `json:"name"`
+	ProjectDir     string        `json:"projectDir"`
+	Created        time.Time     `json:"created"`
+	LastRun        time.Time     `json:"lastRun"`
+	CgroupPath     string        `json:"cgroupPath"`
+	CgroupParent   string        `json:"cgroupParent"`
+	CgroupDelegate bool          `json:"cgroupDelegate"`
+	Resources      Resources     `json:"resources"`
+	StorageSize    uint64        `json:"storageSize"`
+	Ephemeral      bool          `json:"ephemeral,omitempty"`
+	StoragePath    string        `json:"storagePath"`
+	DevSize        uint64        `json:"devSize,omitempty"`
+	ShmSize        uint64        `json:"shmSize"`
+	Tmpfs          []TmpfsMount  `json:"tmpfs"`
+	Volumes        []VolumeMount `json:"volumes,omitempty"`
+	Cache          bool          `json:"cache,omitempty"`
+	Image          string        `json:"image,omitempty"`
+	// Layers are the stored layers the container holds a reference on
+	Layers []string `json:"layers,omitempty"`
+}
+
+// SaveState writes the container state into its config directory
+func SaveState(containerConfigPath string, state *ContainerState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal container state: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(containerConfigPath, stateFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write container state: %v", err)
+	}
+	return nil
+}
+
+// LoadState reads the container state from its config directory
+func LoadState(containerConfigPath string) (*ContainerState, error) {
+	data, err := os.ReadFile(filepath.Join(containerConfigPath, stateFileName))
+	if err != nil {
+		return nil, err
+	}
+	var state ContainerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse container state: %v", err)
+	}
+	return &state, nil
+}
+
+// FindContainer resolves a full or abbreviated container ID (with or without the otalacon- prefix)
+// to the container's config directory
+func FindContainer(id string) (string, error) {
+	_, configDir, err := RuntimePaths()
+	if err != nil {
+		return "", err
+	}
+
+	id = strings.TrimPrefix(id, ContainerPrefix)
+	if id == "" || strings.ContainsAny(id, "/*?[\\") {
+		return "", fmt.Errorf("invalid container ID %q", id)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(configDir, ContainerPrefix+id+"*"))
+	if err != nil {
+		return "", err
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no such container: %s", id)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("container ID %s is ambiguous, %d containers match", id, len(matches))
+	}
+}
+
+// ListContainers returns the state of every container that has one, keyed by its config directory
+func ListContainers() (map[string]*ContainerState, error) {
+	_, configDir, err := RuntimePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(configDir, ContainerPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	containers := make(map[string]*ContainerState)
+	for _, dir := range dirs {
+		state, err := LoadState(dir)
+		if err != nil {
+			continue
+		}
+		containers[dir] = state
+	}
+	return containers, nil
+}
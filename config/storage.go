@@ -0,0 +1,25 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Storage drivers that assemble the container rootfs from the image layers, in the order they are probed
+const (
+	StorageDriverOverlay       = "overlay"
+	StorageDriverFuseOverlayfs = "fuse-overlayfs"
+	StorageDriverVFS           = "vfs"
+)
+
+// StorageDrivers lists the values --storage-driver accepts
+var StorageDrivers = []string{StorageDriverOverlay, StorageDriverFuseOverlayfs, StorageDriverVFS}
+
+// ValidateStorageDriver checks a --storage-driver value, empty meaning the driver is probed
+func ValidateStorageDriver(name string) error {
+	if name == "" || slices.Contains(StorageDrivers, name) {
+		return nil
+	}
+	return fmt.Errorf("unknown storage driver %q, expected one of %s", name, strings.Join(StorageDrivers, ", "))
+}
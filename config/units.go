@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits lists the accepted size suffixes and their multiplier (binary units, like docker).
+// Longer suffixes come first so "mb" is matched before "b".
+var sizeUnits = []struct {
+	suffix     string
+	multiplier uint64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"tb", 1 << 40},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30}, {"t", 1 << 40},
+	{"b", 1},
+}
+
+// ParseSize parses sizes such as "512m", "2g" or "1048576" into bytes
+func ParseSize(size string) (uint64, error) {
+	value := strings.ToLower(strings.TrimSpace(size))
+	multiplier := uint64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	// Whole numbers are multiplied exactly, only fractions go through float64
+	if whole, err := strconv.ParseUint(value, 10, 64); err == nil {
+		if hi, bytes := bits.Mul64(whole, multiplier); hi == 0 {
+			return bytes, nil
+		}
+		return 0, fmt.Errorf("invalid size %q: too large", size)
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 || math.IsInf(number, 0) || math.IsNaN(number) {
+		return 0, fmt.Errorf("invalid size %q: expected a number with an optional k, m, g or t suffix", size)
+	}
+
+	// float64(math.MaxUint64) rounds up to 2^64, the first value that no longer fits
+	bytes := number * float64(multiplier)
+	if bytes >= float64(math.MaxUint64) {
+		return 0, fmt.Errorf("invalid size %q: too large", size)
+	}
+	return uint64(bytes), nil
+}
+
+// FormatSize renders a byte count with the largest unit that keeps it readable
+func FormatSize(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
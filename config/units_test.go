@@ -0,0 +1,75 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want uint64
+		err  string
+	}{
+		{in: "1048576", want: 1 << 20},
+		{in: "512m", want: 512 << 20},
+		{in: " 2G ", want: 2 << 30},
+		{in: "1.5g", want: 3 << 29},
+		{in: "0.5k", want: 512},
+		{in: "100b", want: 100},
+		{in: "1kb", want: 1 << 10},
+		{in: "1kib", want: 1 << 10},
+		{in: "3KiB", want: 3 << 10},
+		{in: "4mib", want: 4 << 20},
+		{in: "1tb", want: 1 << 40},
+		{in: "18446744073709551615", want: 18446744073709551615},
+		{in: "17179869183g", want: 17179869183 << 30},
+		{in: "16777216t", err: "too large"},
+		{in: "17179869184g", err: "too large"},
+		{in: "99999999999999999999k", err: "too large"},
+		{in: "18446744073709551616", err: "too large"},
+		{in: "16777215.5t", want: 18446743523953737728},
+		{in: "16777216.5t", err: "too large"},
+		{in: "16384p", err: "expected a number"},
+		{in: "-1", err: "expected a number"},
+		{in: "", err: "expected a number"},
+		{in: "b", err: "expected a number"},
+		{in: "k", err: "expected a number"},
+		{in: "inf", err: "expected a number"},
+		{in: "nan", err: "expected a number"},
+		{in: "1e400", err: "expected a number"},
+		{in: "1 g", err: "expected a number"},
+	} {
+		got, err := ParseSize(tc.in)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: expected an error with %q, got %d (%v)", tc.in, tc.err, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %d, expected %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   uint64
+		want string
+	}{
+		{in: 0, want: "0B"},
+		{in: 1023, want: "1023B"},
+		{in: 1 << 10, want: "1.0KiB"},
+		{in: 3 << 29, want: "1.5GiB"},
+		{in: 2048 << 40, want: "2048.0TiB"},
+	} {
+		if got := FormatSize(tc.in); got != tc.want {
+			t.Errorf("%d: got %q, expected %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+)
+
+// OCI whiteout markers: ".wh.<name>" deletes name from lower layers, ".wh..wh..opq" hides
+// everything a lower layer had in the directory
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// layerSource is a layer blob waiting to be applied
+type layerSource struct {
+	digest string
+	open   func() (io.ReadCloser, error)
+}
+
+// digestReader hashes everything read through it so the blob can be verified afterwards
+type digestReader struct {
+	reader io.Reader
+	hasher hash.Hash
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.reader.Read(p)
+	d.hasher.Write(p[:n])
+	return n, err
+}
+
+// verify drains the rest of the blob, compares its sha256 with the expected digest and returns it
+func (d *digestReader) verify(expected string) (string, error) {
+	if _, err := io.Copy(io.Discard, d); err != nil {
+		return "", err
+	}
+	actual := "sha256:" + hex.EncodeToString(d.hasher.Sum(nil))
+	if expected != "" && actual != expected {
+		return "", fmt.Errorf("digest mismatch: expected %s, got %s", expected, actual)
+	}
+	return actual, nil
+}
+
+// applyLayerFrom opens a layer blob, unpacks it into the extractor's target and returns its verified digest
+func applyLayerFrom(ex *extractor, layer layerSource) (string, error) {
+	blob, err := layer.open()
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+
+	verifier := &digestReader{reader: blob, hasher: sha256.New()}
+	tarStream, err := Decompress(verifier)
+	if err != nil {
+		return "", err
+	}
+
+	if err := applyLayer(ex, tarStream); err != nil {
+		_ = tarStream.Close()
+		return "", err
+	}
+	if _, err := io.Copy(io.Discard, tarStream); err != nil {
+		return "", err
+	}
+	if err := tarStream.Close(); err != nil {
+		return "", err
+	}
+	return verifier.verify(layer.digest)
+}
+
+// applyLayer unpacks a layer tar stream into its own directory, turning OCI whiteouts into the
+// 0:0 character devices and opaque xattr overlayfs expects, so the directory can be a lowerdir
+func applyLayer(ex *extractor, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		if containsDotDot(hdr.Name) {
+			return fmt.Errorf("refusing entry %q outside the rootfs", hdr.Name)
+		}
+
+		dir, base := path.Split(name)
+
+		if base == whiteoutOpaque {
+			if err := ex.markOpaque(dir); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			hidden := strings.TrimPrefix(base, whiteoutPrefix)
+			if hidden == "" || hidden == "." || hidden == ".." || strings.Contains(hidden, "/") {
+				return fmt.Errorf("refusing whiteout %q that names no file", hdr.Name)
+			}
+			if err := ex.writeWhiteout(path.Join(dir, hidden)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := ex.writeEntry(name, hdr, tr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsDotDot reports whether any component of an archive path is ".."
+func containsDotDot(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
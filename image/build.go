@@ -0,0 +1,147 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BuildStep is the cached result of a build instruction: the layers of the image built up to and
+// including it, bottom first, and the image configuration at that point. Every step holds a
+// reference on its layers, so they outlive the images built from them.
+type BuildStep struct {
+	Key         string                `json:"key"`
+	Instruction string                `json:"instruction"`
+	Layers      []string              `json:"layers"`
+	Config      runConfig.ImageConfig `json:"config"`
+	Created     time.Time             `json:"created"`
+}
+
+// buildCacheDir returns where build steps are recorded, next to the image metadata
+func (s *Store) buildCacheDir() string {
+	return filepath.Join(filepath.Dir(s.metadataDir), "build-cache")
+}
+
+// buildStepPath returns the record of the build step with this cache key
+func (s *Store) buildStepPath(key string) string {
+	return filepath.Join(s.buildCacheDir(), key+".json")
+}
+
+// CachedStep returns the build step recorded under key, or nil when there is none or one of its
+// layers has gone missing
+func (s *Store) CachedStep(key string) (*BuildStep, error) {
+	data, err := os.ReadFile(s.buildStepPath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var step BuildStep
+	if err := json.Unmarshal(data, &step); err != nil {
+		return nil, fmt.Errorf("failed to parse build cache entry %s: %v", key, err)
+	}
+
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	for _, digest := range step.Layers {
+		if !s.hasLayer(digest) {
+			return nil, nil
+		}
+	}
+	return &step, nil
+}
+
+// CommitStep stores upper as a layer on top of parent and records the result under key,
+// replacing an earlier record of the same key
+func (s *Store) CommitStep(key, instruction string, parent []string, upper string, config runConfig.ImageConfig) (*BuildStep, error) {
+	if len(parent)+1 > MaxLayers {
+		return nil, fmt.Errorf("the build would have more than the %d layers an overlay can stack", MaxLayers)
+	}
+
+	layer, cleanup, err := s.archiveLayer(upper)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	staged, err := s.stageLayer(layer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store layer: %v", err)
+	}
+	defer staged.release()
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	s.cleanStaging()
+
+	digest, err := s.installLayer(staged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store layer: %v", err)
+	}
+	step := &BuildStep{
+		Key:         key,
+		Instruction: instruction,
+		Layers:      append(append([]string(nil), parent...), digest),
+		Config:      config,
+		Created:     time.Now(),
+	}
+	if err := s.saveStep(step); err != nil {
+		return nil, err
+	}
+	return step, nil
+}
+
+// saveStep records a build step with the store lock held, moving the layer references over from
+// a record it replaces
+func (s *Store) saveStep(step *BuildStep) error {
+	var previous *BuildStep
+	if data, err := os.ReadFile(s.buildStepPath(step.Key)); err == nil {
+		previous = &BuildStep{}
+		if err := json.Unmarshal(data, previous); err != nil {
+			previous = nil
+		}
+	}
+
+	if err := s.retainLayers(step.Layers); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(step, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.buildStepPath(step.Key), data); err != nil {
+		return err
+	}
+	if previous != nil {
+		return s.releaseLayers(previous.Layers)
+	}
+	return nil
+}
+
+// Tag records the result of a build as the image name, replacing an image of that name
+func (s *Store) Tag(name string, layers []string, config runConfig.ImageConfig, source string) (*Image, error) {
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("image %s would have no layers", name)
+	}
+	img := &Image{
+		Name:      name,
+		Reference: name,
+		Digest:    layers[len(layers)-1],
+		Layers:    layers,
+		Config:    config,
+		Source:    source,
+	}
+	if err := s.unpack(img, nil); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
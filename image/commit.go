@@ -0,0 +1,144 @@
+package image
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// Commit stores the upper layer of a container as a new layer stacked on the layers it runs on.
+// lowers are the container's lowerdirs, topmost first, and none when upper is a full copy of the rootfs;
+// base is the image the container was created from, whose configuration is carried over, or nil for
+// the embedded Alpine rootfs.
+func (s *Store) Commit(name string, base *Image, lowers []string, upper, container string) (*Image, error) {
+	if name == "" {
+		return nil, fmt.Errorf("an image name is required")
+	}
+
+	var chain []string
+	for i := len(lowers) - 1; i >= 0; i-- {
+		digest, err := s.LayerDigest(lowers[i])
+		if err != nil {
+			return nil, fmt.Errorf("container does not run on stored layers: %v", err)
+		}
+		chain = append(chain, digest)
+	}
+
+	layer, cleanup, err := s.archiveLayer(upper)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	img := &Image{
+		Name:      name,
+		Reference: name,
+		Digest:    layer.digest,
+		Layers:    append(chain, layer.digest),
+		Source:    "commit:" + container,
+	}
+	if base != nil {
+		img.Config = base.Config
+	}
+
+	if err := s.unpack(img, []layerSource{layer}); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// archiveLayer writes an upper directory out as a compressed layer next to the store, so it can be
+// addressed by its digest. cleanup removes the file once the layer has been stored.
+func (s *Store) archiveLayer(upper string) (layerSource, func(), error) {
+	layerFile, err := os.CreateTemp(s.layersDir, ".commit-*.tar.gz")
+	if err != nil {
+		return layerSource{}, nil, fmt.Errorf("failed to create layer file: %v", err)
+	}
+	cleanup := func() {
+		layerFile.Close()
+		os.Remove(layerFile.Name())
+	}
+
+	gzw := gzip.NewWriter(layerFile)
+	if err := writeLayer(upper, gzw); err != nil {
+		cleanup()
+		return layerSource{}, nil, fmt.Errorf("failed to archive upper layer: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		cleanup()
+		return layerSource{}, nil, err
+	}
+	digest, err := fileDigest(layerFile.Name())
+	if err != nil {
+		cleanup()
+		return layerSource{}, nil, err
+	}
+
+	layer := layerSource{
+		digest: digest,
+		open:   func() (io.ReadCloser, error) { return os.Open(layerFile.Name()) },
+	}
+	return layer, cleanup, nil
+}
+
+// Export writes the merged view of a container's lowerdirs (topmost first) and upper layer to w as
+// a flat tarball. They are stacked in a read-only overlay, which needs a mount namespace of our own;
+// without lowerdirs upper is archived as it is.
+func Export(lowers []string, upper string, w io.Writer) error {
+	if len(lowers) == 0 {
+		return WriteTar(upper, w)
+	}
+
+	mountPoint, err := os.MkdirTemp(filepath.Dir(upper), ".export-")
+	if err != nil {
+		return fmt.Errorf("failed to create export mount point: %v", err)
+	}
+	defer os.Remove(mountPoint)
+
+	mountDir, lowerdir, err := OverlayLowerdir(append([]string{upper}, lowers...))
+	if err != nil {
+		return err
+	}
+	options := fmt.Sprintf("lowerdir=%s,userxattr", lowerdir)
+	if err := MountOverlay(mountDir, mountPoint, unix.MS_RDONLY, options); err != nil {
+		return fmt.Errorf("failed to mount merged view: %v", err)
+	}
+	defer unix.Unmount(mountPoint, unix.MNT_DETACH)
+
+	return WriteTar(mountPoint, w)
+}
+
+// MountOverlay mounts an overlay at target. Relative lowerdirs are resolved against dir, so the
+// mount is made from there when dir is set, on a thread of its own whose working directory is not
+// shared with the rest of the process.
+func MountOverlay(dir, target string, flags uintptr, options string) error {
+	if dir == "" {
+		return unix.Mount("overlay", target, "overlay", flags, options)
+	}
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine instead of going back to
+		// the scheduler with a working directory of its own
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			result <- fmt.Errorf("failed to unshare the working directory: %v", err)
+			return
+		}
+		if err := unix.Chdir(dir); err != nil {
+			result <- err
+			return
+		}
+		result <- unix.Mount("overlay", target, "overlay", flags, options)
+	}()
+	return <-result
+}
@@ -0,0 +1,76 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// Magic numbers of the compression formats layers and rootfs tarballs come in
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicBzip2 = []byte("BZh")
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Decompress detects the compression of a stream from its first bytes and returns the
+// uncompressed tar stream. Plain tar is passed through; xz and zstd need the xz/zstd tools.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read archive header: %v", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(header, magicGzip):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(header, magicBzip2):
+		return io.NopCloser(bzip2.NewReader(buffered)), nil
+	case bytes.HasPrefix(header, magicXz):
+		return externalDecompress("xz", buffered)
+	case bytes.HasPrefix(header, magicZstd):
+		return externalDecompress("zstd", buffered)
+	default:
+		return io.NopCloser(buffered), nil
+	}
+}
+
+// commandReader streams the output of a decompression tool and reports its failure on Close
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close waits for the tool to exit
+func (c *commandReader) Close() error {
+	_ = c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %v", c.cmd.Path, err)
+	}
+	return nil
+}
+
+// externalDecompress pipes the stream through "<tool> -dc"
+func externalDecompress(tool string, r io.Reader) (io.ReadCloser, error) {
+	toolPath, err := exec.LookPath(tool)
+	if err != nil {
+		return nil, fmt.Errorf("archive is %s compressed but %s is not installed: %v", tool, tool, err)
+	}
+
+	cmd := exec.Command(toolPath, "-dc")
+	cmd.Stdin = r
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", tool, err)
+	}
+	return &commandReader{ReadCloser: stdout, cmd: cmd}, nil
+}
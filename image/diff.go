@@ -0,0 +1,189 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// UpperChanges lists what an overlay upper directory changes in lower, by slash separated path:
+// paths only in the upper were created, paths in both were modified and whiteouts were deleted.
+// Directories overlayfs only copied up to hold a change are left out; opaque ones replaced the
+// directory below them and count as modified.
+func UpperChanges(upper, lower string) ([]utils.TreeChange, error) {
+	var changes []utils.TreeChange
+	err := filepath.WalkDir(upper, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, walkPath)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		// fuse-overlayfs writes OCI style markers where it cannot create whiteout devices
+		base := path.Base(rel)
+		if base == whiteoutOpaque {
+			return nil
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			deleted := strings.TrimSuffix(rel, base) + strings.TrimPrefix(base, whiteoutPrefix)
+			changes = append(changes, utils.TreeChange{Path: deleted, Kind: utils.ChangeDeleted})
+			return nil
+		}
+		if isWhiteout(info) {
+			changes = append(changes, utils.TreeChange{Path: rel, Kind: utils.ChangeDeleted})
+			return nil
+		}
+
+		_, err = os.Lstat(filepath.Join(lower, filepath.FromSlash(rel)))
+		switch {
+		case os.IsNotExist(err):
+			changes = append(changes, utils.TreeChange{Path: rel, Kind: utils.ChangeCreated})
+		case err != nil:
+			return err
+		case !d.IsDir():
+			changes = append(changes, utils.TreeChange{Path: rel, Kind: utils.ChangeModified})
+		default:
+			opaque, err := opaqueDir(walkPath)
+			if err != nil {
+				return err
+			}
+			if opaque {
+				changes = append(changes, utils.TreeChange{Path: rel, Kind: utils.ChangeModified})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// opaqueDir reports whether an upper directory hides everything below it
+func opaqueDir(dirPath string) (bool, error) {
+	if _, err := os.Lstat(filepath.Join(dirPath, whiteoutOpaque)); err == nil {
+		return true, nil
+	}
+	for _, attr := range overlayOpaqueXattrs {
+		value, err := getXattr(dirPath, attr)
+		if err != nil {
+			continue
+		}
+		if string(value) == "y" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// InheritLowerDirs gives directories a step created in upper only to hold new files (slash
+// separated, relative to upper) the owner, mode, xattrs and times they have in lowers, topmost
+// first, so the layer does not override them. Directories the lowers do not show are left alone.
+func InheritLowerDirs(upper string, lowers []string, dirs []string) error {
+	sorted := append([]string(nil), dirs...)
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	for _, dir := range sorted {
+		source, info, err := lowerEntry(lowers, dir)
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			continue
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("/%s is not a directory in the image", dir)
+		}
+
+		target := filepath.Join(upper, filepath.FromSlash(dir))
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			// EINVAL is an owner without a mapping in this user namespace, the directory keeps ours
+			if err := unix.Lchown(target, int(stat.Uid), int(stat.Gid)); err != nil && err != unix.EINVAL {
+				return fmt.Errorf("failed to set owner of /%s: %v", dir, err)
+			}
+		}
+		attrs, err := listXattrs(source)
+		if err != nil {
+			return err
+		}
+		for _, attr := range attrs {
+			if hasAnyPrefix(attr, overlayXattrPrefixes) {
+				continue
+			}
+			value, err := getXattr(source, attr)
+			if err != nil {
+				return err
+			}
+			if err := unix.Lsetxattr(target, attr, value, 0); err != nil && err != unix.EPERM && err != unix.ENOTSUP {
+				return fmt.Errorf("failed to set xattr %s on /%s: %v", attr, dir, err)
+			}
+		}
+		// chown clears setuid and setgid, so the mode goes on afterwards
+		if err := os.Chmod(target, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		mtime := unix.NsecToTimespec(info.ModTime().UnixNano())
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lowerEntry finds rel the way an overlay of lowers, topmost first, shows it: the first layer that
+// has it wins, and a whiteout or an opaque directory on the way hides the layers below. It returns
+// a nil info when rel is not visible.
+func lowerEntry(lowers []string, rel string) (string, os.FileInfo, error) {
+	for _, lower := range lowers {
+		entryPath := filepath.Join(lower, filepath.FromSlash(rel))
+		info, err := os.Lstat(entryPath)
+		if err == nil {
+			if isWhiteout(info) {
+				return "", nil, nil
+			}
+			return entryPath, info, nil
+		}
+		if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return "", nil, err
+		}
+
+		for parent := path.Dir(rel); parent != "."; parent = path.Dir(parent) {
+			parentPath := filepath.Join(lower, filepath.FromSlash(parent))
+			parentInfo, err := os.Lstat(parentPath)
+			if err != nil {
+				continue
+			}
+			if isWhiteout(parentInfo) || !parentInfo.IsDir() {
+				return "", nil, nil
+			}
+			if opaque, _ := opaqueDir(parentPath); opaque {
+				return "", nil, nil
+			}
+		}
+	}
+	return "", nil, nil
+}
+
+// isWhiteout reports whether info is the 0:0 character device overlayfs uses to delete a path
+func isWhiteout(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0
+}
@@ -0,0 +1,57 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestInheritLowerDirs(t *testing.T) {
+	base := t.TempDir()
+	top, bottom, upper := filepath.Join(base, "top"), filepath.Join(base, "bottom"), filepath.Join(base, "upper")
+	for _, dir := range []string{
+		filepath.Join(bottom, "tmp"), filepath.Join(bottom, "gone"), filepath.Join(bottom, "home", "app"),
+		filepath.Join(top, "home"),
+		filepath.Join(upper, "tmp"), filepath.Join(upper, "gone"), filepath.Join(upper, "home", "app"), filepath.Join(upper, "new"),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(bottom, "tmp"), 0777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(bottom, "home", "app"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// The top layer deletes /gone, and makes /home opaque so /home/app of the bottom one is hidden
+	if err := unix.Mknod(filepath.Join(top, "gone"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("cannot create whiteouts here: %v", err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(top, "home"), overlayOpaqueXattrs[0], []byte("y"), 0); err != nil {
+		t.Skipf("cannot set overlay xattrs here: %v", err)
+	}
+
+	if err := InheritLowerDirs(upper, []string{top, bottom}, []string{"gone", "home", "home/app", "new", "tmp"}); err != nil {
+		t.Fatal(err)
+	}
+	for dir, want := range map[string]os.FileMode{
+		"tmp":      0777 | os.ModeSticky,
+		"gone":     0755,
+		"home/app": 0755,
+		"new":      0755,
+	} {
+		info, err := os.Stat(filepath.Join(upper, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode() & (os.ModePerm | os.ModeSticky); got != want {
+			t.Errorf("/%s has mode %v, expected %v", dir, got, want)
+		}
+	}
+	if attrs, _ := listXattrs(filepath.Join(upper, "home")); len(attrs) != 0 {
+		t.Errorf("overlay bookkeeping was copied: %v", attrs)
+	}
+}
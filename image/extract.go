@@ -0,0 +1,272 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrPaxPrefix is how GNU tar and Go's archive/tar carry extended attributes in PAX headers
+const xattrPaxPrefix = "SCHILY.xattr."
+
+// extractor writes tar entries under target keeping ownership, modes, mtimes, xattrs and hardlinks.
+// Directory modes and mtimes are applied by finish, so read-only directories stay writable while
+// later entries and layers are unpacked and their mtimes are not bumped by new children.
+type extractor struct {
+	target string
+	chown  bool
+	// flatten applies whiteouts by deleting files instead of recording them for overlayfs
+	flatten bool
+	dirs    map[string]*tar.Header
+	warned  map[string]bool
+}
+
+// newExtractor prepares an extractor for target. Ownership is only restored when running as
+// root, which for rootless use means inside the container user namespace.
+func newExtractor(target string) *extractor {
+	return &extractor{
+		target: target,
+		chown:  os.Geteuid() == 0,
+		dirs:   make(map[string]*tar.Header),
+		warned: make(map[string]bool),
+	}
+}
+
+// resolve returns where the entry name (a clean absolute path) goes on disk. Its parent directory is
+// resolved inside the target, so symlinks unpacked earlier cannot redirect it; the base name itself
+// is never followed.
+func (ex *extractor) resolve(name string) (string, error) {
+	dir, base := path.Split(name)
+	parent, err := resolveDir(ex.target, dir)
+	if err != nil {
+		return "", fmt.Errorf("refusing entry %q: %v", name, err)
+	}
+	return filepath.Join(parent, base), nil
+}
+
+// remove deletes whatever is at dest, forgetting the directories that went with it
+func (ex *extractor) remove(dest string) error {
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	for dir := range ex.dirs {
+		if dir == dest || strings.HasPrefix(dir, dest+"/") {
+			delete(ex.dirs, dir)
+		}
+	}
+	return nil
+}
+
+// writeWhiteout records the deletion of name from lower layers as an overlayfs whiteout
+func (ex *extractor) writeWhiteout(name string) error {
+	// The base name must be a real entry, or the whiteout would remove its own directory or the target
+	if base := path.Base(name); name != path.Clean(name) || base == "/" || base == "." || base == ".." {
+		return fmt.Errorf("refusing whiteout of %q", name)
+	}
+	dest, err := ex.resolve(name)
+	if err != nil {
+		return err
+	}
+	if err := ex.remove(dest); err != nil {
+		return err
+	}
+	if ex.flatten {
+		return nil
+	}
+	if err := unix.Mknod(dest, unix.S_IFCHR|0000, 0); err != nil {
+		return fmt.Errorf("failed to create whiteout for %s: %v", name, err)
+	}
+	return nil
+}
+
+// markOpaque hides everything lower layers have in dir, the overlayfs way for userxattr mounts
+func (ex *extractor) markOpaque(dir string) error {
+	dest, err := resolveDir(ex.target, dir)
+	if err != nil {
+		return fmt.Errorf("refusing opaque marker in %q: %v", dir, err)
+	}
+	if ex.flatten {
+		// The marker comes right after its directory, so only lower layers' files are cleared
+		entries, err := os.ReadDir(dest)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := ex.remove(filepath.Join(dest, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := unix.Lsetxattr(dest, overlayOpaqueXattrs[0], []byte("y"), 0); err != nil {
+		return fmt.Errorf("failed to mark %s opaque: %v", dir, err)
+	}
+	return nil
+}
+
+// warnOnce logs a warning the first time a kind of problem is seen
+func (ex *extractor) warnOnce(kind, format string, args ...interface{}) {
+	if ex.warned[kind] {
+		return
+	}
+	ex.warned[kind] = true
+	log.Printf("[⚠️] "+format, args...)
+}
+
+// writeEntry creates the file described by hdr at name (a clean absolute path inside the rootfs)
+func (ex *extractor) writeEntry(name string, hdr *tar.Header, r io.Reader) error {
+	dest, err := ex.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	// Replace whatever is already here unless both are directories
+	existing, err := os.Lstat(dest)
+	if err == nil && !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := ex.remove(dest); err != nil {
+			return err
+		}
+		existing = nil
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if existing == nil {
+			if err := os.Mkdir(dest, 0755); err != nil {
+				return err
+			}
+		}
+		ex.dirs[dest] = hdr
+	case tar.TypeReg, tar.TypeRegA:
+		// O_EXCL and O_NOFOLLOW make sure nothing but the new file is written
+		outFile, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(outFile, r); err != nil {
+			outFile.Close()
+			return err
+		}
+		if err := outFile.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, dest); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		if containsDotDot(hdr.Linkname) {
+			return fmt.Errorf("refusing hardlink %q to %q outside the rootfs", hdr.Name, hdr.Linkname)
+		}
+		linkTarget, err := ex.resolve(path.Clean("/" + hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(linkTarget, dest); err != nil {
+			return err
+		}
+		// A hardlink shares the inode and metadata of its target
+		return nil
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(dest, 0600); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		mode := uint32(unix.S_IFCHR)
+		if hdr.Typeflag == tar.TypeBlock {
+			mode = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(dest, mode|0600, int(dev)); err != nil {
+			// Unprivileged user namespaces cannot create devices; /dev is mounted at run time anyway
+			ex.warnOnce("mknod", "Skipping device nodes such as %s: %v", name, err)
+			return nil
+		}
+	default:
+		log.Printf("Skipping unsupported type: %s (%d)\n", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	return ex.applyMetadata(dest, hdr)
+}
+
+// applyMetadata restores ownership, mode, xattrs and mtime of a freshly created entry
+func (ex *extractor) applyMetadata(dest string, hdr *tar.Header) error {
+	if ex.chown {
+		if err := unix.Lchown(dest, hdr.Uid, hdr.Gid); err != nil {
+			// EINVAL means the id has no mapping in this user namespace
+			ex.warnOnce("chown", "Could not set owner %d:%d of %s: %v", hdr.Uid, hdr.Gid, hdr.Name, err)
+		}
+	}
+
+	// chown clears setuid and setgid, so the mode goes on afterwards
+	if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeDir {
+		if err := unix.Chmod(dest, uint32(hdr.Mode&07777)); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		attr, found := strings.CutPrefix(key, xattrPaxPrefix)
+		if !found {
+			continue
+		}
+		if strings.HasPrefix(attr, "trusted.") {
+			ex.warnOnce("trusted", "Skipping trusted.* xattrs such as %s on %s", attr, hdr.Name)
+			continue
+		}
+		if err := unix.Lsetxattr(dest, attr, []byte(value), 0); err != nil {
+			ex.warnOnce("xattr:"+attr, "Could not set xattr %s on %s: %v", attr, hdr.Name, err)
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setMtime(dest, hdr)
+}
+
+// setMtime sets the access and modification times of dest without following symlinks
+func setMtime(dest string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, dest, times, unix.AT_SYMLINK_NOFOLLOW); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// finish applies directory modes and mtimes, deepest directories first
+func (ex *extractor) finish() error {
+	dirs := make([]string, 0, len(ex.dirs))
+	for dir := range ex.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	for _, dir := range dirs {
+		hdr := ex.dirs[dir]
+		// Never follow something that replaced the directory after it was unpacked
+		if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := unix.Chmod(dir, uint32(hdr.Mode&07777)); err != nil {
+			return err
+		}
+		if err := setMtime(dir, hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// secret is the content of the one file outside the extraction target
+const secret = "do not touch"
+
+// entry describes one tar member of a test layer
+type entry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func file(name, body string) entry { return entry{name: name, typeflag: tar.TypeReg, body: body} }
+func dir(name string) entry        { return entry{name: name, typeflag: tar.TypeDir} }
+func symlink(name, target string) entry {
+	return entry{name: name, typeflag: tar.TypeSymlink, linkname: target}
+}
+func hardlink(name, target string) entry {
+	return entry{name: name, typeflag: tar.TypeLink, linkname: target}
+}
+
+// buildTar writes entries into an uncompressed tar stream
+func buildTar(t testing.TB, entries []entry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newLayout creates base/root, the extraction target, next to base/outside holding the secret
+func newLayout(t testing.TB, base string) (root, outside string) {
+	root = filepath.Join(base, "root")
+	outside = filepath.Join(base, "outside")
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte(secret), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+// checkOutside fails the test if anything next to or outside root was created, changed or removed
+func checkOutside(t testing.TB, base string) {
+	t.Helper()
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "root" && e.Name() != "outside" {
+			t.Errorf("extraction created %s outside the target", filepath.Join(base, e.Name()))
+		}
+	}
+
+	outside := filepath.Join(base, "outside")
+	entries, err = os.ReadDir(outside)
+	if err != nil {
+		t.Fatalf("outside directory is gone: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "secret" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("outside directory now holds %v", names)
+	}
+
+	secretPath := filepath.Join(outside, "secret")
+	info, err := os.Lstat(secretPath)
+	if err != nil {
+		t.Fatalf("secret is gone: %v", err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm() != 0644 {
+		t.Errorf("secret changed mode to %v", info.Mode())
+	}
+	if nlink := info.Sys().(*syscall.Stat_t).Nlink; nlink != 1 {
+		t.Errorf("secret has %d hardlinks", nlink)
+	}
+	if content, err := os.ReadFile(secretPath); err != nil || string(content) != secret {
+		t.Errorf("secret content is now %q (%v)", content, err)
+	}
+	for _, attr := range overlayOpaqueXattrs {
+		if _, err := unix.Lgetxattr(outside, attr, nil); err == nil {
+			t.Errorf("outside directory got xattr %s", attr)
+		}
+	}
+}
+
+// forEachResolver runs fn once with the openat2 resolver and once with the userspace walk
+func forEachResolver(t *testing.T, fn func(t *testing.T)) {
+	defer openat2Unsupported.Store(openat2Unsupported.Load())
+
+	t.Run("openat2", func(t *testing.T) {
+		if _, err := resolveDirOpenat2(t.TempDir(), "probe"); err == errNoOpenat2 {
+			t.Skip("openat2 is not available")
+		}
+		openat2Unsupported.Store(false)
+		fn(t)
+	})
+	t.Run("userspace", func(t *testing.T) {
+		openat2Unsupported.Store(true)
+		fn(t)
+	})
+}
+
+// extract applies a tar stream as a layer and finishes directory metadata
+func extract(root string, layer []byte, flatten bool) error {
+	ex := newExtractor(root)
+	ex.flatten = flatten
+	if err := applyLayer(ex, bytes.NewReader(layer)); err != nil {
+		return err
+	}
+	return ex.finish()
+}
+
+// hostileLayer is a tarball that must not touch anything outside the target
+type hostileLayer struct {
+	name    string
+	entries func(outside string) []entry
+	// wantErr is a substring the error must contain; empty means the layer may apply cleanly
+	wantErr string
+	// check inspects the target after extraction
+	check func(t *testing.T, root string)
+}
+
+var hostileLayers = []hostileLayer{
+	{
+		name: "absolute symlink escape",
+		entries: func(outside string) []entry {
+			return []entry{symlink("escape", outside), file("escape/pwned", "x")}
+		},
+		check: func(t *testing.T, root string) {
+			assertFile(t, filepath.Join(root, filepath.Dir(root), "outside", "pwned"), "x")
+		},
+	},
+	{
+		name: "relative symlink escape",
+		entries: func(string) []entry {
+			return []entry{symlink("escape", "../outside"), file("escape/pwned", "x")}
+		},
+		check: func(t *testing.T, root string) {
+			assertFile(t, filepath.Join(root, "outside", "pwned"), "x")
+		},
+	},
+	{
+		name: "symlink climbing past the root",
+		entries: func(string) []entry {
+			return []entry{symlink("escape", "../../../../../../.."), file("escape/pwned", "x")}
+		},
+		check: func(t *testing.T, root string) {
+			assertFile(t, filepath.Join(root, "pwned"), "x")
+		},
+	},
+	{
+		name: "symlink chain escape",
+		entries: func(string) []entry {
+			return []entry{
+				dir("a"),
+				symlink("a/up", ".."),
+				symlink("a/b", "up/../../../outside"),
+				file("a/b/pwned", "x"),
+			}
+		},
+		check: func(t *testing.T, root string) {
+			assertFile(t, filepath.Join(root, "outside", "pwned"), "x")
+		},
+	},
+	{
+		name: "symlink then file",
+		entries: func(outside string) []entry {
+			return []entry{
+				dir("etc"),
+				symlink("etc/passwd", filepath.Join(outside, "secret")),
+				file("etc/passwd", "root:x:0:0"),
+			}
+		},
+		check: func(t *testing.T, root string) {
+			assertFile(t, filepath.Join(root, "etc", "passwd"), "root:x:0:0")
+		},
+	},
+	{
+		name: "relative symlink then file",
+		entries: func(string) []entry {
+			return []entry{symlink("secret", "../outside/secret"), file("secret", "overwritten")}
+		},
+		check: func(t *testing.T, root string) {
+			assertFile(t, filepath.Join(root, "secret"), "overwritten")
+		},
+	},
+	{
+		name: "directory replaced by symlink",
+		entries: func(outside string) []entry {
+			return []entry{dir("d"), symlink("d", outside), file("d/pwned", "x")}
+		},
+	},
+	{
+		name: "hardlink through symlink",
+		entries: func(outside string) []entry {
+			return []entry{symlink("escape", outside), hardlink("stolen", "escape/secret")}
+		},
+	},
+	{
+		name: "hardlink through relative symlink",
+		entries: func(string) []entry {
+			return []entry{symlink("escape", "../outside"), hardlink("stolen", "escape/secret")}
+		},
+	},
+	{
+		name: "hardlink with dot dot",
+		entries: func(string) []entry {
+			return []entry{hardlink("stolen", "../outside/secret")}
+		},
+		wantErr: "outside the rootfs",
+	},
+	{
+		name: "whiteout through symlink",
+		entries: func(outside string) []entry {
+			return []entry{symlink("escape", outside), file("escape/.wh.secret", "")}
+		},
+	},
+	{
+		name: "whiteout through relative symlink",
+		entries: func(string) []entry {
+			return []entry{symlink("escape", "../outside"), file("escape/.wh.secret", "")}
+		},
+	},
+	{
+		name: "opaque marker through symlink",
+		entries: func(outside string) []entry {
+			return []entry{symlink("escape", outside), file("escape/"+whiteoutOpaque, "")}
+		},
+	},
+	{
+		name: "opaque marker through relative symlink",
+		entries: func(string) []entry {
+			return []entry{symlink("escape", "../outside"), file("escape/"+whiteoutOpaque, "")}
+		},
+	},
+	{
+		name: "symlink loop",
+		entries: func(string) []entry {
+			return []entry{symlink("a", "b"), symlink("b", "a"), file("a/file", "x")}
+		},
+		wantErr: "too many levels of symbolic links",
+	},
+	{
+		name: "self referencing symlink",
+		entries: func(string) []entry {
+			return []entry{symlink("loop", "loop/x"), file("loop/file", "x")}
+		},
+		wantErr: "too many levels of symbolic links",
+	},
+	{
+		name: "dot dot entry",
+		entries: func(string) []entry {
+			return []entry{file("../outside/pwned", "x")}
+		},
+		wantErr: "outside the rootfs",
+	},
+	{
+		name: "dot dot inside entry",
+		entries: func(string) []entry {
+			return []entry{dir("a"), file("a/../../pwned", "x")}
+		},
+		wantErr: "outside the rootfs",
+	},
+	{
+		name: "empty whiteout",
+		entries: func(string) []entry {
+			return []entry{file("keep", "x"), file(".wh.", "")}
+		},
+		wantErr: "names no file",
+	},
+	{
+		name: "dot whiteout",
+		entries: func(string) []entry {
+			return []entry{dir("a"), file("a/keep", "x"), file("a/.wh..", "")}
+		},
+		wantErr: "names no file",
+	},
+	{
+		name: "dot dot whiteout",
+		entries: func(string) []entry {
+			return []entry{dir("a"), dir("a/b"), file("a/keep", "x"), file("a/b/.wh...", "")}
+		},
+		wantErr: "names no file",
+	},
+	{
+		name: "root dot dot whiteout",
+		entries: func(string) []entry {
+			return []entry{file("keep", "x"), file(".wh...", "")}
+		},
+		wantErr: "names no file",
+	},
+}
+
+// assertFile fails unless name is a regular file holding content
+func assertFile(t *testing.T, name, content string) {
+	t.Helper()
+	info, err := os.Lstat(name)
+	if err != nil {
+		t.Fatalf("expected %s: %v", name, err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Fatalf("%s is %v, not a regular file", name, info.Mode())
+	}
+	if got, err := os.ReadFile(name); err != nil || string(got) != content {
+		t.Fatalf("%s holds %q (%v), expected %q", name, got, err, content)
+	}
+}
+
+func TestApplyLayerHostile(t *testing.T) {
+	for _, tc := range hostileLayers {
+		t.Run(tc.name, func(t *testing.T) {
+			forEachResolver(t, func(t *testing.T) {
+				for _, flatten := range []bool{false, true} {
+					base := t.TempDir()
+					root, outside := newLayout(t, base)
+					err := extract(root, buildTar(t, tc.entries(outside)), flatten)
+					checkOutside(t, base)
+
+					if tc.wantErr != "" {
+						if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+							t.Fatalf("flatten=%v: expected error containing %q, got %v", flatten, tc.wantErr, err)
+						}
+						continue
+					}
+					if err == nil && tc.check != nil {
+						tc.check(t, root)
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestApplyLayerBadWhiteoutKeepsTarget makes sure a rejected whiteout did not remove anything first
+func TestApplyLayerBadWhiteoutKeepsTarget(t *testing.T) {
+	forEachResolver(t, func(t *testing.T) {
+		for _, name := range []string{".wh.", ".wh..", ".wh...", "a/.wh.", "a/b/.wh...", "a/b/.wh.."} {
+			base := t.TempDir()
+			root, _ := newLayout(t, base)
+			layer := buildTar(t, []entry{dir("a"), dir("a/b"), file("a/b/keep", "x"), file(name, "")})
+			if err := extract(root, layer, false); err == nil {
+				t.Errorf("whiteout %q was accepted", name)
+			}
+			assertFile(t, filepath.Join(root, "a", "b", "keep"), "x")
+			checkOutside(t, base)
+		}
+	})
+}
+
+func TestApplyLayerWhiteouts(t *testing.T) {
+	forEachResolver(t, func(t *testing.T) {
+		root, _ := newLayout(t, t.TempDir())
+		layer := buildTar(t, []entry{
+			dir("a"),
+			file("a/.wh.gone", ""),
+			dir("b"),
+			file("b/"+whiteoutOpaque, ""),
+		})
+		if err := extract(root, layer, false); err != nil {
+			t.Fatal(err)
+		}
+
+		var stat unix.Stat_t
+		if err := unix.Lstat(filepath.Join(root, "a", "gone"), &stat); err != nil {
+			t.Fatalf("whiteout not created: %v", err)
+		}
+		if stat.Mode&unix.S_IFMT != unix.S_IFCHR || stat.Rdev != 0 {
+			t.Fatalf("whiteout is mode %o rdev %d, expected a 0:0 character device", stat.Mode, stat.Rdev)
+		}
+		value := make([]byte, 8)
+		n, err := unix.Lgetxattr(filepath.Join(root, "b"), overlayOpaqueXattrs[0], value)
+		if err != nil || string(value[:n]) != "y" {
+			t.Fatalf("opaque marker not applied: %q %v", value[:n], err)
+		}
+	})
+}
+
+func TestResolveDir(t *testing.T) {
+	forEachResolver(t, func(t *testing.T) {
+		root := t.TempDir()
+		for _, link := range [][2]string{{"abs", "/x/y"}, {"rel", "x/../x/y"}, {"up", "../../.."}} {
+			if err := os.Symlink(link[1], filepath.Join(root, link[0])); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for name, want := range map[string]string{
+			"":           root,
+			"/":          root,
+			"a/b/c":      filepath.Join(root, "a", "b", "c"),
+			"/a/./b/":    filepath.Join(root, "a", "b"),
+			"../../a":    filepath.Join(root, "a"),
+			"abs/z":      filepath.Join(root, "x", "y", "z"),
+			"rel":        filepath.Join(root, "x", "y"),
+			"up":         root,
+			"up/../d":    filepath.Join(root, "d"),
+			"a/../../..": root,
+		} {
+			got, err := resolveDir(root, name)
+			if err != nil {
+				t.Errorf("resolveDir(%q): %v", name, err)
+				continue
+			}
+			if got != want {
+				t.Errorf("resolveDir(%q) = %s, expected %s", name, got, want)
+			}
+		}
+	})
+}
+
+func FuzzApplyLayer(f *testing.F) {
+	// Absolute symlinks in the seeds point at the outside directory of the first fuzz worker only;
+	// the relative ones escape toward it from any run
+	seedBase := f.TempDir()
+	_, seedOutside := newLayout(f, seedBase)
+	for _, tc := range hostileLayers {
+		f.Add(buildTar(f, tc.entries(seedOutside)))
+	}
+
+	base := f.TempDir()
+	f.Fuzz(func(t *testing.T, layer []byte) {
+		forEachResolver(t, func(t *testing.T) {
+			for _, flatten := range []bool{false, true} {
+				root, _ := newLayout(t, base)
+				_ = extract(root, layer, flatten)
+				checkOutside(t, base)
+			}
+		})
+	})
+}
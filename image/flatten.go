@@ -0,0 +1,33 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Flatten copies the merged view of lowerdirs (topmost first) into target, applying whiteouts and
+// opaque directories, for storage drivers that cannot stack layers
+func Flatten(lowers []string, target string) error {
+	ex := newExtractor(target)
+	ex.flatten = true
+
+	for i := len(lowers) - 1; i >= 0; i-- {
+		// Layer paths are short links, and the walk has to start from the directory itself
+		layer, err := filepath.EvalSymlinks(lowers[i])
+		if err != nil {
+			return fmt.Errorf("failed to resolve layer %s: %v", lowers[i], err)
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeLayer(layer, pw))
+		}()
+		err = applyLayer(ex, pr)
+		pr.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy layer %s: %v", lowers[i], err)
+		}
+	}
+	return ex.finish()
+}
@@ -0,0 +1,471 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// MaxLayers caps the layer chain of an image, the same limit Docker applies
+	MaxLayers = 127
+	// maxOverlayOptions is the most the kernel accepts as mount data (one page)
+	maxOverlayOptions = 4096
+	// linkDir holds short symlinks to layer contents, keeping lowerdir options small
+	linkDir = "l"
+	// shortIDLength is how much of a digest names its short link
+	shortIDLength = 16
+	// stagingPrefix names the directories layers are unpacked in before being renamed into place
+	stagingPrefix = ".tmp-"
+)
+
+// Layer is the metadata kept next to every unpacked layer
+type Layer struct {
+	Digest  string    `json:"digest"`
+	Size    uint64    `json:"size"`
+	Refs    int       `json:"refs"`
+	Created time.Time `json:"created"`
+	// Embedded marks the built-in rootfs, which containers use without an image referring to it
+	Embedded bool `json:"embedded,omitempty"`
+}
+
+// layerHex returns the hex part of a sha256 digest, rejecting anything else
+func layerHex(digest string) (string, error) {
+	encoded, found := strings.CutPrefix(digest, "sha256:")
+	if !found || len(encoded) != 64 || strings.Trim(encoded, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid layer digest %q", digest)
+	}
+	return encoded, nil
+}
+
+// layerDir returns the directory of a layer, holding its diff/ contents and layer.json
+func (s *Store) layerDir(digest string) string {
+	encoded, _ := layerHex(digest)
+	return filepath.Join(s.layersDir, encoded)
+}
+
+// LayerPath returns the short path of a layer's contents used as an overlay lowerdir
+func (s *Store) LayerPath(digest string) string {
+	encoded, _ := layerHex(digest)
+	return filepath.Join(s.layersDir, linkDir, encoded[:shortIDLength])
+}
+
+// LayerDigest maps a path returned by LayerPath back to the digest of its layer
+func (s *Store) LayerDigest(layerPath string) (string, error) {
+	target, err := os.Readlink(layerPath)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a stored layer: %v", layerPath, err)
+	}
+	digest := "sha256:" + filepath.Base(filepath.Dir(target))
+	if _, err := layerHex(digest); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// hasLayer reports whether a layer is already unpacked
+func (s *Store) hasLayer(digest string) bool {
+	if _, err := layerHex(digest); err != nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(s.layerDir(digest), "layer.json"))
+	return err == nil
+}
+
+// loadLayer reads the metadata of a layer
+func (s *Store) loadLayer(digest string) (*Layer, error) {
+	data, err := os.ReadFile(filepath.Join(s.layerDir(digest), "layer.json"))
+	if err != nil {
+		return nil, fmt.Errorf("layer %s is not in the store: %v", shortDigest(digest), err)
+	}
+	var layer Layer
+	if err := json.Unmarshal(data, &layer); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata of layer %s: %v", shortDigest(digest), err)
+	}
+	return &layer, nil
+}
+
+// saveLayer writes the metadata of a layer
+func (s *Store) saveLayer(layer *Layer) error {
+	return writeLayerMetadata(s.layerDir(layer.Digest), layer)
+}
+
+// writeLayerMetadata writes layer.json into dir, the layer's own directory or its staging copy
+func writeLayerMetadata(dir string, layer *Layer) error {
+	data, err := json.MarshalIndent(layer, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal layer metadata: %v", err)
+	}
+	return writeFileAtomic(filepath.Join(dir, "layer.json"), data)
+}
+
+// Layers returns the metadata of every stored layer
+func (s *Store) Layers() ([]*Layer, error) {
+	entries, err := os.ReadDir(s.layersDir)
+	if err != nil {
+		return nil, err
+	}
+	var layers []*Layer
+	for _, entry := range entries {
+		digest := "sha256:" + entry.Name()
+		if !entry.IsDir() || !s.hasLayer(digest) {
+			continue
+		}
+		layer, err := s.loadLayer(digest)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// stagedLayer is a layer unpacked into a staging dir, waiting to be installed with the store lock held
+type stagedLayer struct {
+	digest string
+	// dir is the staging dir, empty when the layer was already stored
+	dir string
+	// lock holds the flock on dir that keeps cleanStaging away from it
+	lock *os.File
+}
+
+// release removes the staging dir of a layer that was not installed and drops its flock
+func (l *stagedLayer) release() {
+	if l.dir != "" {
+		_ = os.RemoveAll(l.dir)
+	}
+	if l.lock != nil {
+		l.lock.Close()
+	}
+}
+
+// stageLayer unpacks a layer blob into a staging dir, verifying it against its digest, unless a layer
+// with that digest is already stored. Blobs without a known digest are keyed by the sha256 of their
+// bytes. No store lock is needed, so downloading and extracting never hold up other commands;
+// installLayer then makes the layer visible. The staged layer must be released.
+func (s *Store) stageLayer(source layerSource) (*stagedLayer, error) {
+	if source.digest != "" {
+		if _, err := layerHex(source.digest); err != nil {
+			return nil, err
+		}
+		if s.hasLayer(source.digest) {
+			return &stagedLayer{digest: source.digest}, nil
+		}
+	}
+
+	staging, lock, err := s.newStagingDir()
+	if err != nil {
+		return nil, err
+	}
+	staged := &stagedLayer{dir: staging, lock: lock}
+
+	diff := filepath.Join(staging, "diff")
+	if err := os.Mkdir(diff, 0755); err != nil {
+		staged.release()
+		return nil, err
+	}
+	ex := newExtractor(diff)
+	digest, err := applyLayerFrom(ex, source)
+	if err != nil {
+		staged.release()
+		return nil, err
+	}
+	if err := ex.finish(); err != nil {
+		staged.release()
+		return nil, fmt.Errorf("failed to set directory metadata: %v", err)
+	}
+	staged.digest = digest
+
+	size, err := utils.DirSize(diff)
+	if err != nil {
+		staged.release()
+		return nil, fmt.Errorf("failed to measure layer: %v", err)
+	}
+	layer := &Layer{Digest: digest, Size: size, Created: time.Now()}
+	if err := writeLayerMetadata(staging, layer); err != nil {
+		staged.release()
+		return nil, err
+	}
+	return staged, nil
+}
+
+// installLayer renames a staged layer into place together with its layer.json, so an interrupted
+// unpack never leaves a layer that looks complete. The exclusive store lock must be held.
+// It returns the digest the layer is stored under.
+func (s *Store) installLayer(staged *stagedLayer) (string, error) {
+	// Another image may have brought the same content under a name we could not know in advance
+	if s.hasLayer(staged.digest) {
+		return staged.digest, nil
+	}
+	if staged.dir == "" {
+		return "", fmt.Errorf("layer %s was removed while it was being stored, try again", shortDigest(staged.digest))
+	}
+
+	// The link may dangle until the rename, which is what makes the layer visible
+	link := s.LayerPath(staged.digest)
+	encoded, _ := layerHex(staged.digest)
+	_ = os.Remove(link)
+	if err := os.Symlink(filepath.Join("..", encoded, "diff"), link); err != nil {
+		return "", fmt.Errorf("failed to link layer: %v", err)
+	}
+
+	// Leftovers of an interrupted unpack have no layer.json and are replaced
+	target := s.layerDir(staged.digest)
+	if err := os.RemoveAll(target); err != nil {
+		return "", fmt.Errorf("failed to clean incomplete layer: %v", err)
+	}
+	if err := os.Rename(staged.dir, target); err != nil {
+		return "", fmt.Errorf("failed to install layer: %v", err)
+	}
+	staged.dir = ""
+	return staged.digest, nil
+}
+
+// newStagingDir creates a staging dir and returns it flocked for as long as it is being filled
+func (s *Store) newStagingDir() (string, *os.File, error) {
+	for {
+		dir, err := os.MkdirTemp(s.layersDir, stagingPrefix)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create staging dir: %v", err)
+		}
+		lock, err := os.Open(dir)
+		if err == nil {
+			err = flock(lock, unix.LOCK_EX)
+			if err != nil {
+				lock.Close()
+			}
+		}
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("failed to lock staging dir: %v", err)
+		}
+		// cleanStaging may have taken the dir for stale before the flock was in place
+		if locked, err := lock.Stat(); err == nil {
+			if current, err := os.Stat(dir); err == nil && os.SameFile(locked, current) {
+				return dir, lock, nil
+			}
+		}
+		lock.Close()
+	}
+}
+
+// cleanStaging removes staging dirs left behind by interrupted unpacks. A dir being filled is
+// flocked by its process, so only those whose flock can be taken are stale.
+func (s *Store) cleanStaging() {
+	dirs, _ := filepath.Glob(filepath.Join(s.layersDir, stagingPrefix+"*"))
+	for _, dir := range dirs {
+		lock, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		if unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB) == nil {
+			_ = os.RemoveAll(dir)
+		}
+		lock.Close()
+	}
+}
+
+// retainLayers adds a reference from an image or container to each of its layers
+func (s *Store) retainLayers(digests []string) error {
+	for _, digest := range digests {
+		layer, err := s.loadLayer(digest)
+		if err != nil {
+			return err
+		}
+		layer.Refs++
+		if err := s.saveLayer(layer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseLayers drops a reference from each layer, deleting layers nothing refers to anymore
+func (s *Store) releaseLayers(digests []string) error {
+	for _, digest := range digests {
+		layer, err := s.loadLayer(digest)
+		if err != nil {
+			continue
+		}
+		layer.Refs--
+		if layer.Refs > 0 || layer.Embedded {
+			if err := s.saveLayer(layer); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.removeLayer(digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetainContainerLayers takes a reference for a container on each stored layer among its lowerdirs,
+// so removing or replacing the images it came from leaves them in place. Lowerdirs outside the
+// store, such as a rootfs extracted before it existed, are skipped. record saves the digests with
+// the container while the store is still locked; for a new container imageName is the image it
+// is created from, which must still be installed, so Remove cannot miss the container.
+func (s *Store) RetainContainerLayers(imageName string, lowers []string, record func(digests []string) error) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if imageName != "" {
+		if _, err := s.Get(imageName); err != nil {
+			return err
+		}
+	}
+	var digests []string
+	for _, lower := range lowers {
+		digest, err := s.LayerDigest(lower)
+		if err != nil {
+			continue
+		}
+		if !s.hasLayer(digest) {
+			return fmt.Errorf("layer %s is missing, pull or load the image again", shortDigest(digest))
+		}
+		digests = append(digests, digest)
+	}
+	if err := s.retainLayers(digests); err != nil {
+		return err
+	}
+	if err := record(digests); err != nil {
+		// Leave the counts as they were, nothing refers to these references
+		_ = s.releaseLayers(digests)
+		return err
+	}
+	return nil
+}
+
+// ReleaseContainerLayers drops the references RetainContainerLayers took for a removed container
+func (s *Store) ReleaseContainerLayers(digests []string) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.releaseLayers(digests)
+}
+
+// removeLayer deletes a layer's short link and contents
+func (s *Store) removeLayer(digest string) error {
+	if err := os.Remove(s.LayerPath(digest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(s.layerDir(digest)); err != nil {
+		return fmt.Errorf("failed to remove layer %s: %v", shortDigest(digest), err)
+	}
+	return nil
+}
+
+// LowerDirs returns the overlay lowerdirs of an image, topmost layer first
+func (s *Store) LowerDirs(img *Image) ([]string, error) {
+	return s.ChainLowerDirs(img.Layers, "image "+img.Name)
+}
+
+// ChainLowerDirs returns the overlay lowerdirs, topmost first, of layer digests given bottom
+// first; what names the chain in errors
+func (s *Store) ChainLowerDirs(layers []string, what string) ([]string, error) {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("%s has no layers", what)
+	}
+	if len(layers) > MaxLayers {
+		return nil, fmt.Errorf("%s has %d layers, more than the %d an overlay can stack", what, len(layers), MaxLayers)
+	}
+
+	lowers := make([]string, 0, len(layers))
+	for i := len(layers) - 1; i >= 0; i-- {
+		if !s.hasLayer(layers[i]) {
+			return nil, fmt.Errorf("layer %s of %s is missing, pull or load it again", shortDigest(layers[i]), what)
+		}
+		lowers = append(lowers, s.LayerPath(layers[i]))
+	}
+	return lowers, nil
+}
+
+// EmbeddedLayer stores the rootfs tarball built into the binary as a layer and returns its lowerdir
+func (s *Store) EmbeddedLayer(data []byte) (string, error) {
+	digest := digestOf(data)
+
+	source := layerSource{
+		digest: digest,
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+	staged, err := s.stageLayer(source)
+	if err != nil {
+		return "", fmt.Errorf("failed to unpack embedded rootfs: %v", err)
+	}
+	defer staged.release()
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	s.cleanStaging()
+
+	if _, err := s.installLayer(staged); err != nil {
+		return "", fmt.Errorf("failed to unpack embedded rootfs: %v", err)
+	}
+
+	layer, err := s.loadLayer(digest)
+	if err != nil {
+		return "", err
+	}
+	if !layer.Embedded {
+		layer.Embedded = true
+		if err := s.saveLayer(layer); err != nil {
+			return "", err
+		}
+	}
+	return s.LayerPath(digest), nil
+}
+
+// OverlayLowerdir joins lowerdirs (topmost first) into an overlay lowerdir option. When they all
+// live in one directory the names are made relative to it, and that directory is returned so the
+// mount can be done from there; the option must fit in a page and the stack in MaxLayers.
+func OverlayLowerdir(lowers []string) (string, string, error) {
+	if len(lowers) > MaxLayers+1 {
+		return "", "", fmt.Errorf("%d lower layers exceed the overlay limit of %d", len(lowers), MaxLayers+1)
+	}
+
+	option := strings.Join(lowers, ":")
+	if len(option) < maxOverlayOptions/2 {
+		return "", option, nil
+	}
+
+	// Shorten to names relative to the shared parent of the layer links
+	base := filepath.Dir(lowers[len(lowers)-1])
+	relative := make([]string, 0, len(lowers))
+	for _, lower := range lowers {
+		rel, err := filepath.Rel(base, lower)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = lower
+		}
+		relative = append(relative, rel)
+	}
+	option = strings.Join(relative, ":")
+	if len(option) >= maxOverlayOptions/2 {
+		return "", "", fmt.Errorf("overlay lowerdir option of %d bytes is too long for the kernel", len(option))
+	}
+	return base, option, nil
+}
@@ -0,0 +1,333 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// refNameAnnotation carries the tag of a manifest inside an OCI image layout
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// dockerSaveManifest is one entry of manifest.json in a `docker save` tarball
+type dockerSaveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// blobSource opens files of an image archive, either an unpacked layout directory or a tarball
+type blobSource interface {
+	open(name string) (io.ReadCloser, error)
+}
+
+// dirSource reads blobs from an OCI image layout directory
+type dirSource string
+
+func (d dirSource) open(name string) (io.ReadCloser, error) {
+	if containsDotDot(name) {
+		return nil, fmt.Errorf("refusing path %q outside the image layout", name)
+	}
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// tarSource reads blobs from a tarball by scanning it for the requested member
+type tarSource string
+
+func (t tarSource) open(name string) (io.ReadCloser, error) {
+	file, err := os.Open(string(t))
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := Decompress(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	want := path.Clean(name)
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stream.Close()
+			file.Close()
+			return nil, err
+		}
+		if path.Clean(hdr.Name) == want && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) {
+			return &tarMember{Reader: tr, closers: []io.Closer{stream, file}}, nil
+		}
+	}
+
+	stream.Close()
+	file.Close()
+	return nil, fmt.Errorf("%s not found in %s", name, string(t))
+}
+
+// tarMember exposes one file of a tarball and closes the archive with it
+type tarMember struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *tarMember) Close() error {
+	var firstErr error
+	for _, closer := range m.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// readJSON decodes a small JSON file from an image archive
+func readJSON(source blobSource, name string, v interface{}) error {
+	r, err := source.open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(io.LimitReader(r, 16<<20)).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	return nil
+}
+
+// digestOf returns the sha256 digest of a byte slice
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// blobPath returns where a blob lives inside an OCI image layout
+func blobPath(digest string) (string, error) {
+	algorithm, encoded, found := strings.Cut(digest, ":")
+	if !found || algorithm != "sha256" || len(encoded) != 64 || strings.ContainsAny(encoded, "/.") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return "blobs/" + algorithm + "/" + encoded, nil
+}
+
+// Load imports an image from an OCI image layout directory or a `docker save` tarball.
+// name overrides the tag recorded in the archive.
+func (s *Store) Load(archivePath, name string) (*Image, error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var source blobSource = tarSource(archivePath)
+	if info.IsDir() {
+		source = dirSource(archivePath)
+	}
+
+	// docker save writes manifest.json; OCI layouts (and newer docker save) have index.json
+	var saved []dockerSaveManifest
+	if err := readJSON(source, "manifest.json", &saved); err == nil && len(saved) > 0 {
+		return s.loadDockerSave(source, saved[0], name)
+	}
+	return s.loadLayout(source, name)
+}
+
+// loadDockerSave imports the first image of a `docker save` tarball
+func (s *Store) loadDockerSave(source blobSource, saved dockerSaveManifest, name string) (*Image, error) {
+	if name == "" {
+		if len(saved.RepoTags) == 0 {
+			return nil, fmt.Errorf("archive has no tag, pass --name")
+		}
+		name = saved.RepoTags[0]
+	}
+
+	configReader, err := source.open(saved.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image config: %v", err)
+	}
+	configFile, err := readConfigFile(configReader, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Layer names in a docker save tarball are paths, not digests, so they are recorded but not verified
+	var layers []layerSource
+	for _, layerName := range saved.Layers {
+		layers = append(layers, layerSource{
+			open: func() (io.ReadCloser, error) { return source.open(layerName) },
+		})
+	}
+
+	img := &Image{
+		Name:      name,
+		Reference: name,
+		Digest:    "sha256:" + strings.TrimSuffix(path.Base(saved.Config), ".json"),
+		Layers:    saved.Layers,
+		Config:    configFile.Config,
+		Source:    "docker-archive",
+	}
+	if err := s.unpack(img, layers); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// loadLayout imports the first image of an OCI image layout
+func (s *Store) loadLayout(source blobSource, name string) (*Image, error) {
+	var index Index
+	if err := readJSON(source, "index.json", &index); err != nil {
+		return nil, fmt.Errorf("not an OCI image layout or docker archive: %v", err)
+	}
+	if len(index.Manifests) == 0 {
+		return nil, fmt.Errorf("image layout has no manifests")
+	}
+
+	descriptor := index.Manifests[0]
+	manifest, err := s.layoutManifest(source, descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = descriptor.Annotations[refNameAnnotation]
+		if name == "" {
+			return nil, fmt.Errorf("archive has no tag, pass --name")
+		}
+	}
+
+	configPath, err := blobPath(manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	configReader, err := source.open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image config: %v", err)
+	}
+	configFile, err := readConfigFile(configReader, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []layerSource
+	var layerDigests []string
+	for _, layer := range manifest.Layers {
+		if err := checkLayerMediaType(layer.MediaType); err != nil {
+			return nil, err
+		}
+		layerPath, err := blobPath(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layerSource{
+			digest: layer.Digest,
+			open:   func() (io.ReadCloser, error) { return source.open(layerPath) },
+		})
+		layerDigests = append(layerDigests, layer.Digest)
+	}
+
+	img := &Image{
+		Name:      name,
+		Reference: name,
+		Digest:    descriptor.Digest,
+		Layers:    layerDigests,
+		Config:    configFile.Config,
+		Source:    "oci-layout",
+	}
+	if err := s.unpack(img, layers); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// layoutManifest reads the manifest a layout index points at, descending into a nested index
+func (s *Store) layoutManifest(source blobSource, descriptor Descriptor) (*Manifest, error) {
+	for depth := 0; depth < 2; depth++ {
+		manifestPath, err := blobPath(descriptor.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := source.open(manifestPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open manifest: %v", err)
+		}
+		body, err := io.ReadAll(io.LimitReader(r, 4<<20))
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		if digestOf(body) != descriptor.Digest {
+			return nil, fmt.Errorf("manifest digest mismatch for %s", descriptor.Digest)
+		}
+
+		if isIndex(descriptor.MediaType, body) {
+			var index Index
+			if err := json.Unmarshal(body, &index); err != nil {
+				return nil, fmt.Errorf("failed to parse image index: %v", err)
+			}
+			if descriptor, err = selectPlatform(index); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var manifest Manifest
+		if err := json.Unmarshal(body, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse image manifest: %v", err)
+		}
+		return &manifest, nil
+	}
+	return nil, fmt.Errorf("image index nested too deeply")
+}
+
+// Import stores a root filesystem tarball (plain, gzip, bzip2, xz or zstd) as a single-layer image
+func (s *Store) Import(tarball, name string) (*Image, error) {
+	if name == "" {
+		return nil, fmt.Errorf("an image name is required")
+	}
+
+	digest, err := fileDigest(tarball)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Name:      name,
+		Reference: name,
+		Digest:    digest,
+		Layers:    []string{digest},
+		Source:    "import:" + tarball,
+	}
+	layer := layerSource{
+		digest: digest,
+		open:   func() (io.ReadCloser, error) { return os.Open(tarball) },
+	}
+	if err := s.unpack(img, []layerSource{layer}); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// fileDigest returns the sha256 digest of a file
+func fileDigest(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", filePath, err)
+	}
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,67 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile serialises changes to the store between concurrent otala-box processes
+const lockFile = ".lock"
+
+// lock takes the store lock, exclusive for changes and shared for reads, and returns its release.
+// flock locks belong to the open file, so a process must not take the lock twice.
+func (s *Store) lock(exclusive bool) (func(), error) {
+	file, err := os.OpenFile(filepath.Join(s.layersDir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image store lock: %v", err)
+	}
+
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if err := flock(file, how); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock image store: %v", err)
+	}
+
+	return func() {
+		_ = unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// flock takes a flock on file, retrying when interrupted
+func flock(file *os.File, how int) error {
+	for {
+		err := unix.Flock(int(file.Fd()), how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// writeFileAtomic replaces path with data so readers see either the old or the new contents
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,54 @@
+package image
+
+import runConfig "github.com/Simeon2001/AlpineCell/config"
+
+// Media types understood when resolving manifests and unpacking layers
+const (
+	MediaTypeOCIIndex          = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest       = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerManifest    = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList        = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCILayer          = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGzip      = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeOCILayerZstd      = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MediaTypeDockerLayerGzip   = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeDockerForeignGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// Descriptor points at a blob by digest, as in the OCI image spec
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Platform selects an entry of an image index
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Index is an OCI image index or a Docker manifest list
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Manifest is an OCI image manifest or a Docker v2 schema 2 manifest
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// ConfigFile is the part of the image configuration blob we use
+type ConfigFile struct {
+	Architecture string                `json:"architecture"`
+	OS           string                `json:"os"`
+	Config       runConfig.ImageConfig `json:"config"`
+}
@@ -0,0 +1,219 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DiskUsage is how the layers of the store are shared out between images and the build cache
+type DiskUsage struct {
+	Images       int
+	ActiveImages int
+	// ImageSize counts every layer but those only the build cache refers to
+	ImageSize uint64
+	// ImageReclaimable is what no container runs on and no image in use refers to
+	ImageReclaimable uint64
+	BuildSteps       int
+	BuildCacheSize   uint64
+}
+
+// buildSteps returns every recorded build step
+func (s *Store) buildSteps() ([]*BuildStep, error) {
+	entries, err := os.ReadDir(s.buildCacheDir())
+	if err != nil {
+		return nil, err
+	}
+	var steps []*BuildStep
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.buildCacheDir(), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var step BuildStep
+		if err := json.Unmarshal(data, &step); err != nil || step.Key == "" {
+			// An unreadable entry holds no layers we could release, so it is just dropped
+			step = BuildStep{Key: strings.TrimSuffix(entry.Name(), ".json")}
+		}
+		steps = append(steps, &step)
+	}
+	return steps, nil
+}
+
+// DiskUsage measures the store. keep are the layers containers run on and usedImages the
+// names of the images they were created from.
+func (s *Store) DiskUsage(keep, usedImages map[string]bool) (*DiskUsage, error) {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	layers, err := s.Layers()
+	if err != nil {
+		return nil, err
+	}
+	images, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	steps, err := s.buildSteps()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &DiskUsage{Images: len(images), BuildSteps: len(steps)}
+	inImage := make(map[string]bool)
+	inUse := make(map[string]bool)
+	for digest := range keep {
+		inUse[digest] = true
+	}
+	for _, img := range images {
+		for _, digest := range img.Layers {
+			inImage[digest] = true
+			if usedImages[img.Name] {
+				inUse[digest] = true
+			}
+		}
+		if usedImages[img.Name] {
+			usage.ActiveImages++
+		}
+	}
+	inStep := make(map[string]bool)
+	for _, step := range steps {
+		for _, digest := range step.Layers {
+			inStep[digest] = true
+		}
+	}
+
+	for _, layer := range layers {
+		switch {
+		case inStep[layer.Digest] && !inImage[layer.Digest] && !inUse[layer.Digest]:
+			usage.BuildCacheSize += layer.Size
+		case inUse[layer.Digest]:
+			usage.ImageSize += layer.Size
+		default:
+			usage.ImageSize += layer.Size
+			usage.ImageReclaimable += layer.Size
+		}
+	}
+	return usage, nil
+}
+
+// PruneBuildCache forgets the build steps recorded before until and returns how many there were.
+// Their layers lose a reference but are left for PruneLayers, which knows what containers use.
+func (s *Store) PruneBuildCache(until time.Time) (int, error) {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	steps, err := s.buildSteps()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, step := range steps {
+		if step.Created.After(until) {
+			continue
+		}
+		if err := os.Remove(s.buildStepPath(step.Key)); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove build cache entry %s: %v", step.Key, err)
+		}
+		for _, digest := range step.Layers {
+			layer, err := s.loadLayer(digest)
+			if err != nil || layer.Refs <= 0 {
+				continue
+			}
+			layer.Refs--
+			if err := s.saveLayer(layer); err != nil {
+				return removed, err
+			}
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// PruneLayers removes the layers created before until that no image or build step refers to and
+// that are not in keep, the layers containers run on, and returns how many went. The built-in
+// rootfs is only removed with embedded. Leftovers of interrupted unpacks go as well.
+func (s *Store) PruneLayers(keep map[string]bool, embedded bool, until time.Time) (int, error) {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	s.cleanStaging()
+
+	// The reference counts are only trusted to let go of a layer when the metadata agrees
+	referenced := make(map[string]bool)
+	images, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	for _, img := range images {
+		for _, digest := range img.Layers {
+			referenced[digest] = true
+		}
+	}
+	steps, err := s.buildSteps()
+	if err != nil {
+		return 0, err
+	}
+	for _, step := range steps {
+		for _, digest := range step.Layers {
+			referenced[digest] = true
+		}
+	}
+
+	entries, err := os.ReadDir(s.layersDir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		digest := "sha256:" + entry.Name()
+		if !entry.IsDir() || entry.Name() == linkDir || strings.HasPrefix(entry.Name(), stagingPrefix) {
+			continue
+		}
+		if _, err := layerHex(digest); err != nil {
+			continue
+		}
+		// A layer directory without layer.json is what an unpack from before staging left behind
+		if !s.hasLayer(digest) {
+			if err := s.removeLayer(digest); err != nil {
+				return removed, err
+			}
+			continue
+		}
+		layer, err := s.loadLayer(digest)
+		if err != nil {
+			return removed, err
+		}
+		if keep[digest] || referenced[digest] || layer.Refs > 0 || (layer.Embedded && !embedded) || layer.Created.After(until) {
+			continue
+		}
+		if err := s.removeLayer(digest); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	// Short links left dangling by layers removed by hand
+	links, _ := os.ReadDir(filepath.Join(s.layersDir, linkDir))
+	for _, link := range links {
+		linkPath := filepath.Join(s.layersDir, linkDir, link.Name())
+		if _, err := os.Stat(linkPath); os.IsNotExist(err) {
+			_ = os.Remove(linkPath)
+		}
+	}
+	return removed, nil
+}
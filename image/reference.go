@@ -0,0 +1,102 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultRegistry = "docker.io"
+	// dockerHubEndpoint is where docker.io references are actually served from
+	dockerHubEndpoint = "registry-1.docker.io"
+	defaultTag        = "latest"
+)
+
+// Reference is a parsed image reference such as ghcr.io/org/app:1.0 or alpine@sha256:...
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference, filling in docker.io, library/ and :latest like docker does
+func ParseReference(ref string) (Reference, error) {
+	if ref == "" || strings.ContainsAny(ref, " \t\n") {
+		return Reference{}, fmt.Errorf("invalid image reference %q", ref)
+	}
+
+	var parsed Reference
+	remainder := ref
+
+	if name, digest, found := strings.Cut(remainder, "@"); found {
+		if !strings.HasPrefix(digest, "sha256:") || len(digest) != len("sha256:")+64 {
+			return Reference{}, fmt.Errorf("invalid digest in image reference %q", ref)
+		}
+		parsed.Digest = digest
+		remainder = name
+	}
+
+	// A tag is a colon after the last slash; a colon before it is a registry port
+	if i := strings.LastIndex(remainder, ":"); i > strings.LastIndex(remainder, "/") {
+		parsed.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+	}
+
+	// The first component is a registry if it looks like a host name
+	first, rest, hasSlash := strings.Cut(remainder, "/")
+	if hasSlash && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		parsed.Registry = first
+		parsed.Repository = rest
+	} else {
+		parsed.Registry = defaultRegistry
+		parsed.Repository = remainder
+	}
+
+	if parsed.Registry == defaultRegistry && !strings.Contains(parsed.Repository, "/") {
+		parsed.Repository = "library/" + parsed.Repository
+	}
+	if parsed.Tag == "" && parsed.Digest == "" {
+		parsed.Tag = defaultTag
+	}
+	if parsed.Repository == "" || parsed.Repository != strings.ToLower(parsed.Repository) {
+		return Reference{}, fmt.Errorf("invalid repository name in image reference %q", ref)
+	}
+
+	return parsed, nil
+}
+
+// String returns the fully qualified reference
+func (r Reference) String() string {
+	name := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		name += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		name += "@" + r.Digest
+	}
+	return name
+}
+
+// manifestRef is the tag or digest to request from the registry
+func (r Reference) manifestRef() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// endpoint returns the base URL of the registry API. Local registries are spoken to over plain HTTP.
+func (r Reference) endpoint(insecure bool) string {
+	host := r.Registry
+	if host == defaultRegistry {
+		host = dockerHubEndpoint
+	}
+
+	scheme := "https"
+	hostname := strings.Split(host, ":")[0]
+	if insecure || hostname == "localhost" || hostname == "127.0.0.1" {
+		scheme = "http"
+	}
+	return scheme + "://" + host
+}
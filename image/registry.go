@@ -0,0 +1,353 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// manifestAccept lists every manifest type we can resolve, indexes first
+var manifestAccept = strings.Join([]string{
+	MediaTypeOCIIndex,
+	MediaTypeDockerList,
+	MediaTypeOCIManifest,
+	MediaTypeDockerManifest,
+}, ", ")
+
+// registryClient speaks the OCI distribution (Docker registry v2) API for one repository
+type registryClient struct {
+	ref      Reference
+	baseURL  string
+	client   *http.Client
+	token    string
+	insecure bool
+}
+
+// newRegistryClient prepares a client for the repository of ref
+func newRegistryClient(ref Reference, insecure bool) *registryClient {
+	return &registryClient{
+		ref:      ref,
+		baseURL:  ref.endpoint(insecure),
+		client:   &http.Client{Timeout: 30 * time.Minute},
+		insecure: insecure,
+	}
+}
+
+// get performs a GET against the registry, fetching an anonymous bearer token when challenged
+func (c *registryClient) get(path, accept string) (*http.Response, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("request to %s failed: %v", c.ref.Registry, err)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			_ = resp.Body.Close()
+			if err := c.authenticate(challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("GET %s: unauthorized", path)
+}
+
+// authenticate answers a "Bearer realm=...,service=...,scope=..." challenge with an anonymous token
+func (c *registryClient) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("registry %s requires unsupported authentication %q", c.ref.Registry, scheme)
+	}
+
+	values := parseChallenge(params)
+	realm := values["realm"]
+	if realm == "" {
+		return fmt.Errorf("registry %s sent a challenge without realm", c.ref.Registry)
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil || (tokenURL.Scheme != "https" && tokenURL.Scheme != "http") {
+		return fmt.Errorf("registry %s sent an invalid realm %q", c.ref.Registry, realm)
+	}
+	// The realm may carry parameters of its own, which are kept
+	query := tokenURL.Query()
+	if service := values["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := values["scope"]
+	if scope == "" {
+		scope = "repository:" + c.ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	resp, err := c.client.Get(tokenURL.String())
+	if err != nil {
+		return fmt.Errorf("failed to fetch registry token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch registry token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to decode registry token: %v", err)
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	return nil
+}
+
+// parseChallenge splits key="value" pairs of a WWW-Authenticate header
+func parseChallenge(params string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(params, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found {
+			values[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return values
+}
+
+// fetchManifest downloads the manifest for a tag or digest, returning its body, media type and digest.
+// The digest is always computed from the body: a manifest fetched by digest must match it, and one
+// fetched by tag must match the Docker-Content-Digest the registry sends along.
+func (c *registryClient) fetchManifest(reference string) ([]byte, string, string, error) {
+	resp, err := c.get("/v2/"+c.ref.Repository+"/manifests/"+reference, manifestAccept)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, "", "", err
+	}
+	digest := digestOf(body)
+	expected := resp.Header.Get("Docker-Content-Digest")
+	if strings.HasPrefix(reference, "sha256:") {
+		expected = reference
+	}
+	if expected != "" && expected != digest {
+		return nil, "", "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", expected, digest)
+	}
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	return body, mediaType, digest, nil
+}
+
+// blob opens a blob by digest
+func (c *registryClient) blob(digest string) (io.ReadCloser, error) {
+	resp, err := c.get("/v2/"+c.ref.Repository+"/blobs/"+digest, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// resolveManifest follows an index to the manifest for this machine's platform
+func (c *registryClient) resolveManifest() (*Manifest, string, error) {
+	body, mediaType, digest, err := c.fetchManifest(c.ref.manifestRef())
+	if err != nil {
+		return nil, "", err
+	}
+
+	if isIndex(mediaType, body) {
+		var index Index
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, "", fmt.Errorf("failed to parse image index: %v", err)
+		}
+		descriptor, err := selectPlatform(index)
+		if err != nil {
+			return nil, "", err
+		}
+		// Fetched by digest, so fetchManifest has checked the body against the descriptor
+		if body, _, digest, err = c.fetchManifest(descriptor.Digest); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to parse image manifest: %v", err)
+	}
+	if manifest.SchemaVersion != 2 {
+		return nil, "", fmt.Errorf("unsupported manifest schema version %d", manifest.SchemaVersion)
+	}
+	return &manifest, digest, nil
+}
+
+// isIndex reports whether a manifest body is an index, falling back to its shape when untyped
+func isIndex(mediaType string, body []byte) bool {
+	if mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerList {
+		return true
+	}
+	var probe struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if json.Unmarshal(body, &probe) != nil {
+		return false
+	}
+	return probe.MediaType == MediaTypeOCIIndex || probe.MediaType == MediaTypeDockerList || len(probe.Manifests) > 0
+}
+
+// selectPlatform picks the linux manifest matching the architecture and variant we run on
+func selectPlatform(index Index) (Descriptor, error) {
+	return matchPlatform(index, runtime.GOARCH, platformVariant())
+}
+
+// platformVariant returns the variant of this machine's architecture as image indexes name it:
+// v8 for arm64 and, for arm, the GOARM this binary was built for
+func platformVariant() string {
+	switch runtime.GOARCH {
+	case "arm64":
+		return "v8"
+	case "arm":
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "GOARM" && setting.Value != "" {
+					return "v" + strings.Split(setting.Value, ",")[0]
+				}
+			}
+		}
+		return "v7"
+	}
+	return ""
+}
+
+// matchPlatform picks the linux manifest for arch with the given variant. A manifest that names no
+// variant is taken when none matches exactly; for an architecture without variants any is taken.
+func matchPlatform(index Index, arch, variant string) (Descriptor, error) {
+	var fallback *Descriptor
+	for i, descriptor := range index.Manifests {
+		platform := descriptor.Platform
+		if platform == nil || platform.OS != "linux" || platform.Architecture != arch {
+			continue
+		}
+		if platform.Variant == variant {
+			return descriptor, nil
+		}
+		if fallback == nil && (platform.Variant == "" || variant == "") {
+			fallback = &index.Manifests[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, nil
+	}
+	if variant != "" {
+		return Descriptor{}, fmt.Errorf("image has no manifest for linux/%s/%s", arch, variant)
+	}
+	return Descriptor{}, fmt.Errorf("image has no manifest for linux/%s", arch)
+}
+
+// Pull downloads an image from a registry and unpacks it into the store under its full reference
+func (s *Store) Pull(reference string, insecure bool) (*Image, error) {
+	ref, err := ParseReference(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newRegistryClient(ref, insecure)
+	manifest, digest, err := client.resolveManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", ref, err)
+	}
+
+	configBlob, err := client.blob(manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image config: %v", err)
+	}
+	configFile, err := readConfigFile(configBlob, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []layerSource
+	var layerDigests []string
+	for _, layer := range manifest.Layers {
+		if err := checkLayerMediaType(layer.MediaType); err != nil {
+			return nil, err
+		}
+		digest := layer.Digest
+		layers = append(layers, layerSource{
+			digest: digest,
+			open:   func() (io.ReadCloser, error) { return client.blob(digest) },
+		})
+		layerDigests = append(layerDigests, digest)
+	}
+
+	img := &Image{
+		Name:      ref.String(),
+		Reference: ref.String(),
+		Digest:    digest,
+		Layers:    layerDigests,
+		Config:    configFile.Config,
+		Source:    "registry",
+	}
+	if err := s.unpack(img, layers); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// readConfigFile reads and verifies the image configuration blob
+func readConfigFile(r io.ReadCloser, digest string) (*ConfigFile, error) {
+	defer r.Close()
+
+	body, err := io.ReadAll(io.LimitReader(r, 16<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %v", err)
+	}
+	if digest != "" && digestOf(body) != digest {
+		return nil, fmt.Errorf("image config digest mismatch: expected %s, got %s", digest, digestOf(body))
+	}
+
+	var configFile ConfigFile
+	if err := json.Unmarshal(body, &configFile); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %v", err)
+	}
+	return &configFile, nil
+}
+
+// checkLayerMediaType rejects layer types that are not tar archives
+func checkLayerMediaType(mediaType string) error {
+	switch mediaType {
+	case "", MediaTypeOCILayer, MediaTypeOCILayerGzip, MediaTypeOCILayerZstd,
+		MediaTypeDockerLayerGzip, MediaTypeDockerForeignGzip:
+		return nil
+	default:
+		return fmt.Errorf("unsupported layer media type %s", mediaType)
+	}
+}
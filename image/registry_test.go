@@ -0,0 +1,353 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeRegistry is a local stand-in for a registry serving one repository
+type fakeRegistry struct {
+	t         *testing.T
+	server    *httptest.Server
+	manifests map[string][]byte
+	types     map[string]string
+	// headerDigests overrides the Docker-Content-Digest sent for a manifest reference
+	headerDigests map[string]string
+	blobs         map[string][]byte
+	// token, when set, is required as a bearer token handed out by the /token realm
+	token string
+	// realmQuery is appended to the realm, its parameters must come back with the token request
+	realmQuery url.Values
+	// onBlob, when set, runs before every blob is served
+	onBlob func()
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		t:             t,
+		manifests:     make(map[string][]byte),
+		types:         make(map[string]string),
+		headerDigests: make(map[string]string),
+		blobs:         make(map[string][]byte),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		query := req.URL.Query()
+		for key := range r.realmQuery {
+			if query.Get(key) != r.realmQuery.Get(key) {
+				http.Error(w, "missing realm parameter "+key, http.StatusBadRequest)
+				return
+			}
+		}
+		if query.Get("service") != "fake" || query.Get("scope") != "repository:test/app:pull" {
+			http.Error(w, "bad token request "+req.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+	if r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token {
+		realm := r.server.URL + "/token"
+		if len(r.realmQuery) > 0 {
+			realm += "?" + r.realmQuery.Encode()
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`",service="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if reference, found := strings.CutPrefix(req.URL.Path, "/v2/test/app/manifests/"); found {
+		body, ok := r.manifests[reference]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		digest := digestOf(body)
+		if override, ok := r.headerDigests[reference]; ok {
+			digest = override
+		}
+		w.Header().Set("Content-Type", r.types[reference])
+		w.Header().Set("Docker-Content-Digest", digest)
+		_, _ = w.Write(body)
+		return
+	}
+	if digest, found := strings.CutPrefix(req.URL.Path, "/v2/test/app/blobs/"); found {
+		body, ok := r.blobs[digest]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if r.onBlob != nil {
+			r.onBlob()
+		}
+		_, _ = w.Write(body)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// addBlob stores a blob and returns its descriptor
+func (r *fakeRegistry) addBlob(mediaType string, body []byte) Descriptor {
+	digest := digestOf(body)
+	r.blobs[digest] = body
+	return Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(body))}
+}
+
+// addManifest serves v under reference and under its own digest, returning the digest
+func (r *fakeRegistry) addManifest(reference, mediaType string, v interface{}) string {
+	body, err := json.Marshal(v)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	digest := digestOf(body)
+	for _, ref := range []string{reference, digest} {
+		r.manifests[ref] = body
+		r.types[ref] = mediaType
+	}
+	return digest
+}
+
+// reference returns how the repository of the registry is pulled
+func (r *fakeRegistry) reference(tagOrDigest string) string {
+	separator := ":"
+	if strings.HasPrefix(tagOrDigest, "sha256:") {
+		separator = "@"
+	}
+	return strings.TrimPrefix(r.server.URL, "http://") + "/test/app" + separator + tagOrDigest
+}
+
+// gzipLayer returns a gzipped tar holding one file
+func gzipLayer(t *testing.T, name, content string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(buildTar(t, []entry{file(name, content)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// addImage serves a single layer image for platform under tag, returning the manifest digest
+func (r *fakeRegistry) addImage(tag string, platform Platform, content string) string {
+	configBody, _ := json.Marshal(ConfigFile{Architecture: platform.Architecture, OS: platform.OS})
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        r.addBlob("application/vnd.oci.image.config.v1+json", configBody),
+		Layers:        []Descriptor{r.addBlob(MediaTypeOCILayerGzip, gzipLayer(r.t, "etc/release", content))},
+	}
+	return r.addManifest(tag, MediaTypeOCIManifest, manifest)
+}
+
+// newTestStore opens an image store in a temporary data directory
+func newTestStore(t *testing.T) *Store {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// pulledRelease reads the file the test images carry from the top layer of img
+func pulledRelease(t *testing.T, store *Store, img *Image) string {
+	t.Helper()
+	lowers, err := store.LowerDirs(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(lowers[0], "etc", "release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// addIndex serves an index for the current platform and another one under tag
+func (r *fakeRegistry) addIndex(tag string) (string, Descriptor) {
+	here := Platform{OS: "linux", Architecture: runtime.GOARCH, Variant: platformVariant()}
+	other := Platform{OS: "linux", Architecture: "s390x"}
+	if runtime.GOARCH == "s390x" {
+		other.Architecture = "riscv64"
+	}
+
+	otherDigest := r.addImage("other", other, "other")
+	hereDigest := r.addImage("here", here, "here")
+	index := Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests: []Descriptor{
+			{MediaType: MediaTypeOCIManifest, Digest: otherDigest, Size: int64(len(r.manifests[otherDigest])), Platform: &other},
+			{MediaType: MediaTypeOCIManifest, Digest: hereDigest, Size: int64(len(r.manifests[hereDigest])), Platform: &here},
+		},
+	}
+	return r.addManifest(tag, MediaTypeOCIIndex, index), index.Manifests[1]
+}
+
+func TestPullIndex(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.token = "secret-token"
+	_, here := registry.addIndex("1.0")
+	store := newTestStore(t)
+
+	img, err := store.Pull(registry.reference("1.0"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Digest != here.Digest {
+		t.Errorf("image digest is %s, expected the platform manifest %s", img.Digest, here.Digest)
+	}
+	if got := pulledRelease(t, store, img); got != "here" {
+		t.Errorf("pulled the manifest holding %q", got)
+	}
+}
+
+func TestPullWithRealmQuery(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.token = "secret-token"
+	registry.realmQuery = url.Values{"account": {"robot"}}
+	registry.addImage("1.0", Platform{OS: "linux", Architecture: runtime.GOARCH}, "authorized")
+
+	if _, err := newTestStore(t).Pull(registry.reference("1.0"), false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullByDigest(t *testing.T) {
+	registry := newFakeRegistry(t)
+	digest := registry.addImage("1.0", Platform{OS: "linux", Architecture: runtime.GOARCH}, "pinned")
+	store := newTestStore(t)
+
+	img, err := store.Pull(registry.reference(digest), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Digest != digest {
+		t.Errorf("image digest is %s, expected %s", img.Digest, digest)
+	}
+	if got := pulledRelease(t, store, img); got != "pinned" {
+		t.Errorf("pulled the manifest holding %q", got)
+	}
+}
+
+func TestPullRejectsTamperedManifests(t *testing.T) {
+	t.Run("by digest", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		digest := registry.addImage("1.0", Platform{OS: "linux", Architecture: runtime.GOARCH}, "pinned")
+		evil := registry.addImage("evil", Platform{OS: "linux", Architecture: runtime.GOARCH}, "evil")
+		// The registry answers the pinned digest with another manifest and claims it is the pinned one
+		registry.manifests[digest] = registry.manifests[evil]
+		registry.headerDigests[digest] = digest
+
+		_, err := newTestStore(t).Pull(registry.reference(digest), false)
+		if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+			t.Fatalf("expected a digest mismatch, got %v", err)
+		}
+	})
+
+	t.Run("by tag with a wrong header", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		registry.addImage("1.0", Platform{OS: "linux", Architecture: runtime.GOARCH}, "tagged")
+		registry.headerDigests["1.0"] = digestOf([]byte("something else"))
+
+		_, err := newTestStore(t).Pull(registry.reference("1.0"), false)
+		if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+			t.Fatalf("expected a digest mismatch, got %v", err)
+		}
+	})
+
+	t.Run("index entry", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		_, here := registry.addIndex("1.0")
+		evil := registry.addImage("evil", Platform{OS: "linux", Architecture: runtime.GOARCH}, "evil")
+		registry.manifests[here.Digest] = registry.manifests[evil]
+		registry.headerDigests[here.Digest] = here.Digest
+
+		_, err := newTestStore(t).Pull(registry.reference("1.0"), false)
+		if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+			t.Fatalf("expected a digest mismatch, got %v", err)
+		}
+	})
+
+	t.Run("index by digest", func(t *testing.T) {
+		registry := newFakeRegistry(t)
+		indexDigest, _ := registry.addIndex("1.0")
+		registry.manifests[indexDigest] = append([]byte(" "), registry.manifests[indexDigest]...)
+		registry.headerDigests[indexDigest] = indexDigest
+
+		_, err := newTestStore(t).Pull(registry.reference(indexDigest), false)
+		if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+			t.Fatalf("expected a digest mismatch, got %v", err)
+		}
+	})
+}
+
+func TestPullRejectsTamperedLayers(t *testing.T) {
+	registry := newFakeRegistry(t)
+	digest := registry.addImage("1.0", Platform{OS: "linux", Architecture: runtime.GOARCH}, "genuine")
+	var manifest Manifest
+	if err := json.Unmarshal(registry.manifests[digest], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	registry.blobs[manifest.Layers[0].Digest] = gzipLayer(t, "etc/release", "forged")
+
+	_, err := newTestStore(t).Pull(registry.reference("1.0"), false)
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("expected a digest mismatch, got %v", err)
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	descriptor := func(digest, arch, variant string) Descriptor {
+		return Descriptor{Digest: digest, Platform: &Platform{OS: "linux", Architecture: arch, Variant: variant}}
+	}
+	index := Index{Manifests: []Descriptor{
+		{Digest: "windows", Platform: &Platform{OS: "windows", Architecture: "amd64"}},
+		descriptor("amd64-v3", "amd64", "v3"),
+		descriptor("amd64", "amd64", ""),
+		descriptor("arm-v6", "arm", "v6"),
+		descriptor("arm-v7", "arm", "v7"),
+		descriptor("arm64", "arm64", ""),
+		descriptor("riscv64-v1", "riscv64", "v1"),
+	}}
+
+	for _, tc := range []struct {
+		arch, variant, want string
+	}{
+		{"amd64", "", "amd64"},
+		{"arm", "v7", "arm-v7"},
+		{"arm", "v6", "arm-v6"},
+		{"arm", "v5", ""},
+		{"arm64", "v8", "arm64"},
+		{"riscv64", "", "riscv64-v1"},
+		{"s390x", "", ""},
+	} {
+		got, err := matchPlatform(index, tc.arch, tc.variant)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s/%s: expected no match, got %s", tc.arch, tc.variant, got.Digest)
+			}
+			continue
+		}
+		if err != nil || got.Digest != tc.want {
+			t.Errorf("%s/%s: got %s (%v), expected %s", tc.arch, tc.variant, got.Digest, err, tc.want)
+		}
+	}
+}
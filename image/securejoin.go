@@ -0,0 +1,199 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks bounds the symlinks followed while resolving one path, like the kernel's ELOOP limit
+const maxSymlinks = 40
+
+// errNoOpenat2 means the kernel or a seccomp filter does not allow openat2
+var errNoOpenat2 = errors.New("openat2 is not available")
+
+// openat2Unsupported is set after openat2 failed once, so later lookups go straight to the fallback
+var openat2Unsupported atomic.Bool
+
+// resolveDir returns the real path of the directory name inside root, creating missing directories
+// with mode 0755. Symlinks are resolved as if root were "/", so no layout of the tree, such as an
+// earlier entry that is a symlink to the host, can lead outside root.
+func resolveDir(root, name string) (string, error) {
+	if !openat2Unsupported.Load() {
+		resolved, err := resolveDirOpenat2(root, name)
+		if err != errNoOpenat2 {
+			return resolved, err
+		}
+		openat2Unsupported.Store(true)
+	}
+	return resolveDirUserspace(root, name)
+}
+
+// pathComponents splits a slash separated path into its components, dropping empty ones and "."
+func pathComponents(name string) []string {
+	var components []string
+	for _, component := range strings.Split(name, "/") {
+		if component != "" && component != "." {
+			components = append(components, component)
+		}
+	}
+	return components
+}
+
+// resolveDirOpenat2 lets the kernel confine the lookup with RESOLVE_IN_ROOT, one component at a time
+// so missing directories can be created in the parent that was just resolved
+func resolveDirOpenat2(root, name string) (string, error) {
+	rootFd, err := unix.Openat2(unix.AT_FDCWD, root, &unix.OpenHow{Flags: unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC})
+	if err == unix.ENOSYS || err == unix.EPERM {
+		return "", errNoOpenat2
+	}
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(rootFd)
+
+	how := &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	}
+
+	// The prefix is kept unresolved; ".." after a symlink must be handled by the kernel, not lexically
+	prefix := "."
+	pending := pathComponents(name)
+	links := 0
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+
+		next := prefix + "/" + component
+		fd, err := unix.Openat2(rootFd, next, how)
+		if err == unix.ENOENT {
+			var parentFd int
+			if parentFd, err = unix.Openat2(rootFd, prefix, how); err != nil {
+				return "", err
+			}
+			err = unix.Mkdirat(parentFd, component, 0755)
+			if err == unix.EEXIST {
+				// A dangling symlink: create what it points to, resolved inside root like any other path
+				target, linkErr := readlinkat(parentFd, component)
+				unix.Close(parentFd)
+				if linkErr != nil {
+					return "", fmt.Errorf("failed to resolve %s: %v", next, linkErr)
+				}
+				links++
+				if links > maxSymlinks {
+					return "", fmt.Errorf("too many levels of symbolic links in %s", name)
+				}
+				if strings.HasPrefix(target, "/") {
+					prefix = "."
+				}
+				pending = append(pathComponents(target), pending...)
+				continue
+			}
+			unix.Close(parentFd)
+			if err != nil {
+				return "", fmt.Errorf("failed to create %s: %v", next, err)
+			}
+			fd, err = unix.Openat2(rootFd, next, how)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %v", next, err)
+		}
+		unix.Close(fd)
+		prefix = next
+	}
+
+	fd, err := unix.Openat2(rootFd, prefix, how)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+
+	rootPath, err := fdPath(rootFd)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := fdPath(fd)
+	if err != nil {
+		return "", err
+	}
+	if resolved != rootPath && !strings.HasPrefix(resolved, rootPath+"/") {
+		return "", fmt.Errorf("%s resolves to %s outside %s", name, resolved, rootPath)
+	}
+	return resolved, nil
+}
+
+// readlinkat returns the target of the symlink name in the directory dirFd
+func readlinkat(dirFd int, name string) (string, error) {
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(dirFd, name, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// fdPath returns the path the kernel has for an open file descriptor
+func fdPath(fd int) (string, error) {
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+}
+
+// resolveDirUserspace walks the path with Lstat and Readlink, following symlinks by splicing their
+// target into the remaining components and clamping ".." at root
+func resolveDirUserspace(root, name string) (string, error) {
+	var resolved []string
+	pending := pathComponents(name)
+	links := 0
+
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+
+		if component == ".." {
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		current := filepath.Join(root, filepath.Join(resolved...), component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(current, 0755); err != nil {
+				return "", fmt.Errorf("failed to create %s: %v", current, err)
+			}
+			resolved = append(resolved, component)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			links++
+			if links > maxSymlinks {
+				return "", fmt.Errorf("too many levels of symbolic links in %s", name)
+			}
+			target, err := os.Readlink(current)
+			if err != nil {
+				return "", err
+			}
+			if strings.HasPrefix(target, "/") {
+				resolved = nil
+			}
+			pending = append(pathComponents(target), pending...)
+			continue
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s is not a directory", current)
+		}
+		resolved = append(resolved, component)
+	}
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
@@ -0,0 +1,301 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Image is the metadata recorded for every rootfs in the store
+type Image struct {
+	Name      string                `json:"name"`
+	Reference string                `json:"reference"`
+	Digest    string                `json:"digest"`
+	Layers    []string              `json:"layers"`
+	Config    runConfig.ImageConfig `json:"config"`
+	Source    string                `json:"source"`
+	Size      uint64                `json:"size"`
+	Created   time.Time             `json:"created"`
+}
+
+// EmbeddedImage names the Alpine rootfs built into the binary, used when no image is chosen
+const EmbeddedImage = "embedded"
+
+// defaultFile records the image new containers use when --image is not given
+const defaultFile = "default"
+
+// Store keeps unpacked layers under <data>/layers, keyed by digest and shared between images,
+// and image metadata under <data>/metadata/images
+type Store struct {
+	layersDir   string
+	metadataDir string
+}
+
+// NewStore opens the image store in the runtime data directory, creating it if needed
+func NewStore() (*Store, error) {
+	dataDir, _, err := runConfig.RuntimePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		layersDir:   filepath.Join(dataDir, "layers"),
+		metadataDir: filepath.Join(dataDir, "metadata", "images"),
+	}
+	for _, dir := range []string{filepath.Join(store.layersDir, linkDir), store.metadataDir, store.buildCacheDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create image store: %v", err)
+		}
+	}
+	return store, nil
+}
+
+// storeName turns an image name such as docker.io/library/alpine:3.20 into a file name. "_" is
+// escaped too, so every name gets a file of its own.
+func storeName(name string) string {
+	return strings.NewReplacer("_", "__", "/", "_s", ":", "_c", "@", "_a").Replace(name)
+}
+
+// metadataPath returns where the metadata of an image lives
+func (s *Store) metadataPath(name string) string {
+	return filepath.Join(s.metadataDir, storeName(name)+".json")
+}
+
+// Get loads the metadata of an installed image
+func (s *Store) Get(name string) (*Image, error) {
+	data, err := os.ReadFile(s.metadataPath(name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("image %s is not installed", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var img Image
+	if err := json.Unmarshal(data, &img); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata of image %s: %v", name, err)
+	}
+	return &img, nil
+}
+
+// Resolve finds an installed image by the name it was stored under, its fully qualified reference,
+// or its digest (a unique prefix of at least 12 hex characters is enough)
+func (s *Store) Resolve(name string) (*Image, error) {
+	img, err := s.Get(name)
+	if err == nil {
+		return img, nil
+	}
+	if ref, parseErr := ParseReference(name); parseErr == nil && ref.String() != name {
+		if img, refErr := s.Get(ref.String()); refErr == nil {
+			return img, nil
+		}
+	}
+
+	prefix := strings.TrimPrefix(name, "sha256:")
+	if len(prefix) < 12 || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, err
+	}
+	images, listErr := s.List()
+	if listErr != nil {
+		return nil, listErr
+	}
+	var matches []*Image
+	for _, candidate := range images {
+		if strings.HasPrefix(strings.TrimPrefix(candidate.Digest, "sha256:"), prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, err
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("digest %s matches %d images, use the image name", name, len(matches))
+	}
+}
+
+// List returns every installed image sorted by name
+func (s *Store) List() ([]*Image, error) {
+	entries, err := os.ReadDir(s.metadataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []*Image
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.metadataDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var img Image
+		if err := json.Unmarshal(data, &img); err != nil {
+			log.Printf("[❌] Skipping unreadable image metadata %s: %v", entry.Name(), err)
+			continue
+		}
+		images = append(images, &img)
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+// Remove deletes the metadata of an image and the layers nothing else uses, clearing it as the
+// default. inUse, when given, is asked with the store lock held whether the image may go, so no
+// container can be created from it in between.
+func (s *Store) Remove(name string, inUse func(img *Image) error) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	img, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+	if inUse != nil {
+		if err := inUse(img); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(s.metadataPath(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove metadata of %s: %v", name, err)
+	}
+	if err := s.releaseLayers(img.Layers); err != nil {
+		return err
+	}
+	if s.Default() == name {
+		return s.setDefault("")
+	}
+	return nil
+}
+
+// Default returns the image new containers use, empty for the embedded Alpine rootfs
+func (s *Store) Default() string {
+	data, err := os.ReadFile(filepath.Join(s.metadataDir, defaultFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// SetDefault changes the image new containers use; an empty name restores the embedded Alpine rootfs
+func (s *Store) SetDefault(name string) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.setDefault(name)
+}
+
+// setDefault writes the default image with the store lock held
+func (s *Store) setDefault(name string) error {
+	path := filepath.Join(s.metadataDir, defaultFile)
+	if name == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFileAtomic(path, []byte(name+"\n"))
+}
+
+// save writes the metadata of an image
+func (s *Store) save(img *Image) error {
+	data, err := json.MarshalIndent(img, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal image metadata: %v", err)
+	}
+	return writeFileAtomic(s.metadataPath(img.Name), data)
+}
+
+// unpack stores the layers of an image, reusing layers already present, and records its metadata.
+// The digests of the stored layers replace img.Layers. An image with the same name is replaced.
+// Layers are fetched and extracted before the store is locked, which is only held to install them.
+func (s *Store) unpack(img *Image, layers []layerSource) error {
+	var digests []string
+	if len(img.Layers) > len(layers) {
+		// Layers already in the store the new ones are stacked on, such as a committed container's base
+		digests = append(digests, img.Layers[:len(img.Layers)-len(layers)]...)
+	}
+	if len(digests)+len(layers) > MaxLayers {
+		return fmt.Errorf("image %s would have %d layers, more than the %d an overlay can stack; export and import it to flatten", img.Name, len(digests)+len(layers), MaxLayers)
+	}
+
+	var staged []*stagedLayer
+	defer func() {
+		for _, layer := range staged {
+			layer.release()
+		}
+	}()
+	for i, layer := range layers {
+		label := shortDigest(layer.digest)
+		if s.hasLayer(layer.digest) {
+			label += " (already stored)"
+		}
+		fmt.Printf("📦 Layer %d/%d %s\n", i+1, len(layers), label)
+		layer, err := s.stageLayer(layer)
+		if err != nil {
+			return fmt.Errorf("failed to store layer %d: %v", i+1, err)
+		}
+		staged = append(staged, layer)
+	}
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s.cleanStaging()
+
+	for i, layer := range staged {
+		digest, err := s.installLayer(layer)
+		if err != nil {
+			return fmt.Errorf("failed to store layer %d: %v", i+1, err)
+		}
+		digests = append(digests, digest)
+	}
+	img.Layers = digests
+
+	img.Size = 0
+	for _, digest := range digests {
+		layer, err := s.loadLayer(digest)
+		if err != nil {
+			return err
+		}
+		img.Size += layer.Size
+	}
+
+	// Take the new references before dropping the old ones so shared layers survive
+	previous, _ := s.Get(img.Name)
+	if err := s.retainLayers(digests); err != nil {
+		return err
+	}
+	img.Created = time.Now()
+	if err := s.save(img); err != nil {
+		return err
+	}
+	if previous != nil {
+		return s.releaseLayers(previous.Layers)
+	}
+	return nil
+}
+
+// shortDigest trims a digest for display
+func shortDigest(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
@@ -0,0 +1,74 @@
+package image
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestStoreNameIsInjective(t *testing.T) {
+	names := []string{
+		"a/b", "a_b", "a:b", "a@b", "a__b", "a_sb", "a/_b", "a_/b",
+		"x:y", "x_y", "img/cat", "img:at", "docker.io/library/alpine:3.20",
+		"docker.io_library_alpine_3.20", "alpine@sha256:0123", "alpine_sha256_0123",
+	}
+	seen := make(map[string]string)
+	for _, name := range names {
+		file := storeName(name)
+		if other, found := seen[file]; found {
+			t.Errorf("%q and %q are both stored as %q", name, other, file)
+		}
+		seen[file] = name
+	}
+}
+
+func TestCleanStagingKeepsLayersBeingStaged(t *testing.T) {
+	store := newTestStore(t)
+	busy, lock, err := store.newStagingDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	stale, err := os.MkdirTemp(store.layersDir, stagingPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.cleanStaging()
+	if _, err := os.Stat(busy); err != nil {
+		t.Errorf("staging dir still being filled was removed: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale staging dir was kept: %v", err)
+	}
+}
+
+func TestPullDoesNotHoldTheStoreLock(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.addImage("1.0", Platform{OS: "linux", Architecture: runtime.GOARCH}, "slow")
+	store := newTestStore(t)
+
+	// While the layer is downloading, readers of the store must get through
+	registry.onBlob = func() {
+		done := make(chan error, 1)
+		go func() {
+			unlock, err := store.lock(false)
+			if err == nil {
+				unlock()
+			}
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("the store stayed locked while a layer was downloading")
+		}
+	}
+	if _, err := store.Pull(registry.reference("1.0"), false); err != nil {
+		t.Fatal(err)
+	}
+}
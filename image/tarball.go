@@ -0,0 +1,232 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Opaque directory markers overlayfs sets in an upper layer, with and without the userxattr option,
+// and the one fuse-overlayfs uses when it runs unprivileged
+var overlayOpaqueXattrs = []string{"user.overlay.opaque", "trusted.overlay.opaque", "user.fuseoverlayfs.opaque"}
+
+// overlayXattrPrefixes hold overlay bookkeeping that is never copied into a layer
+var overlayXattrPrefixes = []string{"user.overlay.", "trusted.overlay.", "user.fuseoverlayfs."}
+
+// tarWriter archives a directory tree keeping ownership, modes, mtimes, xattrs and hardlinks
+type tarWriter struct {
+	root string
+	tw   *tar.Writer
+	// overlayDiff converts overlayfs whiteouts and opaque directories into OCI whiteouts
+	overlayDiff bool
+	links       map[[2]uint64]string
+}
+
+// WriteTar writes the tree under root to w as a tar archive
+func WriteTar(root string, w io.Writer) error {
+	return writeTree(root, w, false)
+}
+
+// writeLayer writes an overlayfs upper directory to w as an OCI layer
+func writeLayer(upper string, w io.Writer) error {
+	return writeTree(upper, w, true)
+}
+
+// writeTree walks root in lexical order and archives every entry
+func writeTree(root string, w io.Writer, overlayDiff bool) error {
+	tw := &tarWriter{
+		root:        root,
+		tw:          tar.NewWriter(w),
+		overlayDiff: overlayDiff,
+		links:       make(map[[2]uint64]string),
+	}
+
+	err := filepath.WalkDir(root, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if walkPath == root {
+			return nil
+		}
+		return tw.addEntry(walkPath)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.tw.Close()
+}
+
+// addEntry writes the header and contents of a single file
+func (t *tarWriter) addEntry(walkPath string) error {
+	rel, err := filepath.Rel(t.root, walkPath)
+	if err != nil {
+		return err
+	}
+	name := filepath.ToSlash(rel)
+
+	info, err := os.Lstat(walkPath)
+	if err != nil {
+		return err
+	}
+	stat, _ := info.Sys().(*syscall.Stat_t)
+
+	// overlayfs records deletions as 0:0 character devices
+	if t.overlayDiff && info.Mode()&os.ModeCharDevice != 0 && stat != nil && stat.Rdev == 0 {
+		dir, base := filepath.Split(name)
+		return t.writeMarker(dir + whiteoutPrefix + base)
+	}
+
+	if info.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+
+	var linkTarget string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if linkTarget, err = os.Readlink(walkPath); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %v", walkPath, err)
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Format = tar.FormatPAX
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = info.ModTime(), info.ModTime()
+
+	// Later names of a hardlinked file point at the first one
+	if info.Mode().IsRegular() && stat != nil && stat.Nlink > 1 {
+		key := [2]uint64{uint64(stat.Dev), stat.Ino}
+		if first, seen := t.links[key]; seen {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			t.links[key] = name
+		}
+	}
+
+	opaque, err := t.readXattrs(walkPath, hdr)
+	if err != nil {
+		return err
+	}
+
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		file, err := os.Open(walkPath)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(t.tw, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %v", walkPath, err)
+		}
+	}
+
+	if opaque {
+		return t.writeMarker(name + "/" + whiteoutOpaque)
+	}
+	return nil
+}
+
+// readXattrs copies extended attributes into PAX records, leaving out overlayfs bookkeeping.
+// It reports whether the directory is marked opaque.
+func (t *tarWriter) readXattrs(walkPath string, hdr *tar.Header) (bool, error) {
+	names, err := listXattrs(walkPath)
+	if err != nil {
+		return false, err
+	}
+
+	opaque := false
+	for _, attr := range names {
+		value, err := getXattr(walkPath, attr)
+		if err != nil {
+			return false, err
+		}
+		if hasAnyPrefix(attr, overlayXattrPrefixes) {
+			if t.overlayDiff && hdr.Typeflag == tar.TypeDir && string(value) == "y" {
+				for _, opaqueAttr := range overlayOpaqueXattrs {
+					opaque = opaque || attr == opaqueAttr
+				}
+			}
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[xattrPaxPrefix+attr] = string(value)
+	}
+	return opaque, nil
+}
+
+// hasAnyPrefix reports whether s starts with one of prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMarker writes an empty whiteout file
+func (t *tarWriter) writeMarker(name string) error {
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Format:   tar.FormatPAX,
+	})
+}
+
+// listXattrs returns the names of the extended attributes of a file, not following symlinks
+func listXattrs(filePath string) ([]string, error) {
+	size, err := unix.Llistxattr(filePath, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list xattrs of %s: %v", filePath, err)
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(filePath, buf); err != nil {
+		return nil, fmt.Errorf("failed to list xattrs of %s: %v", filePath, err)
+	}
+
+	var names []string
+	for _, attr := range strings.Split(string(buf[:size]), "\x00") {
+		if attr != "" {
+			names = append(names, attr)
+		}
+	}
+	return names, nil
+}
+
+// getXattr reads one extended attribute of a file, not following symlinks
+func getXattr(filePath, attr string) ([]byte, error) {
+	size, err := unix.Lgetxattr(filePath, attr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read xattr %s of %s: %v", attr, filePath, err)
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Lgetxattr(filePath, attr, buf); err != nil {
+		return nil, fmt.Errorf("failed to read xattr %s of %s: %v", attr, filePath, err)
+	}
+	return buf[:size], nil
+}
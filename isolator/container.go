@@ -2,6 +2,7 @@ package isolator
 
 import (
 	"fmt"
+	"github.com/Simeon2001/AlpineCell/cache"
 	"github.com/Simeon2001/AlpineCell/isolator/utils"
 	"github.com/Simeon2001/AlpineCell/message"
 	"github.com/Simeon2001/AlpineCell/security"
@@ -120,7 +121,7 @@ func SpawnContainer() {
 	// create pathname for mounted or copied directory
 	var mountedProjectDir string
 	if getconfig.ContainerConfig.ContainerID != "" {
-		mountedProjectDir = "MDIR-" + getconfig.ContainerConfig.ContainerID
+		mountedProjectDir = ProjectDirPrefix + getconfig.ContainerConfig.ContainerID
 	} else {
 		must("containerID is null error; ", fmt.Errorf("containerID is null"))
 	}
@@ -130,6 +131,10 @@ func SpawnContainer() {
 	// Make mount namespace private
 	must("namespace private mount error: ", unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""))
 
+	// Probe before the environment is cleared, fuse-overlayfs is looked up in PATH
+	driver, err := selectStorageDriver(getconfig.StorageDriver, securityConfig)
+	must("storage driver selection failed", err)
+
 	// Clear all environment variables and set only what's needed
 	os.Clearenv()
 
@@ -138,9 +143,11 @@ func SpawnContainer() {
 	conEtcPath := filepath.Join(rootfs, "etc")
 	containerResolv := filepath.Join(conEtcPath, "resolv.conf")
 
-	// Construct the overlay options string
-	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", securityConfig.RootfsPath, securityConfig.UpperPath, securityConfig.WorkPath)
-	must("overlay mount failed", unix.Mount("overlay", rootfs, "overlay", 0, options))
+	must(driver.name()+" rootfs mount failed", driver.mount(securityConfig, rootfs, getconfig.Ephemeral, getconfig.StorageSize))
+	must("volume mounts failed", mountVolumes(rootfs, getconfig.Volumes))
+	if getconfig.CacheDir != "" {
+		must("cache mounts failed", mountCaches(rootfs, getconfig.CacheDir))
+	}
 
 	if getconfig.Network {
 		// Copy host resolv.conf to container
@@ -152,7 +159,9 @@ func SpawnContainer() {
 
 	// mounted proc, dev, sys and devicesnode
 	// mounter(rootfs, mountedProjectDir)
-	mounter(rootfs, dns)
+	mounter(rootfs, dns, getconfig.CgroupDelegate, getconfig.DevSize, getconfig.ShmSize)
+	// Mounted after mounter so the runtime's /dev and /dev/shm mounts cannot hide a user --tmpfs
+	must("tmpfs mounts failed", mountTmpfs(rootfs, getconfig.Tmpfs))
 
 	// Create a directory to hold the old root (inside the new root)
 	putOld := filepath.Join(rootfs, ".pivot_old") //rootfs + "/.pivot_old"
@@ -164,8 +173,14 @@ func SpawnContainer() {
 	if getconfig.MountBool {
 		must("bind mount the source to the target dest error: ", unix.Mount(getconfig.Mounts, bindDest, "", unix.MS_BIND, ""))
 	}
+	if getconfig.OverlayMount != "" {
+		must("overlay mount of the project error: ", mountProjectOverlay(driver, securityConfig.UpperPath, getconfig.OverlayMount, bindDest))
+	}
 	if getconfig.CopyMounts != "" {
-		must("copy mounts error: ", utils.CopyDirectoryContents(getconfig.CopyMounts, bindDest))
+		patterns, err := utils.ReadIgnorePatterns(getconfig.CopyMounts, getconfig.CopyExclude)
+		must("reading copy ignore patterns error: ", err)
+		must("copy mounts error: ", utils.CopyDirectoryContents(getconfig.CopyMounts, bindDest, utils.NewIgnoreMatcher(patterns)))
+		must("copy manifest error: ", writeCopyManifest(securityConfig.UpperPath, getconfig.CopyMounts, patterns, bindDest))
 	}
 
 	// change to the new rootfs
@@ -198,6 +213,19 @@ func SpawnContainer() {
 		fmt.Sprintf("PWD=%s", mountedProjectDir),
 	)
 
+	// The image's environment wins over our defaults, PATH included
+	if len(getconfig.ImageConfig.Env) > 0 {
+		env = mergeEnv(env, getconfig.ImageConfig.Env)
+		os.Setenv("PATH", lookupEnv(env, "PATH"))
+	}
+
+	// Point the package managers at the shared caches, over what the image sets
+	if getconfig.CacheDir != "" {
+		for _, ecosystem := range cache.Ecosystems {
+			env = mergeEnv(env, ecosystem.Env)
+		}
+	}
+
 	// Check for dependency files and set execution commands based on language
 	var execCommand string
 	var execArgs []string
@@ -308,6 +336,9 @@ func SpawnContainer() {
 				// Use the virtual environment's pip for installation
 				installCmd = filepath.Join(venvPath, "bin", "pip")
 				installArgs = []string{"install", "--no-cache-dir", "-r", "requirements.txt"}
+				if getconfig.CacheDir != "" {
+					installArgs = []string{"install", "-r", "requirements.txt"}
+				}
 
 				// Update PATH to include virtual environment at the beginning
 				for i, envVar := range env {
@@ -346,7 +377,17 @@ func SpawnContainer() {
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 
+			// Installs into a cache that is not safe to share take turns with other containers
+			releaseCache := func() {}
+			if getconfig.CacheDir != "" {
+				if ecosystem := cache.ForTool(installCmd); ecosystem != nil && ecosystem.Exclusive {
+					releaseCache, err = cache.LockInstall(ecosystem.Destination)
+					must("cache lock error: ", err)
+				}
+			}
+
 			err = cmd.Run()
+			releaseCache()
 			must("dependency installation error: ", err)
 
 			log.Printf("Dependencies installed successfully")
@@ -361,6 +402,19 @@ func SpawnContainer() {
 
 	}
 
+	// Without --script or --command run what the image defines, from its working directory
+	runImageCommand := execCommand == "" && getconfig.ImageConfig.HasDefaultCommand()
+	if runImageCommand {
+		imageCommand := imageArgv(getconfig.ImageConfig)
+		execCommand = imageCommand[0]
+		execArgs = imageCommand[1:]
+		if workDir := getconfig.ImageConfig.WorkingDir; workDir != "" {
+			must("image working directory error: ", os.MkdirAll(workDir, 0755))
+			must("chdir to image working directory failed: ", os.Chdir(workDir))
+			env = mergeEnv(env, []string{"PWD=" + workDir})
+		}
+	}
+
 	var finalCmdPath string
 	var finalArgv []string
 
@@ -385,7 +439,11 @@ func SpawnContainer() {
 		}
 	}
 
-	if execCommand == "sh" && len(execArgs) > 0 && strings.HasPrefix(execArgs[0], "-c ") {
+	if runImageCommand {
+		// Entrypoint and Cmd are already an argument vector, no shell heuristics apply
+		finalCmdPath = cmdPath
+		finalArgv = argv
+	} else if execCommand == "sh" && len(execArgs) > 0 && strings.HasPrefix(execArgs[0], "-c ") {
 		fmt.Println("💡 Detected 'sh -c' pattern. Preparing command for shell execution.")
 		commandToRun := strings.TrimPrefix(execArgs[0], "-c ")
 
@@ -413,6 +471,7 @@ func SpawnContainer() {
 		finalArgv = argv
 	}
 
+	must("rlimits error: ", security.ApplyRlimits(securityConfig.Rlimit))
 	must("capabilities error: ", security.ApplyCapabilities(securityConfig.Capabilities))
 	must("seccomp error: ", security.ApplySeccomp(securityConfig.Seccomp))
 
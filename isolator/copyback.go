@@ -0,0 +1,144 @@
+package isolator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Simeon2001/AlpineCell/isolator/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// ProjectDirPrefix names the directory, followed by the container ID, where the project is copied or mounted
+const ProjectDirPrefix = "MDIR-"
+
+// copyManifestName is kept next to a container's upper layer once a run copied the project in
+const copyManifestName = "copy.json"
+
+// CopyManifest records the copied project as it was when the container started, the base that
+// changes made by the container and by the host are both measured against
+type CopyManifest struct {
+	Source   string                     `json:"source"`
+	Patterns []string                   `json:"patterns,omitempty"`
+	Copied   time.Time                  `json:"copied"`
+	Entries  map[string]utils.TreeEntry `json:"entries"`
+}
+
+// CopyManifestPath returns where the copy manifest of the container with this upper layer lives
+func CopyManifestPath(upperPath string) string {
+	return filepath.Join(filepath.Dir(upperPath), copyManifestName)
+}
+
+// LoadCopyManifest reads the copy manifest of a container
+func LoadCopyManifest(upperPath string) (*CopyManifest, error) {
+	data, err := os.ReadFile(CopyManifestPath(upperPath))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("the container has not been run with --copy")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest CopyManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse copy manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// Save writes the copy manifest of a container
+func (m *CopyManifest) Save(upperPath string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(CopyManifestPath(upperPath), data, 0644)
+}
+
+// writeCopyManifest records the project copy at copyDir right after --copy filled it
+func writeCopyManifest(upperPath, source string, patterns []string, copyDir string) error {
+	entries, err := utils.ScanTree(copyDir, utils.NewIgnoreMatcher(patterns))
+	if err != nil {
+		return err
+	}
+	manifest := CopyManifest{Source: source, Patterns: patterns, Copied: time.Now(), Entries: entries}
+	return manifest.Save(upperPath)
+}
+
+// PlanCopyBack compares the project copy at copyDir with the manifest and the host project and
+// returns the changes the container made, flagging those the host changed too
+func PlanCopyBack(manifest *CopyManifest, copyDir string) ([]utils.TreeChange, map[string]utils.TreeEntry, error) {
+	ignore := utils.NewIgnoreMatcher(manifest.Patterns)
+	copied, err := utils.ScanTree(copyDir, ignore)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to scan the container copy: %v", err)
+	}
+	host, err := utils.ScanTree(manifest.Source, ignore)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to scan %s: %v", manifest.Source, err)
+	}
+	changes := utils.DiffTrees(manifest.Entries, copied, host)
+
+	// The scans leave out ignored files, which a directory the container deleted may still hold on
+	// the host; such a directory, and the deleted ones above it, stay. Deepest paths come first.
+	kept := make(map[string]bool)
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if change.Kind != utils.ChangeDeleted || !manifest.Entries[change.Path].Mode.IsDir() {
+			continue
+		}
+		if !change.Conflict && !kept[change.Path] {
+			children, err := os.ReadDir(filepath.Join(manifest.Source, filepath.FromSlash(change.Path)))
+			if err != nil {
+				continue
+			}
+			for _, child := range children {
+				if _, inBase := manifest.Entries[path.Join(change.Path, child.Name())]; !inBase {
+					changes[i].Conflict = true
+					break
+				}
+			}
+		}
+		if changes[i].Conflict || kept[change.Path] {
+			changes[i].Conflict = true
+			for dir := path.Dir(change.Path); dir != "."; dir = path.Dir(dir) {
+				kept[dir] = true
+			}
+		}
+	}
+	return changes, copied, nil
+}
+
+// CopyBack applies the changes from PlanCopyBack to the host project and moves the manifest forward,
+// so the same changes are not applied twice. Conflicts and changes that failed keep their old base
+// and show up again; the failures are returned once everything else is applied and recorded.
+func CopyBack(manifest *CopyManifest, upperPath, copyDir string, changes []utils.TreeChange, copied map[string]utils.TreeEntry) error {
+	failed := utils.ApplyChanges(copyDir, manifest.Source, changes)
+	unapplied := make(map[string]bool, len(failed))
+	errs := make([]error, 0, len(failed))
+	for _, failure := range failed {
+		unapplied[failure.Path] = true
+		errs = append(errs, failure)
+	}
+
+	entries := make(map[string]utils.TreeEntry, len(copied))
+	for path, entry := range copied {
+		entries[path] = entry
+	}
+	for _, change := range changes {
+		if !change.Conflict && !unapplied[change.Path] {
+			continue
+		}
+		if entry, ok := manifest.Entries[change.Path]; ok {
+			entries[change.Path] = entry
+		} else {
+			delete(entries, change.Path)
+		}
+	}
+	manifest.Entries = entries
+	if err := manifest.Save(upperPath); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
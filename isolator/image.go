@@ -0,0 +1,40 @@
+package isolator
+
+import (
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"strings"
+)
+
+// mergeEnv overlays the image's environment on top of env, replacing variables with the same name
+func mergeEnv(env, imageEnv []string) []string {
+	merged := append([]string{}, env...)
+	for _, entry := range imageEnv {
+		name, _, _ := strings.Cut(entry, "=")
+		replaced := false
+		for i, existing := range merged {
+			if strings.HasPrefix(existing, name+"=") {
+				merged[i] = entry
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, entry)
+		}
+	}
+	return merged
+}
+
+// imageArgv returns the entrypoint followed by the default command of an image
+func imageArgv(imageConfig runConfig.ImageConfig) []string {
+	return append(append([]string{}, imageConfig.Entrypoint...), imageConfig.Cmd...)
+}
+
+// lookupEnv returns the value of a variable in an environment list
+func lookupEnv(env []string, name string) string {
+	for _, entry := range env {
+		if value, found := strings.CutPrefix(entry, name+"="); found {
+			return value
+		}
+	}
+	return ""
+}
@@ -2,16 +2,20 @@ package isolator
 
 import (
 	"fmt"
+	"github.com/Simeon2001/AlpineCell/cache"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
 	"github.com/Simeon2001/AlpineCell/isolator/utils"
 	"golang.org/x/sys/unix"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 )
 
-// mounter mounts necessary directories and filesystems inside the container
-func mounter(rootfs, dns string) {
+// mounter mounts necessary directories and filesystems inside the container.
+// cgroupWritable leaves /sys/fs/cgroup read-write for containers with a delegated subtree.
+func mounter(rootfs, dns string, cgroupWritable bool, devSize, shmSize uint64) {
 	// Create necessary directories
 	dirs := []string{
 		"/dev", "/dev/pts", "/dev/mqueue", "/dev/shm",
@@ -51,8 +55,15 @@ func mounter(rootfs, dns string) {
 
 	// Try mounting sysfs (works in rootful), else bind-mount /sys
 	must("mount sysfs", unix.Mount("sysfs", conSys, "sysfs", unix.MS_NOSUID|unix.MS_NOEXEC|unix.MS_NODEV|unix.MS_RDONLY, ""))
-	must("mount /sys/fs/cgroup", unix.Mount("cgroup2", cgroupPath, "cgroup2", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC|unix.MS_RDONLY, "nsdelegate,memory_recursiveprot"))
-	must("mount /dev as tmpfs", unix.Mount("tmpfs", conDev, "tmpfs", unix.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k"))
+	cgroupFlags := uintptr(unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_RDONLY)
+	if cgroupWritable {
+		cgroupFlags &^= unix.MS_RDONLY
+	}
+	must("mount /sys/fs/cgroup", unix.Mount("cgroup2", cgroupPath, "cgroup2", cgroupFlags, "nsdelegate,memory_recursiveprot"))
+	if devSize == 0 {
+		devSize = runConfig.DefaultDevSize
+	}
+	must("mount /dev as tmpfs", unix.Mount("tmpfs", conDev, "tmpfs", unix.MS_NOSUID|syscall.MS_STRICTATIME, fmt.Sprintf("mode=755,size=%d", devSize)))
 	for _, dir := range []string{"/dev/pts", "/dev/mqueue", "/dev/shm"} {
 		deviceDir := filepath.Join(rootfs, dir)
 		must("Failed to create device directory %s after mounting tmpfs: ", os.MkdirAll(deviceDir, 0755))
@@ -69,7 +80,10 @@ func mounter(rootfs, dns string) {
 	_ = os.Remove(ptmxPath) // Remove if exists
 	must("create ptmx symlink", os.Symlink("pts/ptmx", ptmxPath))
 	must("mount /dev/mqueue", unix.Mount("mqueue", conMqueue, "mqueue", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""))
-	must("mount /dev/shm", unix.Mount("tmpfs", conShm, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "size=64000k"))
+	if shmSize == 0 {
+		shmSize = runConfig.DefaultShmSize
+	}
+	must("mount /dev/shm", unix.Mount("tmpfs", conShm, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, fmt.Sprintf("size=%d", shmSize)))
 
 	// Create device nodes
 	must("device mount error: ", utils.CreateDeviceNodesAndMount(rootfs))
@@ -77,6 +91,145 @@ func mounter(rootfs, dns string) {
 
 }
 
+// mountTmpfs mounts the user requested tmpfs filesystems inside the rootfs
+func mountTmpfs(rootfs string, mounts []runConfig.TmpfsMount) error {
+	for _, mount := range mounts {
+		target := filepath.Join(rootfs, mount.Destination)
+		if err := ensureNoSymlinks(rootfs, mount.Destination); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("failed to create tmpfs mount point %s: %w", mount.Destination, err)
+		}
+
+		flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV)
+		if mount.NoExec {
+			flags |= unix.MS_NOEXEC
+		}
+		if mount.ReadOnly {
+			flags |= unix.MS_RDONLY
+		}
+		options := fmt.Sprintf("mode=%o", mount.Mode)
+		if mount.Size != 0 {
+			options += fmt.Sprintf(",size=%d", mount.Size)
+		}
+
+		if err := unix.Mount("tmpfs", target, "tmpfs", flags, options); err != nil {
+			return fmt.Errorf("failed to mount tmpfs on %s: %w", mount.Destination, err)
+		}
+	}
+	return nil
+}
+
+// mountVolumes binds named volumes into the rootfs. A volume that is still empty is first filled
+// with what the image has at its destination, taking that directory's owner and mode, so images
+// running as another user can write to it.
+func mountVolumes(rootfs string, volumes []runConfig.VolumeMount) error {
+	for _, volume := range volumes {
+		target := filepath.Join(rootfs, volume.Destination)
+		if err := ensureNoSymlinks(rootfs, volume.Destination); err != nil {
+			return err
+		}
+		if err := seedVolume(volume.Source, target); err != nil {
+			return fmt.Errorf("failed to fill volume %s from %s: %w", volume.Name, volume.Destination, err)
+		}
+		if err := bindMount(volume.Source, target, volume.ReadOnly); err != nil {
+			return fmt.Errorf("failed to mount volume %s on %s: %w", volume.Name, volume.Destination, err)
+		}
+	}
+	return nil
+}
+
+// mountCaches binds the shared package manager caches under cacheDir into the rootfs
+func mountCaches(rootfs, cacheDir string) error {
+	for _, ecosystem := range cache.Ecosystems {
+		if ecosystem.Requires != "" {
+			if _, err := os.Lstat(filepath.Join(rootfs, ecosystem.Requires)); err != nil {
+				continue
+			}
+		}
+		if err := ensureNoSymlinks(rootfs, ecosystem.Destination); err != nil {
+			return err
+		}
+		if err := bindMount(filepath.Join(cacheDir, ecosystem.Name), filepath.Join(rootfs, ecosystem.Destination), false); err != nil {
+			return fmt.Errorf("failed to mount the %s cache on %s: %w", ecosystem.Name, ecosystem.Destination, err)
+		}
+
+		if ecosystem.Link == "" {
+			continue
+		}
+		if err := ensureNoSymlinks(rootfs, filepath.Dir(ecosystem.Link)); err != nil {
+			return err
+		}
+		link := filepath.Join(rootfs, ecosystem.Link)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			if err := os.Symlink(ecosystem.Destination, link); err != nil {
+				return fmt.Errorf("failed to link %s to the %s cache: %w", ecosystem.Link, ecosystem.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// bindMount binds source over target, creating target first
+func bindMount(source, target string, readOnly bool) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return err
+	}
+	if !readOnly {
+		return nil
+	}
+	// A bind remount in a user namespace must keep the flags locked on the source mount
+	var stat unix.Statfs_t
+	if err := unix.Statfs(target, &stat); err != nil {
+		return err
+	}
+	locked := uintptr(stat.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+	if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|locked, ""); err != nil {
+		return fmt.Errorf("read-only remount: %w", err)
+	}
+	return nil
+}
+
+// seedVolume copies the image directory at target into an empty volume
+func seedVolume(source, target string) error {
+	entries, err := os.ReadDir(source)
+	if err != nil || len(entries) > 0 {
+		return err
+	}
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return utils.CopyTree(target, source, utils.CopyOptions{Merge: true})
+}
+
+// ensureNoSymlinks refuses mount destinations whose existing components are symlinks,
+// since those could point the mount outside the container rootfs
+func ensureNoSymlinks(rootfs, destination string) error {
+	current := rootfs
+	for _, component := range strings.Split(strings.TrimPrefix(destination, "/"), "/") {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", current, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("mount destination %s contains a symlink at %s", destination, strings.TrimPrefix(current, rootfs))
+		}
+	}
+	return nil
+}
+
 // sanitizeFileOwnership sanitizes file ownership in the rootfs
 func sanitizeFileOwnership(rootfsPath string) error {
 	// In rootless containers, we might be mapped to different UIDs
@@ -0,0 +1,34 @@
+package isolator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// projectOverlayDir is the directory next to a container's upper layer holding the changes made to
+// a project mounted with --overlay-mount
+const projectOverlayDir = "project"
+
+// ProjectOverlayPaths returns the upper and work directories of the project overlay of the
+// container with this upper layer
+func ProjectOverlayPaths(upperPath string) (string, string) {
+	dir := filepath.Join(filepath.Dir(upperPath), projectOverlayDir)
+	return filepath.Join(dir, "upper"), filepath.Join(dir, "work")
+}
+
+// mountProjectOverlay mounts the host project at target with the storage driver, so the container
+// writes to its own upper directory and the host tree stays untouched
+func mountProjectOverlay(driver storageDriver, upperPath, project, target string) error {
+	upper, work := ProjectOverlayPaths(upperPath)
+	if strings.HasPrefix(upper+"/", strings.TrimSuffix(project, "/")+"/") {
+		return fmt.Errorf("cannot overlay %s, it holds the container storage itself", project)
+	}
+	for _, dir := range []string{upper, work} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return driver.mountProject(project, upper, work, target)
+}
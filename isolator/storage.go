@@ -0,0 +1,256 @@
+package isolator
+
+import (
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/image"
+	"github.com/Simeon2001/AlpineCell/security"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// storageDriver assembles the container rootfs from the image layers and the writable layer
+type storageDriver interface {
+	// name is what --storage-driver calls the driver
+	name() string
+	// probe returns why the driver cannot work here, nil when it can
+	probe(securityConfig *security.Config) error
+	// mount makes the container rootfs appear at target. With ephemeral the changes go to a tmpfs
+	// of storageSize bytes (unlimited when 0) that is gone after the run.
+	mount(securityConfig *security.Config, target string, ephemeral bool, storageSize uint64) error
+	// mountProject overlays the host directory lower at target, with the changes going to upper
+	mountProject(lower, upper, work, target string) error
+}
+
+// newStorageDrivers returns every driver by name
+func newStorageDrivers() map[string]storageDriver {
+	return map[string]storageDriver{
+		runConfig.StorageDriverOverlay:       overlayDriver{},
+		runConfig.StorageDriverFuseOverlayfs: &fuseOverlayDriver{},
+		runConfig.StorageDriverVFS:           vfsDriver{},
+	}
+}
+
+// VFSPath returns where the vfs driver keeps the full copy of a container's rootfs, next to its upper layer
+func VFSPath(upperPath string) string {
+	return filepath.Join(filepath.Dir(upperPath), "vfs")
+}
+
+// selectStorageDriver returns the driver named by --storage-driver, or probes for the first one that
+// works. A container that already has a vfs copy keeps using it, since its changes live there.
+func selectStorageDriver(requested string, securityConfig *security.Config) (storageDriver, error) {
+	drivers := newStorageDrivers()
+
+	if _, err := os.Stat(VFSPath(securityConfig.UpperPath)); err == nil {
+		if requested != "" && requested != runConfig.StorageDriverVFS {
+			return nil, fmt.Errorf("container files live in a vfs copy, run it with --storage-driver %s", runConfig.StorageDriverVFS)
+		}
+		return drivers[runConfig.StorageDriverVFS], nil
+	}
+
+	if requested != "" {
+		driver := drivers[requested]
+		if err := driver.probe(securityConfig); err != nil {
+			return nil, fmt.Errorf("storage driver %s is not usable: %w", requested, err)
+		}
+		return driver, nil
+	}
+
+	var reasons []string
+	for _, name := range runConfig.StorageDrivers {
+		driver := drivers[name]
+		err := driver.probe(securityConfig)
+		if err == nil {
+			if len(reasons) > 0 {
+				log.Printf("[⚠️] Using the %s storage driver (%s)", name, strings.Join(reasons, "; "))
+			}
+			return driver, nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %v", name, err))
+	}
+	return nil, fmt.Errorf("no storage driver is usable: %s", strings.Join(reasons, "; "))
+}
+
+// lowerPaths returns the container's lowerdirs, topmost first
+func lowerPaths(securityConfig *security.Config) []string {
+	if len(securityConfig.LowerPaths) == 0 {
+		// Containers created before the layer store run on a single extracted rootfs
+		return []string{securityConfig.RootfsPath}
+	}
+	return securityConfig.LowerPaths
+}
+
+// overlayDriver mounts kernel overlayfs with userxattr, which needs Linux 5.11 and a filesystem
+// that supports user.* xattrs
+type overlayDriver struct{}
+
+func (overlayDriver) name() string { return runConfig.StorageDriverOverlay }
+
+// probe mounts a throwaway overlay next to the container's upper layer
+func (overlayDriver) probe(securityConfig *security.Config) error {
+	dir, err := os.MkdirTemp(filepath.Dir(securityConfig.UpperPath), ".probe-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, sub := range []string{"lower", "upper", "work", "merged"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	options := fmt.Sprintf("lowerdir=%s/lower,upperdir=%s/upper,workdir=%s/work,userxattr", dir, dir, dir)
+	merged := filepath.Join(dir, "merged")
+	if err := unix.Mount("overlay", merged, "overlay", 0, options); err != nil {
+		return err
+	}
+	return unix.Unmount(merged, unix.MNT_DETACH)
+}
+
+func (overlayDriver) mount(securityConfig *security.Config, target string, ephemeral bool, storageSize uint64) error {
+	options, mountDir, err := overlayOptions(securityConfig, ephemeral, storageSize)
+	if err != nil {
+		return err
+	}
+	return image.MountOverlay(mountDir, target, 0, options+",userxattr")
+}
+
+func (overlayDriver) mountProject(lower, upper, work, target string) error {
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", lower, upper, work)
+	return unix.Mount("overlay", target, "overlay", 0, options)
+}
+
+// fuseOverlayDriver runs fuse-overlayfs on the same layers and upper layer as the overlay driver,
+// for kernels and filesystems where an unprivileged overlay mount is refused
+type fuseOverlayDriver struct {
+	binary string
+}
+
+func (*fuseOverlayDriver) name() string { return runConfig.StorageDriverFuseOverlayfs }
+
+func (d *fuseOverlayDriver) probe(securityConfig *security.Config) error {
+	binary, err := exec.LookPath("fuse-overlayfs")
+	if err != nil {
+		return fmt.Errorf("fuse-overlayfs is not installed")
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return fmt.Errorf("/dev/fuse is not available")
+	}
+	d.binary = binary
+	return nil
+}
+
+func (d *fuseOverlayDriver) mount(securityConfig *security.Config, target string, ephemeral bool, storageSize uint64) error {
+	options, mountDir, err := overlayOptions(securityConfig, ephemeral, storageSize)
+	if err != nil {
+		return err
+	}
+
+	// fuse-overlayfs daemonizes once the mount is up and goes away with the mount namespace
+	cmd := exec.Command(d.binary, "-o", options, target)
+	cmd.Dir = mountDir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("fuse-overlayfs failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (d *fuseOverlayDriver) mountProject(lower, upper, work, target string) error {
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if output, err := exec.Command(d.binary, "-o", options, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("fuse-overlayfs failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// vfsDriver copies the image into a directory of its own and bind mounts it; it works everywhere
+// but costs a full copy per container
+type vfsDriver struct{}
+
+func (vfsDriver) name() string { return runConfig.StorageDriverVFS }
+
+func (vfsDriver) probe(securityConfig *security.Config) error { return nil }
+
+func (vfsDriver) mount(securityConfig *security.Config, target string, ephemeral bool, storageSize uint64) error {
+	if ephemeral {
+		return fmt.Errorf("--ephemeral needs an overlay storage driver, the vfs driver writes straight to its copy")
+	}
+
+	copyPath := VFSPath(securityConfig.UpperPath)
+	if _, err := os.Stat(copyPath); os.IsNotExist(err) {
+		log.Printf("Copying the image for the vfs storage driver, this happens once per container")
+
+		staging := copyPath + ".tmp"
+		if err := os.RemoveAll(staging); err != nil {
+			return err
+		}
+		if err := os.Mkdir(staging, 0755); err != nil {
+			return err
+		}
+		// Changes made under an overlay driver so far are carried over as the topmost layer
+		layers := append([]string{securityConfig.UpperPath}, lowerPaths(securityConfig)...)
+		if err := image.Flatten(layers, staging); err != nil {
+			_ = os.RemoveAll(staging)
+			return fmt.Errorf("failed to copy the image: %w", err)
+		}
+		if err := os.Rename(staging, copyPath); err != nil {
+			return err
+		}
+	}
+	return unix.Mount(copyPath, target, "", unix.MS_BIND, "")
+}
+
+func (vfsDriver) mountProject(lower, upper, work, target string) error {
+	return fmt.Errorf("--overlay-mount needs an overlay storage driver, this container uses %s", runConfig.StorageDriverVFS)
+}
+
+// overlayOptions builds the overlay mount options shared by overlayfs and fuse-overlayfs. When ephemeral
+// is set, new writes go to a tmpfs stacked on top of the persistent upper layer and are discarded on exit;
+// a user namespace cannot mount block devices, so that tmpfs is also the only way storageSize can be
+// enforced, failing writes with "no space left on device" instead of filling the host disk. It also
+// returns the directory the mount has to be made from when the lowerdirs were shortened to relative names.
+func overlayOptions(securityConfig *security.Config, ephemeral bool, storageSize uint64) (string, string, error) {
+	lowers := lowerPaths(securityConfig)
+
+	if !ephemeral {
+		dir, lowerdir, err := image.OverlayLowerdir(lowers)
+		if err != nil {
+			return "", "", err
+		}
+		return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+			lowerdir, securityConfig.UpperPath, securityConfig.WorkPath), dir, nil
+	}
+
+	scratch := filepath.Join(filepath.Dir(securityConfig.UpperPath), "scratch")
+	if err := os.MkdirAll(scratch, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create scratch dir: %w", err)
+	}
+
+	tmpfsOptions := "mode=0755"
+	if storageSize != 0 {
+		tmpfsOptions += fmt.Sprintf(",size=%d", storageSize)
+	}
+	if err := unix.Mount("tmpfs", scratch, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, tmpfsOptions); err != nil {
+		return "", "", fmt.Errorf("failed to mount ephemeral tmpfs: %w", err)
+	}
+
+	scratchUpper := filepath.Join(scratch, "upper")
+	scratchWork := filepath.Join(scratch, "work")
+	for _, dir := range []string{scratchUpper, scratchWork} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", "", fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	// The persistent upper layer becomes the topmost lower layer, keeping earlier changes visible
+	dir, lowerdir, err := image.OverlayLowerdir(append([]string{securityConfig.UpperPath}, lowers...))
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		lowerdir, scratchUpper, scratchWork), dir, nil
+}
@@ -0,0 +1,367 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyWorkers is how many files CopyTree fills in at once
+const copyWorkers = 8
+
+// CopyOptions tunes CopyTree
+type CopyOptions struct {
+	// LinkDest holds an earlier copy, such as a snapshot, whose unchanged files are hardlinked
+	// instead of copied, so nothing may write to it
+	LinkDest string
+	// Merge copies into an existing tree, replacing what differs and leaving unchanged files alone
+	Merge bool
+	// Ignore leaves out the paths it matches
+	Ignore *IgnoreMatcher
+	// IgnoreBase is where src sits, slash separated, under the root the Ignore patterns are relative to
+	IgnoreBase string
+}
+
+// copyJob is a regular file created by the walk and filled in by a worker
+type copyJob struct {
+	src  string
+	dst  *os.File
+	info os.FileInfo
+}
+
+// treeCopier carries what CopyTree learns while walking a tree
+type treeCopier struct {
+	opts  CopyOptions
+	chown bool
+	links map[[2]uint64]string
+	dirs  map[string]os.FileInfo
+	jobs  chan copyJob
+	wg    sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// CopyTree copies the tree at src to dst keeping ownership (when running as root), modes, mtimes,
+// xattrs, symlinks, device nodes and hardlinks. File data is shared with a reflink where the
+// filesystem supports it and copied in the kernel otherwise, several files at a time. Without
+// Merge, dst must not exist yet.
+func CopyTree(src, dst string, opts CopyOptions) error {
+	c := &treeCopier{
+		opts:  opts,
+		chown: os.Geteuid() == 0,
+		links: make(map[[2]uint64]string),
+		dirs:  make(map[string]os.FileInfo),
+		jobs:  make(chan copyJob, copyWorkers),
+	}
+	for i := 0; i < copyWorkers; i++ {
+		c.wg.Add(1)
+		go c.worker()
+	}
+
+	walkErr := filepath.WalkDir(src, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := c.failed(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, walkPath)
+		if err != nil {
+			return err
+		}
+		if rel != "." && opts.Ignore.Match(path.Join(opts.IgnoreBase, filepath.ToSlash(rel)), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return c.copyEntry(walkPath, filepath.Join(dst, rel), rel)
+	})
+
+	close(c.jobs)
+	c.wg.Wait()
+	if walkErr != nil {
+		return walkErr
+	}
+	if err := c.failed(); err != nil {
+		return err
+	}
+	return c.finish()
+}
+
+// worker fills in files until the walk is done, only closing them once something failed
+func (c *treeCopier) worker() {
+	defer c.wg.Done()
+	for job := range c.jobs {
+		if c.failed() != nil {
+			job.dst.Close()
+			continue
+		}
+		if err := c.copyFile(job); err != nil {
+			c.fail(err)
+		}
+	}
+}
+
+// fail records the first error, which stops the walk
+func (c *treeCopier) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// failed returns the first error a worker ran into
+func (c *treeCopier) failed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// copyEntry recreates a single entry at dst. Regular files are created here, so later hardlinks
+// can point at them, and handed to a worker.
+func (c *treeCopier) copyEntry(src, dst, rel string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	stat, _ := info.Sys().(*syscall.Stat_t)
+
+	if c.opts.Merge {
+		if existing, err := os.Lstat(dst); err == nil {
+			switch {
+			case info.IsDir() && existing.IsDir():
+				c.dirs[dst] = info
+				return c.applyMetadata(src, dst, info, stat)
+			case info.Mode().IsRegular() && unchangedFile(info, dst):
+				c.rememberLink(stat, dst)
+				return nil
+			}
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		if err := os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+		c.dirs[dst] = info
+	case mode.IsRegular():
+		if first := c.rememberLink(stat, dst); first != "" {
+			return os.Link(first, dst)
+		}
+		if c.opts.LinkDest != "" && unchangedFile(info, filepath.Join(c.opts.LinkDest, rel)) {
+			return os.Link(filepath.Join(c.opts.LinkDest, rel), dst)
+		}
+		out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		c.jobs <- copyJob{src: src, dst: out, info: info}
+		return nil
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	case mode&(os.ModeDevice|os.ModeNamedPipe) != 0 && stat != nil:
+		// Character devices include the 0:0 whiteouts of an overlay upper layer
+		if err := unix.Mknod(dst, stat.Mode, int(stat.Rdev)); err != nil {
+			if err == unix.EPERM && stat.Rdev != 0 {
+				// Real device nodes cannot be created in a user namespace
+				return nil
+			}
+			return fmt.Errorf("failed to recreate %s: %w", src, err)
+		}
+	default:
+		// Sockets belong to the process that created them
+		return nil
+	}
+
+	return c.applyMetadata(src, dst, info, stat)
+}
+
+// rememberLink records dst as the copy of a file with several links and returns an earlier copy
+// of the same inode, if any
+func (c *treeCopier) rememberLink(stat *syscall.Stat_t, dst string) string {
+	if stat == nil || stat.Nlink < 2 {
+		return ""
+	}
+	key := [2]uint64{uint64(stat.Dev), stat.Ino}
+	if first, seen := c.links[key]; seen {
+		return first
+	}
+	c.links[key] = dst
+	return ""
+}
+
+// copyFile fills in a file created by copyEntry and applies its metadata
+func (c *treeCopier) copyFile(job copyJob) error {
+	if err := cloneFileData(job.src, job.dst); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", job.src, err)
+	}
+	stat, _ := job.info.Sys().(*syscall.Stat_t)
+	return c.applyMetadata(job.src, job.dst.Name(), job.info, stat)
+}
+
+// applyMetadata copies ownership, xattrs, mode and times; directories get mode and times in finish
+func (c *treeCopier) applyMetadata(src, dst string, info os.FileInfo, stat *syscall.Stat_t) error {
+	if c.chown && stat != nil {
+		// EINVAL is an owner without a mapping in this user namespace, the copy keeps ours
+		if err := unix.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to set owner of %s: %w", dst, err)
+		}
+	}
+	if err := copyXattrs(src, dst); err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		return nil
+	case info.Mode()&os.ModeSymlink != 0:
+		return setTimes(dst, info)
+	}
+	// chown clears setuid and setgid, so the mode goes on afterwards
+	if err := unix.Chmod(dst, uint32(info.Mode().Perm())|modeBits(info.Mode())); err != nil {
+		return err
+	}
+	return setTimes(dst, info)
+}
+
+// finish applies directory modes and times, deepest directories first
+func (c *treeCopier) finish() error {
+	dirs := make([]string, 0, len(c.dirs))
+	for dir := range c.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	for _, dir := range dirs {
+		info := c.dirs[dir]
+		if err := unix.Chmod(dir, uint32(info.Mode().Perm())|modeBits(info.Mode())); err != nil {
+			return err
+		}
+		if err := setTimes(dir, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modeBits returns the setuid, setgid and sticky bits of mode in chmod form
+func modeBits(mode os.FileMode) uint32 {
+	var bits uint32
+	if mode&os.ModeSetuid != 0 {
+		bits |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= unix.S_ISVTX
+	}
+	return bits
+}
+
+// unchangedFile reports whether the regular file at other matches info in size, mtime, mode and owner
+func unchangedFile(info os.FileInfo, other string) bool {
+	otherInfo, err := os.Lstat(other)
+	if err != nil || !otherInfo.Mode().IsRegular() {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	otherStat, otherOk := otherInfo.Sys().(*syscall.Stat_t)
+	if !ok || !otherOk {
+		return false
+	}
+	return info.Size() == otherInfo.Size() &&
+		info.ModTime().Equal(otherInfo.ModTime()) &&
+		info.Mode() == otherInfo.Mode() &&
+		stat.Uid == otherStat.Uid && stat.Gid == otherStat.Gid
+}
+
+// cloneFileData fills out, which it closes, with the contents of src, as a reflink when the
+// filesystem allows it
+func cloneFileData(src string, out *os.File) error {
+	in, err := os.Open(src)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	defer in.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		// Copying between two *os.File uses copy_file_range, keeping the data in the kernel
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// setTimes copies the access and modification times of info to path without following symlinks
+func setTimes(path string, info os.FileInfo) error {
+	atime := info.ModTime()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		atime = time.Unix(stat.Atim.Unix())
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(info.ModTime().UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// copyXattrs copies every extended attribute the destination filesystem accepts
+func copyXattrs(src, dst string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err == unix.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list xattrs of %s: %w", src, err)
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(src, buf); err != nil {
+		return fmt.Errorf("failed to list xattrs of %s: %w", src, err)
+	}
+
+	for _, attr := range strings.Split(string(buf[:size]), "\x00") {
+		if attr == "" {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(src, attr, nil)
+		if err != nil {
+			return fmt.Errorf("failed to read xattr %s of %s: %w", attr, src, err)
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(src, attr, value); err != nil {
+			return fmt.Errorf("failed to read xattr %s of %s: %w", attr, src, err)
+		}
+		// trusted.* needs real root and some filesystems refuse some namespaces; neither is fatal
+		if err := unix.Lsetxattr(dst, attr, value[:valueSize], 0); err != nil && err != unix.EPERM && err != unix.ENOTSUP {
+			return fmt.Errorf("failed to set xattr %s on %s: %w", attr, dst, err)
+		}
+	}
+	return nil
+}
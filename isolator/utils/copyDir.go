@@ -2,90 +2,15 @@ package utils
 
 import (
 	"fmt"
-	"io"
 	"os"
-	"path/filepath"
 )
 
-// CopyDirectoryContents copies all contents from src directory into dst directory
-// (similar to how bind mount works - copies contents, not the directory itself)
-func CopyDirectoryContents(src, dst string) error {
-	// Ensure destination exists
+// CopyDirectoryContents copies the contents of the src directory into dst (similar to how a bind
+// mount works - the contents, not the directory itself). Paths matched by ignore are left out, and
+// files already copied by an earlier run are only replaced when they changed.
+func CopyDirectoryContents(src, dst string, ignore *IgnoreMatcher) error {
 	if err := os.MkdirAll(dst, 0755); err != nil {
 		return fmt.Errorf("failed to create destination directory: %w", err)
 	}
-
-	// Read the contents of the source directory
-	entries, err := os.ReadDir(src)
-	if err != nil {
-		return fmt.Errorf("failed to read source directory: %w", err)
-	}
-
-	// Copy each entry
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			// Recursively copy subdirectory
-			if err := copyDirectory(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			// Copy file
-			if err := copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
-
-// copyDirectory recursively copies a directory and all its contents
-func copyDirectory(src, dst string) error {
-	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		relPath, err := filepath.Rel(src, path)
-		if err != nil {
-			return err
-		}
-
-		dstPath := filepath.Join(dst, relPath)
-
-		if d.IsDir() {
-			return os.MkdirAll(dstPath, 0755)
-		} else {
-			return copyFile(path, dstPath)
-		}
-	})
-}
-
-// copyFile copies a single file from src to dst
-func copyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	if _, err = io.Copy(dstFile, srcFile); err != nil {
-		return err
-	}
-
-	// Copy file permissions
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return err
-	}
-	return os.Chmod(dst, srcInfo.Mode())
+	return CopyTree(src, dst, CopyOptions{Merge: true, Ignore: ignore})
 }
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DirSize returns the disk space used by everything under path, counting hardlinked files once
+func DirSize(path string) (uint64, error) {
+	var total uint64
+	seen := make(map[uint64]bool)
+
+	err := filepath.WalkDir(path, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if stat.Nlink > 1 {
+				if seen[stat.Ino] {
+					return nil
+				}
+				seen[stat.Ino] = true
+			}
+			// st_blocks is in 512 byte units regardless of the filesystem block size
+			total += uint64(stat.Blocks) * 512
+			return nil
+		}
+
+		total += uint64(info.Size())
+		return nil
+	})
+
+	return total, err
+}
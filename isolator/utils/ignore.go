@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is the file at the root of a project listing what --copy leaves out
+const IgnoreFileName = ".otalaignore"
+
+// ignorePattern is one line of an ignore file
+type ignorePattern struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// IgnoreMatcher matches slash separated paths relative to a project root against patterns in
+// .gitignore syntax. As with git, the last matching pattern wins and a path inside an ignored
+// directory cannot be brought back by a later negated pattern.
+type IgnoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// NewIgnoreMatcher parses patterns, one per entry, in .gitignore syntax
+func NewIgnoreMatcher(patterns []string) *IgnoreMatcher {
+	m := &IgnoreMatcher{}
+	for _, line := range patterns {
+		m.add(line)
+	}
+	return m
+}
+
+// ReadIgnorePatterns returns the lines of the .otalaignore at the root of dir, if there is one,
+// followed by extra so those take precedence
+func ReadIgnorePatterns(dir string, extra []string) ([]string, error) {
+	var patterns []string
+
+	file, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			patterns = append(patterns, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(patterns, extra...), nil
+}
+
+// add parses a single line, skipping blanks and comments
+func (m *IgnoreMatcher) add(line string) {
+	line = strings.TrimRight(line, "\r")
+	// Trailing spaces are dropped unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	var p ignorePattern
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return
+	}
+
+	// A pattern with a slash before its end is relative to the root, any other matches at every depth
+	if !strings.Contains(line, "/") {
+		p.segments = []string{"**", line}
+	} else {
+		p.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	}
+	m.patterns = append(m.patterns, p)
+}
+
+// Match reports whether rel, a slash separated path relative to the root, is ignored
+func (m *IgnoreMatcher) Match(rel string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	name := strings.Split(rel, "/")
+	ignored := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(p.segments, name) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches path components against pattern components, where "**" spans any number
+// of components
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChangeKind says what happened to a path between two scans of a tree
+type ChangeKind string
+
+const (
+	ChangeCreated  ChangeKind = "created"
+	ChangeModified ChangeKind = "modified"
+	ChangeDeleted  ChangeKind = "deleted"
+)
+
+// TreeEntry is what ScanTree records about a directory, regular file or symlink
+type TreeEntry struct {
+	Mode os.FileMode `json:"mode"`
+	Size int64       `json:"size,omitempty"`
+	// ModTime is in nanoseconds and only kept for regular files, directories change with their contents
+	ModTime int64  `json:"mtime,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+// TreeChange is a path whose entry differs between two scans
+type TreeChange struct {
+	Path string
+	Kind ChangeKind
+	// Conflict is set when the tree the change would be applied to changed the path as well
+	Conflict bool
+}
+
+// ScanTree records every directory, regular file and symlink under root by slash separated relative
+// path, leaving out what ignore matches. Other file types are not carried between trees.
+func ScanTree(root string, ignore *IgnoreMatcher) (map[string]TreeEntry, error) {
+	entries := make(map[string]TreeEntry)
+	err := filepath.WalkDir(root, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, walkPath)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if ignore.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			entries[rel] = TreeEntry{Mode: mode}
+		case mode.IsRegular():
+			entries[rel] = TreeEntry{Mode: mode, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(walkPath)
+			if err != nil {
+				return err
+			}
+			entries[rel] = TreeEntry{Mode: mode, Target: target}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// DiffTrees returns what changed from base to changed, sorted by path. A change is a conflict when
+// current, the tree it would be applied to, no longer matches base at that path, or when it deletes
+// a directory current added entries to; changes current already has are left out.
+func DiffTrees(base, changed, current map[string]TreeEntry) []TreeChange {
+	// Directories holding entries current has and base does not
+	grown := make(map[string]bool)
+	for path := range current {
+		if _, inBase := base[path]; inBase {
+			continue
+		}
+		for dir := pathpkg.Dir(path); dir != "." && !grown[dir]; dir = pathpkg.Dir(dir) {
+			grown[dir] = true
+		}
+	}
+
+	paths := make(map[string]struct{}, len(changed))
+	for path := range base {
+		paths[path] = struct{}{}
+	}
+	for path := range changed {
+		paths[path] = struct{}{}
+	}
+
+	var changes []TreeChange
+	for path := range paths {
+		baseEntry, inBase := base[path]
+		changedEntry, inChanged := changed[path]
+		if inBase == inChanged && baseEntry == changedEntry {
+			continue
+		}
+		currentEntry, inCurrent := current[path]
+		if inCurrent == inChanged && currentEntry == changedEntry {
+			continue
+		}
+
+		change := TreeChange{Path: path, Kind: ChangeModified}
+		switch {
+		case !inBase:
+			change.Kind = ChangeCreated
+		case !inChanged:
+			change.Kind = ChangeDeleted
+		}
+		change.Conflict = inCurrent != inBase || currentEntry != baseEntry ||
+			(change.Kind == ChangeDeleted && grown[path])
+		changes = append(changes, change)
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// ApplyError is a change ApplyChanges could not make
+type ApplyError struct {
+	Path string
+	Err  error
+}
+
+func (e *ApplyError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyChanges makes dst match src at every path in changes that is not a conflict, deleting
+// deepest paths first and then creating or replacing from the top down. Files are written next to
+// their final name and renamed into place, and get the mode and mtime they have in src.
+// A change that fails does not stop the others; the failures are returned by path.
+func ApplyChanges(src, dst string, changes []TreeChange) []*ApplyError {
+	var failed []*ApplyError
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if change.Conflict || change.Kind != ChangeDeleted {
+			continue
+		}
+		if err := removeEntry(filepath.Join(dst, filepath.FromSlash(change.Path))); err != nil {
+			failed = append(failed, &ApplyError{Path: change.Path, Err: err})
+		}
+	}
+
+	for _, change := range changes {
+		if change.Conflict || change.Kind == ChangeDeleted {
+			continue
+		}
+		if err := copyEntryOver(filepath.Join(src, filepath.FromSlash(change.Path)), filepath.Join(dst, filepath.FromSlash(change.Path))); err != nil {
+			failed = append(failed, &ApplyError{Path: change.Path, Err: err})
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+	return failed
+}
+
+// removeEntry deletes a file, symlink or a directory that was already emptied
+func removeEntry(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if errors.Is(err, unix.ENOTEMPTY) {
+		return fmt.Errorf("cannot delete %s, it still holds files that were not copied", path)
+	}
+	return err
+}
+
+// copyEntryOver replaces dst with the directory, file or symlink at src
+func copyEntryOver(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	existing, err := os.Lstat(dst)
+	exists := err == nil
+
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		if exists && !existing.IsDir() {
+			if err := os.Remove(dst); err != nil {
+				return err
+			}
+			exists = false
+		}
+		if !exists {
+			if err := os.Mkdir(dst, 0700); err != nil {
+				return err
+			}
+		}
+		return unix.Chmod(dst, uint32(mode.Perm())|modeBits(mode))
+	case mode.IsRegular(), mode&os.ModeSymlink != 0:
+		if exists && existing.IsDir() {
+			if err := removeEntry(dst); err != nil {
+				return err
+			}
+		}
+		staging := filepath.Join(filepath.Dir(dst), ".otala-sync-"+filepath.Base(dst))
+		if err := os.RemoveAll(staging); err != nil {
+			return err
+		}
+		if err := writeStaged(src, staging, info); err != nil {
+			os.RemoveAll(staging)
+			return fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+		return os.Rename(staging, dst)
+	}
+	return nil
+}
+
+// writeStaged creates path as a copy of the file or symlink src with its mode and times
+func writeStaged(src, path string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, path); err != nil {
+			return err
+		}
+		return setTimes(path, info)
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := cloneFileData(src, out); err != nil {
+		return err
+	}
+	if err := unix.Chmod(path, uint32(info.Mode().Perm())|modeBits(info.Mode())); err != nil {
+		return err
+	}
+	return setTimes(path, info)
+}
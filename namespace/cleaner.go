@@ -1,6 +1,7 @@
 package namespace
 
 import (
+	"encoding/json"
 	runConfig "github.com/Simeon2001/AlpineCell/config"
 	"log"
 	"os"
@@ -14,8 +15,8 @@ import (
 // clean is responsible for cleaning up resources and processes related to container execution.
 // It removes container-related directories, reaps zombie processes, stops associated systemd units, and kills the main process.
 // config specifies container runtime configuration, including paths to remove and cleanup behavior.
-// pid represents the process ID of the container runtime process to terminate.
-func clean(config *runConfig.RunConfig, pid int) {
+// pid represents the process ID of the container runtime process to terminate, exitCode how its command exited (-1 when it was killed).
+func clean(config *runConfig.RunConfig, pid int, exitCode int) {
 
 	// Remove bind mount directory
 	// Paths to delete
@@ -49,12 +50,69 @@ func clean(config *runConfig.RunConfig, pid int) {
 		log.Printf("[✅] Reaped zombie process with pid %d", pid)
 	}
 
-	containerName := "otalacon-" + config.ContainerConfig.ContainerID
+	containerName := runConfig.ContainerPrefix + config.ContainerConfig.ContainerID
+
+	// Capture usage before the scope (and its cgroup) is stopped
+	recordStats(config, containerName, exitCode)
+
 	systemd.CleanSystemd(containerName)
 	killer(pid)
 
 }
 
+// statsReport is the JSON document written to --stats-file
+type statsReport struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`
+	ExitedAt time.Time      `json:"exitedAt"`
+	ExitCode int            `json:"exitCode"`
+	Stats    *systemd.Stats `json:"stats,omitempty"`
+}
+
+// recordStats prints a resource usage summary for the container and writes it, with the exit code,
+// to the stats file if requested
+func recordStats(config *runConfig.RunConfig, containerName string, exitCode int) {
+	stats, err := systemd.ReadStats(config.ContainerConfig.CgroupPath)
+	if err != nil {
+		log.Printf("[❌] Failed to read resource usage: %v", err)
+	} else {
+		log.Println("[📊] Resource usage summary:")
+		log.Printf("    Memory peak: %s", runConfig.FormatSize(stats.MemoryPeak))
+		log.Printf("    CPU time:    %s (user %s, system %s)",
+			usecDuration(stats.CPUUsageUsec), usecDuration(stats.CPUUserUsec), usecDuration(stats.CPUSystemUsec))
+		log.Printf("    Pids peak:   %d", stats.PidsPeak)
+		log.Printf("    IO:          read %s in %d ops, wrote %s in %d ops",
+			runConfig.FormatSize(stats.IOReadBytes), stats.IOReadOps, runConfig.FormatSize(stats.IOWriteBytes), stats.IOWriteOps)
+	}
+
+	if config.StatsFile == "" {
+		return
+	}
+
+	report := statsReport{
+		ID:       config.ContainerConfig.ContainerID,
+		Name:     containerName,
+		ExitedAt: time.Now(),
+		ExitCode: exitCode,
+		Stats:    stats,
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("[❌] Failed to marshal resource usage: %v", err)
+		return
+	}
+	if err := os.WriteFile(config.StatsFile, data, 0644); err != nil {
+		log.Printf("[❌] Failed to write stats file %s: %v", config.StatsFile, err)
+		return
+	}
+	log.Printf("[✅] Resource usage written to %s", config.StatsFile)
+}
+
+// usecDuration turns a cgroup microsecond counter into a printable duration
+func usecDuration(usec uint64) time.Duration {
+	return time.Duration(usec) * time.Microsecond
+}
+
 // killer terminates a process by its process ID (pid) using the SIGKILL signal.
 func killer(pid int) {
 	// Find process
@@ -1,52 +1,26 @@
 package namespace
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"embed"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"github.com/Simeon2001/AlpineCell/image"
 	"os"
 	"path/filepath"
-	"syscall"
+	"slices"
 )
 
-// getRuntimePaths returns the paths for the runtime data and config directories.
-func getRuntimePaths() (string, string, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return "", "", err
-	}
-
-	// Data directory (for rootfs, storage)
-	dataDir := os.Getenv("XDG_DATA_HOME")
-	if dataDir == "" {
-		dataDir = filepath.Join(homeDir, ".local", "share")
-	}
-	runtimeDataDir := filepath.Join(dataDir, "otala-runc")
-
-	// Config directory (for config.json)
-	configDir := os.Getenv("XDG_CONFIG_HOME")
-	if configDir == "" {
-		configDir = filepath.Join(homeDir, ".config")
-	}
-	runtimeConfigDir := filepath.Join(configDir, "otala-runc")
-
-	return runtimeDataDir, runtimeConfigDir, nil
-}
-
-// initializeruntimeDirs to crate container folders; rootfs, storage, metadata, containers
+// initializeruntimeDirs to crate container folders; layers, storage, metadata, containers
 func initializeRuntimeDirs() (string, string, error) {
-	dataDir, configDir, err := getRuntimePaths()
+	dataDir, configDir, err := runConfig.RuntimePaths()
 	if err != nil {
 		return "", "", err
 	}
 
 	// Check if all required directories exist
 	requiredDirs := []string{
-		filepath.Join(dataDir, "rootfs"),
+		filepath.Join(dataDir, "layers"),
 		filepath.Join(dataDir, "storage"),
 		filepath.Join(dataDir, "metadata"),
 		filepath.Join(configDir, "containers"),
@@ -68,7 +42,7 @@ func initializeRuntimeDirs() (string, string, error) {
 	}
 
 	// Create directories that don't exist
-	if err := os.MkdirAll(filepath.Join(dataDir, "rootfs"), 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(dataDir, "layers"), 0755); err != nil {
 		return "", "", err
 	}
 	if err := os.MkdirAll(filepath.Join(dataDir, "storage"), 0755); err != nil {
@@ -85,14 +59,22 @@ func initializeRuntimeDirs() (string, string, error) {
 }
 
 // SetupContainerEnvironment sets up the container environment by creating necessary directories and files.
-func SetupContainerEnvironment(containerID string, configData *[]byte, conExist bool, rootfs *embed.FS) (string, string, *[]byte, error) {
+// lowerDirs are the layers of a stored image, topmost first; when empty the embedded Alpine rootfs is used.
+func SetupContainerEnvironment(containerID string, configData *[]byte, conExist bool, rootfs *embed.FS, lowerDirs []string) (string, string, *[]byte, error) {
 	// Initialize runtime directories
 	dataDir, configDir, err := initializeRuntimeDirs()
 	if err != nil {
 		return "", "", nil, fmt.Errorf("failed to initialize runtime directories: %v", err)
 	}
 
-	rootfsPath := filepath.Join(dataDir, "rootfs", "alpine")
+	embedded := len(lowerDirs) == 0
+	if embedded {
+		embeddedLayer, err := embeddedRootfs(rootfs)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("failed to create rootfs layer: %v", err)
+		}
+		lowerDirs = []string{embeddedLayer}
+	}
 	containerPath := filepath.Join(dataDir, "storage", containerID)
 	upperPath := filepath.Join(containerPath, "upper")
 	workPath := filepath.Join(containerPath, "work")
@@ -107,6 +89,33 @@ func SetupContainerEnvironment(containerID string, configData *[]byte, conExist
 		if err != nil {
 			return "", "", nil, fmt.Errorf("failed to parse config.json using the path given: %v", err)
 		}
+
+		// The writable layer only makes sense on top of the rootfs it was created on
+		var existing struct {
+			Rootfs string   `json:"rootfs"`
+			Lowers []string `json:"lowerdirs"`
+		}
+		if err := json.Unmarshal(dataFromConfigPath, &existing); err != nil {
+			return "", "", nil, fmt.Errorf("failed to parse config.json: %v", err)
+		}
+		if len(existing.Lowers) == 0 && embedded && existing.Rootfs == filepath.Join(dataDir, "rootfs", "alpine") {
+			// Containers created before the layer store run on the embedded rootfs extracted there.
+			// It stays in use while it exists; once removed the container moves to the embedded layer.
+			if _, err := os.Stat(existing.Rootfs); err == nil {
+				return containerPath, configConPath, &dataFromConfigPath, nil
+			}
+			migrated, err := migrateLowerDirs(configPath, dataFromConfigPath, lowerDirs)
+			if err != nil {
+				return "", "", nil, err
+			}
+			return containerPath, configConPath, migrated, nil
+		}
+		if len(existing.Lowers) == 0 {
+			existing.Lowers = []string{existing.Rootfs}
+		}
+		if !slices.Equal(existing.Lowers, lowerDirs) {
+			return "", "", nil, fmt.Errorf("container %s was created from a different image", containerID)
+		}
 		return containerPath, configConPath, &dataFromConfigPath, nil
 	}
 
@@ -116,12 +125,9 @@ func SetupContainerEnvironment(containerID string, configData *[]byte, conExist
 		return "", "", nil, fmt.Errorf("failed to parse config.json: %v", err)
 	}
 
-	// Create container-specific directories
-	if err := extractRootfs(rootfsPath, rootfs); err != nil {
-		return "", "", nil, fmt.Errorf("failed to create rootfs directory: %v", err)
-	}
-
-	config["rootfs"] = rootfsPath
+	// The topmost layer stands in as the rootfs for tools that expect a single directory
+	config["rootfs"] = lowerDirs[0]
+	config["lowerdirs"] = lowerDirs
 	config["merged"] = mergedPath
 	config["upper"] = upperPath
 	config["work"] = workPath
@@ -144,88 +150,35 @@ func SetupContainerEnvironment(containerID string, configData *[]byte, conExist
 	return containerPath, configConPath, &updatedConfigData, nil
 }
 
-// extractRootfs extracts the Alpine Linux rootfs from the embedded filesystem into the target directory.
-func extractRootfs(target string, alpineFS *embed.FS) error {
-	f, err := alpineFS.Open("alpine-minirootfs.tar.gz")
-	if err != nil {
-		return err
+// migrateLowerDirs points the config.json of a container at new lowerdirs and returns the updated config
+func migrateLowerDirs(configPath string, configData []byte, lowerDirs []string) (*[]byte, error) {
+	var config map[string]interface{}
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config.json: %v", err)
 	}
-	defer f.Close()
+	config["rootfs"] = lowerDirs[0]
+	config["lowerdirs"] = lowerDirs
 
-	gzr, err := gzip.NewReader(f)
+	updatedConfigData, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to marshal updated config: %v", err)
 	}
-	defer gzr.Close()
-
-	tr := tar.NewReader(gzr)
+	if err := os.WriteFile(configPath, updatedConfigData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write config.json: %v", err)
+	}
+	return &updatedConfigData, nil
+}
 
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
+// embeddedRootfs stores the Alpine rootfs built into the binary as a layer and returns its lowerdir
+func embeddedRootfs(alpineFS *embed.FS) (string, error) {
+	data, err := alpineFS.ReadFile("alpine-minirootfs.tar.gz")
+	if err != nil {
+		return "", err
+	}
 
-		path := filepath.Join(target, hdr.Name)
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			// Create directory with more permissive mode initially
-			err := os.MkdirAll(path, 0755)
-			if err != nil {
-				return err
-			}
-			// Set proper mode after creation
-			err = os.Chmod(path, os.FileMode(hdr.Mode))
-			if err != nil {
-				log.Printf("Warning: failed to set mode on %s: %v", path, err)
-			}
-		case tar.TypeReg:
-			err := os.MkdirAll(filepath.Dir(path), 0755)
-			if err != nil {
-				return err
-			}
-			outFile, err := os.Create(path)
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(outFile, tr); err != nil {
-				outFile.Close()
-				return err
-			}
-			outFile.Chmod(os.FileMode(hdr.Mode))
-			outFile.Close()
-		case tar.TypeSymlink:
-			// Ensure parent directory exists
-			err := os.MkdirAll(filepath.Dir(path), 0755)
-			if err != nil {
-				return err
-			}
-			// Remove existing symlink if it exists
-			if _, err := os.Lstat(path); err == nil {
-				if err := os.Remove(path); err != nil {
-					return fmt.Errorf("failed to remove existing symlink %s: %v", path, err)
-				}
-			}
-			err = os.Symlink(hdr.Linkname, path)
-			if err != nil {
-				return err
-			}
-		case tar.TypeFifo:
-			// Create named pipe (FIFO)
-			err := os.MkdirAll(filepath.Dir(path), 0755)
-			if err != nil {
-				return err
-			}
-			err = syscall.Mkfifo(path, uint32(hdr.Mode))
-			if err != nil && !os.IsExist(err) {
-				return err
-			}
-		default:
-			log.Printf("Skipping unsupported type: %s (%d)\n", hdr.Name, hdr.Typeflag)
-		}
+	store, err := image.NewStore()
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return store.EmbeddedLayer(data)
 }
@@ -2,6 +2,7 @@ package namespace
 
 import (
 	"encoding/json"
+	"github.com/Simeon2001/AlpineCell/cache"
 	runConfig "github.com/Simeon2001/AlpineCell/config"
 	"github.com/Simeon2001/AlpineCell/security"
 	"log"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/Simeon2001/AlpineCell/message"
 	network "github.com/Simeon2001/AlpineCell/nework"
+	"github.com/Simeon2001/AlpineCell/systemd"
 	"golang.org/x/sys/unix"
 )
 
@@ -26,6 +28,15 @@ func Stage1UserNS(initConfig *runConfig.RunConfig, configData *[]byte) {
 		must("unmarshal seccomp config err: ", err)
 	}
 
+	// Apply --ulimit overrides on top of the rlimits declared in config.json
+	var ulimits []security.Rlimit
+	for _, spec := range initConfig.Ulimits {
+		rlimit, err := security.ParseUlimit(spec)
+		must("parse ulimit err: ", err)
+		ulimits = append(ulimits, rlimit)
+	}
+	secconfig.Rlimit = security.MergeRlimits(secconfig.Rlimit, ulimits)
+
 	// Pipe #1: parent → child
 	parentRead, parentWrite, err := os.Pipe()
 	must("pipe parent→child", err)
@@ -60,6 +71,27 @@ func Stage1UserNS(initConfig *runConfig.RunConfig, configData *[]byte) {
 		Cloneflags: unix.CLONE_NEWUSER | unix.CLONE_NEWNS | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC | unix.CLONE_NEWPID | unix.CLONE_NEWCGROUP | unix.CLONE_NEWNET,
 	}
 
+	// With delegation the child is cloned straight into its own leaf cgroup, which then
+	// becomes the root of its cgroup namespace
+	if initConfig.CgroupDelegate {
+		containerCgroup, err := systemd.PrepareDelegation(initConfig.ContainerConfig.CgroupPath)
+		must("preparing delegated cgroup failed", err)
+
+		cgroupDir, err := os.Open(containerCgroup)
+		must("opening delegated cgroup failed", err)
+		defer cgroupDir.Close()
+
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroupDir.Fd())
+	}
+
+	// Keep prune away from the shared caches while the container can write to them
+	if initConfig.CacheDir != "" {
+		release, err := cache.Use(initConfig.CacheDir)
+		must("locking caches failed", err)
+		defer release()
+	}
+
 	must("executing child process failed", cmd.Start())
 
 	// close this pipe
@@ -128,7 +160,7 @@ func Stage1UserNS(initConfig *runConfig.RunConfig, configData *[]byte) {
 	go func(pid int, sigChan chan os.Signal, initConfig *runConfig.RunConfig) {
 		sig := <-sigChan
 		log.Printf("[⚠️] Received signal %v. Shutting down container...", sig)
-		clean(initConfig, pid)
+		clean(initConfig, pid, -1)
 		log.Println("[✅] Cleanup complete")
 		// Wait a moment for cleanup to complete
 		time.Sleep(500 * time.Millisecond)
@@ -137,13 +169,25 @@ func Stage1UserNS(initConfig *runConfig.RunConfig, configData *[]byte) {
 
 	// Wait for the child process to complete
 	err = cmd.Wait()
+	exitCode := 0
 	if err != nil {
+		exitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		}
 		log.Printf("[❌] Child process exited with error: %v", err)
 	} else {
 		log.Println("[✅] Container exited successfully")
 	}
 
-	clean(initConfig, processID)
+	// Copy back before clean, which may delete the container's files
+	if initConfig.CopyBack {
+		if err := RunInUserNS([]string{"sync", "--exited", initConfig.ContainerConfig.ContainerID}); err != nil {
+			log.Printf("[❌] Copying changes back failed: %v", err)
+		}
+	}
+
+	clean(initConfig, processID, exitCode)
 	log.Println("[✅] All resources cleaned up")
 
 }
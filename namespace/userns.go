@@ -0,0 +1,103 @@
+package namespace
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Simeon2001/AlpineCell/security"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// UserNSCommand is the hidden argument that marks a process re-executed inside the container user namespace
+const UserNSCommand = "userns"
+
+// InUserNS reports whether the process runs in a user namespace other than the initial one
+func InUserNS() bool {
+	file, err := os.Open("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return true
+	}
+	// The initial namespace maps every id onto itself
+	fields := strings.Fields(scanner.Text())
+	identity := len(fields) == 3 && fields[0] == "0" && fields[1] == "0" && fields[2] == "4294967295"
+	return !identity || scanner.Scan()
+}
+
+// RunInUserNS re-executes the binary with args inside a new user namespace that has the same
+// uid/gid mapping as containers, so files it creates get the ownership containers expect
+func RunInUserNS(args []string) error {
+	goRead, goWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer goWrite.Close()
+
+	cmd := exec.Command("/proc/self/exe", append([]string{UserNSCommand}, args...)...)
+	cmd.ExtraFiles = []*os.File{goRead}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: unix.CLONE_NEWUSER | unix.CLONE_NEWNS,
+	}
+
+	if err := cmd.Start(); err != nil {
+		goRead.Close()
+		return fmt.Errorf("failed to start user namespace: %v", err)
+	}
+	goRead.Close()
+
+	if err := SetupUserNamespaceMapping(cmd.Process.Pid); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	// Tell the child its ids are mapped
+	if _, err := goWrite.Write([]byte{1}); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("failed to signal user namespace: %v", err)
+	}
+	goWrite.Close()
+
+	if err := cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("command failed inside the user namespace")
+		}
+		return err
+	}
+	return nil
+}
+
+// EnterUserNS runs in the re-executed child: it waits until the parent has written the id
+// mappings and then re-executes once more to gain root capabilities in the namespace
+func EnterUserNS() error {
+	if ok, err := security.ProcessHasEffectiveCaps(); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	goRead := os.NewFile(3, "user namespace go-ahead")
+	if goRead == nil {
+		return fmt.Errorf("user namespace go-ahead pipe not available")
+	}
+	buf := make([]byte, 1)
+	if _, err := goRead.Read(buf); err != nil {
+		return fmt.Errorf("parent did not map the user namespace: %v", err)
+	}
+	goRead.Close()
+
+	return security.GainCapabilitiesWithDefaults()
+}
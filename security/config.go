@@ -51,6 +51,7 @@ type Config struct {
 	Rlimit       []Rlimit     `json:"rlimits"`
 	Seccomp      Seccomp      `json:"seccomp"`
 	RootfsPath   string       `json:"rootfs"`
+	LowerPaths   []string     `json:"lowerdirs,omitempty"`
 	MergedPath   string       `json:"merged"`
 	UpperPath    string       `json:"upper"`
 	WorkPath     string       `json:"work"`
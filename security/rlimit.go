@@ -0,0 +1,161 @@
+package security
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// rlimitMap maps rlimit names as they appear in config.json to their resource numbers
+var rlimitMap = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+// normalizeRlimitName turns "nofile", "NOFILE" or "rlimit_nofile" into "RLIMIT_NOFILE"
+func normalizeRlimitName(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "RLIMIT_") {
+		name = "RLIMIT_" + name
+	}
+	return name
+}
+
+// parseRlimitValue parses a single limit value, accepting "unlimited" and -1 for RLIM_INFINITY
+func parseRlimitValue(value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if value == "unlimited" || value == "-1" {
+		return unix.RLIM_INFINITY, nil
+	}
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit value %q", value)
+	}
+	return parsed, nil
+}
+
+// ParseUlimit parses a --ulimit flag of the form name=soft:hard (or name=value for both)
+func ParseUlimit(spec string) (Rlimit, error) {
+	name, values, found := strings.Cut(spec, "=")
+	if !found || name == "" || values == "" {
+		return Rlimit{}, fmt.Errorf("invalid ulimit %q: expected name=soft:hard", spec)
+	}
+
+	limitType := normalizeRlimitName(name)
+	if _, ok := rlimitMap[limitType]; !ok {
+		return Rlimit{}, fmt.Errorf("invalid ulimit %q: unknown limit %q", spec, name)
+	}
+
+	softStr, hardStr, hasHard := strings.Cut(values, ":")
+	if !hasHard {
+		hardStr = softStr
+	}
+
+	soft, err := parseRlimitValue(softStr)
+	if err != nil {
+		return Rlimit{}, fmt.Errorf("invalid ulimit %q: %v", spec, err)
+	}
+	hard, err := parseRlimitValue(hardStr)
+	if err != nil {
+		return Rlimit{}, fmt.Errorf("invalid ulimit %q: %v", spec, err)
+	}
+	if soft > hard {
+		return Rlimit{}, fmt.Errorf("invalid ulimit %q: soft limit %d exceeds hard limit %d", spec, soft, hard)
+	}
+
+	return Rlimit{Type: limitType, Soft: soft, Hard: hard}, nil
+}
+
+// ValidateRlimit checks a limit against the caller's current hard limit. Inside a user namespace
+// the hard limit can never be raised, so asking for more would fail once the container starts.
+func ValidateRlimit(rl Rlimit) error {
+	resource, ok := rlimitMap[normalizeRlimitName(rl.Type)]
+	if !ok {
+		return fmt.Errorf("unknown rlimit type %q", rl.Type)
+	}
+
+	var current unix.Rlimit
+	if err := unix.Getrlimit(resource, &current); err != nil {
+		return fmt.Errorf("failed to read current %s: %v", rl.Type, err)
+	}
+	if rl.Hard > current.Max {
+		return fmt.Errorf("%s hard limit %s exceeds the caller's hard limit %s; rootless containers cannot raise it",
+			rl.Type, formatRlimitValue(rl.Hard), formatRlimitValue(current.Max))
+	}
+	return nil
+}
+
+// MergeRlimits returns base with every entry of overrides replacing the limit of the same type
+func MergeRlimits(base, overrides []Rlimit) []Rlimit {
+	merged := make([]Rlimit, 0, len(base)+len(overrides))
+	index := make(map[string]int)
+
+	for _, rl := range append(append([]Rlimit{}, base...), overrides...) {
+		rl.Type = normalizeRlimitName(rl.Type)
+		if i, ok := index[rl.Type]; ok {
+			merged[i] = rl
+			continue
+		}
+		index[rl.Type] = len(merged)
+		merged = append(merged, rl)
+	}
+	return merged
+}
+
+// ApplyRlimits sets every configured rlimit on the current process so the exec'd workload inherits them.
+// Limits above the current hard limit are clamped to it, since a user namespace cannot raise them.
+func ApplyRlimits(rlimits []Rlimit) error {
+	for _, rl := range rlimits {
+		limitType := normalizeRlimitName(rl.Type)
+		resource, ok := rlimitMap[limitType]
+		if !ok {
+			return fmt.Errorf("unknown rlimit type %q", rl.Type)
+		}
+
+		var current unix.Rlimit
+		if err := unix.Getrlimit(resource, &current); err != nil {
+			return fmt.Errorf("failed to read current %s: %v", limitType, err)
+		}
+
+		limit := unix.Rlimit{Cur: rl.Soft, Max: rl.Hard}
+		if limit.Max > current.Max {
+			log.Printf("Warning: %s hard limit %s exceeds the allowed %s, clamping",
+				limitType, formatRlimitValue(limit.Max), formatRlimitValue(current.Max))
+			limit.Max = current.Max
+		}
+		if limit.Cur > limit.Max {
+			limit.Cur = limit.Max
+		}
+
+		if err := unix.Setrlimit(resource, &limit); err != nil {
+			return fmt.Errorf("failed to set %s to %s:%s: %v",
+				limitType, formatRlimitValue(limit.Cur), formatRlimitValue(limit.Max), err)
+		}
+	}
+	return nil
+}
+
+// formatRlimitValue prints RLIM_INFINITY as "unlimited"
+func formatRlimitValue(value uint64) string {
+	if value == unix.RLIM_INFINITY {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value, 10)
+}
@@ -3,56 +3,89 @@ package systemd
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
 )
 
-// findCgroupPath tries to locate the cgroup path for our scope unit
-func findCgroupPath(containerName string) (string, error) {
-	// First try the unified hierarchy (cgroup v2)
-	// In systemd environments, user scopes may be under /sys/fs/cgroup/user.slice/
-	possiblePaths := []string{
-		// cgroup v2 paths
-		fmt.Sprintf("/sys/fs/cgroup/user.slice/user-%d.slice/user@%d.service/%s.scope", os.Getuid(), os.Getuid(), containerName),
-		fmt.Sprintf("/sys/fs/cgroup/%s.scope", containerName),
-		// If using session scope
-		fmt.Sprintf("/sys/fs/cgroup/user.slice/user-%d.slice/session-*.scope/%s.scope", os.Getuid(), containerName),
+// cgroupRoot is where the unified cgroup hierarchy is mounted on the host
+const cgroupRoot = "/sys/fs/cgroup"
+
+// jobTimeout bounds how long we wait for systemd to finish a start job
+const jobTimeout = 10 * time.Second
+
+// subscribeJobRemoved asks systemd to emit JobRemoved signals and routes them into a channel.
+// It must be called before the job is queued so the completion signal cannot be missed.
+func subscribeJobRemoved(conn *dbus.Conn, systemd dbus.BusObject) (chan *dbus.Signal, error) {
+	if err := systemd.Call(UserInterface+".Subscribe", 0).Err; err != nil {
+		return nil, fmt.Errorf("failed to subscribe to systemd signals: %v", err)
+	}
+
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(dbus.ObjectPath(UserPath)),
+		dbus.WithMatchInterface(UserInterface),
+		dbus.WithMatchMember("JobRemoved"),
+	); err != nil {
+		return nil, fmt.Errorf("failed to match JobRemoved signal: %v", err)
 	}
 
-	for _, path := range possiblePaths {
-		// Handle wildcards in path
-		if strings.Contains(path, "*") {
-			matches, err := filepath.Glob(path)
-			if err == nil && len(matches) > 0 {
-				// Use the first match
-				return matches[0], nil
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	return signals, nil
+}
+
+// waitForJob blocks until systemd reports the given job as removed and fails unless its result is "done"
+func waitForJob(signals chan *dbus.Signal, jobPath dbus.ObjectPath, unitName string) error {
+	timeout := time.After(jobTimeout)
+
+	for {
+		select {
+		case signal, ok := <-signals:
+			if !ok {
+				return fmt.Errorf("dbus connection closed while waiting for %s", unitName)
 			}
-		} else if _, err := os.Stat(path); err == nil {
-			return path, nil
+			// JobRemoved(u id, o job, s unit, s result)
+			if signal.Name != UserInterface+".JobRemoved" || len(signal.Body) < 4 {
+				continue
+			}
+			if path, _ := signal.Body[1].(dbus.ObjectPath); path != jobPath {
+				continue
+			}
+			if result, _ := signal.Body[3].(string); result != "done" {
+				return fmt.Errorf("systemd job for %s finished with result %q", unitName, result)
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("timed out after %v waiting for systemd to start %s", jobTimeout, unitName)
 		}
 	}
-
-	// If we couldn't find it in the common places, try searching
-	return findCgroupPathBySearching(containerName)
 }
 
-// findCgroupPathBySearching is a fallback that searches for the cgroup
-func findCgroupPathBySearching(containerName string) (string, error) {
-	cmd := exec.Command("find", "/sys/fs/cgroup", "-name", containerName+".scope", "-type", "d")
-	output, err := cmd.Output()
+// unitCgroupPath reads the ControlGroup property of a scope or slice unit and returns its path on the host
+func unitCgroupPath(conn *dbus.Conn, systemd dbus.BusObject, unitName string) (string, error) {
+	var unitPath dbus.ObjectPath
+	if err := systemd.Call(UserInterface+".GetUnit", 0, unitName).Store(&unitPath); err != nil {
+		return "", fmt.Errorf("failed to get unit %s: %v", unitName, err)
+	}
+
+	unitInterface := "org.freedesktop.systemd1.Scope"
+	if strings.HasSuffix(unitName, ".slice") {
+		unitInterface = "org.freedesktop.systemd1.Slice"
+	}
+
+	controlGroup, err := conn.Object(UserService, unitPath).GetProperty(unitInterface + ".ControlGroup")
 	if err != nil {
-		return "", fmt.Errorf("failed to search for cgroup: %v", err)
+		return "", fmt.Errorf("failed to read ControlGroup of %s: %v", unitName, err)
 	}
 
-	if len(output) == 0 {
-		return "", fmt.Errorf("cgroup not found")
+	group, ok := controlGroup.Value().(string)
+	if !ok || group == "" {
+		return "", fmt.Errorf("unit %s has no control group", unitName)
 	}
 
-	// Use the first result
-	path := strings.TrimSpace(string(output))
-	parts := strings.Split(path, "\n")
-	return parts[0], nil
+	return filepath.Join(cgroupRoot, group), nil
 }
 
 // readMemoryMax reads the memory.max file in the given cgroup path
@@ -0,0 +1,55 @@
+package systemd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// supervisorLeaf holds the runtime process, since a delegated cgroup with
+	// controllers enabled for its children may not contain processes itself
+	supervisorLeaf = "supervisor"
+	// containerLeaf is the cgroup the container init is created in; it becomes
+	// the root of the container's cgroup namespace
+	containerLeaf = "container"
+)
+
+// PrepareDelegation splits a delegated scope into a supervisor leaf for this process and a container
+// leaf for the workload, enables every available controller for them, and returns the container leaf.
+func PrepareDelegation(cgroupPath string) (string, error) {
+	if cgroupPath == "" {
+		return "", fmt.Errorf("cgroup path is empty")
+	}
+
+	supervisor := filepath.Join(cgroupPath, supervisorLeaf)
+	container := filepath.Join(cgroupPath, containerLeaf)
+	for _, dir := range []string{supervisor, container} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create cgroup %s: %v", dir, err)
+		}
+	}
+
+	// Leave the scope root empty so controllers can be enabled for the leaves
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	if err := os.WriteFile(filepath.Join(supervisor, "cgroup.procs"), pid, 0644); err != nil {
+		return "", fmt.Errorf("failed to move runtime into %s: %v", supervisor, err)
+	}
+
+	controllers, err := os.ReadFile(filepath.Join(cgroupPath, "cgroup.controllers"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read available controllers: %v", err)
+	}
+	for _, controller := range strings.Fields(string(controllers)) {
+		subtreeControl := filepath.Join(cgroupPath, "cgroup.subtree_control")
+		if err := os.WriteFile(subtreeControl, []byte("+"+controller), 0644); err != nil {
+			return "", fmt.Errorf("failed to enable %s controller: %v", controller, err)
+		}
+	}
+
+	// No chown is needed: we created the leaf, so its cgroup.procs, cgroup.threads and
+	// cgroup.subtree_control belong to our uid, which is what the container's root maps to
+	return container, nil
+}
@@ -2,10 +2,9 @@ package systemd
 
 import (
 	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
 	"log"
 	"os"
-	"strconv"
-	"time"
 
 	"github.com/godbus/dbus/v5"
 )
@@ -17,12 +16,55 @@ const (
 	UserInterface = "org.freedesktop.systemd1.Manager"
 )
 
-func Manager(containerName string, memoryBytes string) (error, bool, string) {
+// unitProperty is a single systemd unit property, marshalled as the D-Bus (sv) struct
+type unitProperty struct {
+	Name  string
+	Value dbus.Variant
+}
 
-	memBytes, err := strconv.ParseUint(memoryBytes, 10, 64)
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Memory limit must be a number: %v\n", err)
-		os.Exit(1)
+// resourceProperties turns resource limits into systemd unit properties, leaving out those not set
+func resourceProperties(resources runConfig.Resources) []unitProperty {
+	var properties []unitProperty
+
+	if resources.Memory != 0 {
+		properties = append(properties,
+			unitProperty{
+				Name:  "MemoryMax",
+				Value: dbus.MakeVariant(resources.Memory), // uint64
+			},
+			unitProperty{
+				// MemorySwapMax counts swap only, not memory + swap
+				Name:  "MemorySwapMax",
+				Value: dbus.MakeVariant(resources.SwapMax()), // uint64
+			},
+		)
+	}
+
+	if resources.MemoryHigh != 0 {
+		properties = append(properties, unitProperty{Name: "MemoryHigh", Value: dbus.MakeVariant(resources.MemoryHigh)})
+	}
+
+	if resources.MemoryReservation != 0 {
+		properties = append(properties, unitProperty{Name: "MemoryLow", Value: dbus.MakeVariant(resources.MemoryReservation)})
+	}
+
+	if resources.CPUs != 0 {
+		// CPUQuota=150% is expressed over D-Bus as 1.5s of CPU time per second
+		quota := uint64(resources.CPUs * 1000000)
+		properties = append(properties, unitProperty{Name: "CPUQuotaPerSecUSec", Value: dbus.MakeVariant(quota)})
+	}
+
+	if resources.PidsLimit != 0 {
+		properties = append(properties, unitProperty{Name: "TasksMax", Value: dbus.MakeVariant(resources.PidsLimit)})
+	}
+
+	return properties
+}
+
+func Manager(containerName, slice string, delegate bool, resources runConfig.Resources) (error, bool, string) {
+
+	if err := resources.Validate(); err != nil {
+		return err, false, ""
 	}
 
 	// Connect to the user's session bus
@@ -51,35 +93,38 @@ func Manager(containerName string, memoryBytes string) (error, bool, string) {
 	}
 
 	// The correct D-Bus signature is a(sv)
-	properties := []struct {
-		Name  string
-		Value dbus.Variant
-	}{
+	properties := []unitProperty{
 		// {
 		// 	Name:  "Description",
 		// 	Value: dbus.MakeVariant(fmt.Sprintf("Scope for %s", containerName)),
 		// },
-		{
-			Name:  "MemoryMax",
-			Value: dbus.MakeVariant(memBytes), // uint64
-		},
-		{
-			Name:  "MemorySwapMax",
-			Value: dbus.MakeVariant(memBytes), // uint64
-		},
 		{
 			Name:  "PIDs",
 			Value: dbus.MakeVariant([]uint32{uint32(os.Getpid())}),
 		},
+		{
+			// Group every container under one slice so their total usage can be capped
+			Name:  "Slice",
+			Value: dbus.MakeVariant(slice),
+		},
+	}
+	properties = append(properties, resourceProperties(resources)...)
+
+	if delegate {
+		// Let the container manage the cgroup subtree below its scope
+		properties = append(properties, unitProperty{Name: "Delegate", Value: dbus.MakeVariant(true)})
 	}
 
 	// For a(sa(sv)) — no auxiliary units
 	var aux []struct {
 		Name       string
-		Properties []struct {
-			Name  string
-			Value dbus.Variant
-		}
+		Properties []unitProperty
+	}
+
+	// Subscribe before queuing the job so its JobRemoved signal cannot be missed
+	signals, err := subscribeJobRemoved(conn, systemd)
+	if err != nil {
+		return err, false, ""
 	}
 
 	// Call StartTransientUnit
@@ -98,22 +143,20 @@ func Manager(containerName string, memoryBytes string) (error, bool, string) {
 		return fmt.Errorf("Failed to start transient unit: %v\n", err), false, ""
 	}
 
-	// Give systemd a moment to set up the cgroup
-	time.Sleep(500 * time.Millisecond)
+	// Wait for systemd to finish the start job, failing fast if it did not succeed
+	if err := waitForJob(signals, jobPath, unitName); err != nil {
+		return err, false, ""
+	}
 
-	// Find and verify the cgroup path
-	cgroupPath, err := findCgroupPath(containerName)
+	// Ask systemd for the exact cgroup it created for the scope
+	cgroupPath, err := unitCgroupPath(conn, systemd, unitName)
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Failed to find cgroup path: %v\n", err)
-	} else {
-		// Check memory.max
-		// log.Printf("%s is the cgroup path \n", cgroupPath)
-		_, err := readMemoryMax(cgroupPath)
-		if err != nil {
-			return fmt.Errorf("Failed to read memory.max: %v\n", err), false, ""
-		} else {
-			// log.Printf("Verified memory.max: %s\n", memoryMax)
-		}
+		return err, false, ""
+	}
+
+	// Check memory.max
+	if _, err := readMemoryMax(cgroupPath); err != nil {
+		return fmt.Errorf("Failed to read memory.max: %v\n", err), false, ""
 	}
 
 	return nil, false, cgroupPath
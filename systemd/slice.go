@@ -0,0 +1,80 @@
+package systemd
+
+import (
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"regexp"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// DefaultSlice is the slice containers are placed in unless --cgroup-parent says otherwise
+const DefaultSlice = "otala.slice"
+
+// sliceNamePattern matches valid systemd slice unit names
+var sliceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9:_.-]+\.slice$`)
+
+// ValidateSlice checks that name is usable as a systemd slice unit
+func ValidateSlice(name string) error {
+	if !sliceNamePattern.MatchString(name) || strings.HasPrefix(name, "-") || strings.Contains(name, "--") {
+		return fmt.Errorf("invalid slice name %q: expected something like otala.slice or otala-ci.slice", name)
+	}
+	return nil
+}
+
+// ConfigureSlice sets aggregate limits on a slice shared by many containers. The properties are
+// stored persistently by systemd so they survive the slice going idle between runs.
+func ConfigureSlice(slice string, limits runConfig.Resources) error {
+	if err := ValidateSlice(slice); err != nil {
+		return err
+	}
+
+	// Swap is left to the limits of the containers in the slice
+	limits.MemorySwap = runConfig.SwapUnlimited
+	properties := resourceProperties(limits)
+	if len(properties) == 0 {
+		return fmt.Errorf("no limits given for %s", slice)
+	}
+
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to session bus: %v", err)
+	}
+	defer func(conn *dbus.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	systemd := conn.Object(UserService, dbus.ObjectPath(UserPath))
+	if err := systemd.Call(UserInterface+".SetUnitProperties", 0, slice, false, properties).Err; err != nil {
+		return fmt.Errorf("failed to set properties on %s: %v", slice, err)
+	}
+	return nil
+}
+
+// SliceStats reads the aggregate resource usage of every container in a slice
+func SliceStats(slice string) (string, *Stats, error) {
+	if err := ValidateSlice(slice); err != nil {
+		return "", nil, err
+	}
+
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to connect to session bus: %v", err)
+	}
+	defer func(conn *dbus.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	systemd := conn.Object(UserService, dbus.ObjectPath(UserPath))
+	cgroupPath, err := unitCgroupPath(conn, systemd, slice)
+	if err != nil {
+		return "", nil, err
+	}
+
+	stats, err := ReadStats(cgroupPath)
+	if err != nil {
+		return cgroupPath, nil, err
+	}
+	return cgroupPath, stats, nil
+}
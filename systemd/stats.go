@@ -0,0 +1,128 @@
+package systemd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Stats is the resource usage of a container's scope, read from its cgroup v2 files
+type Stats struct {
+	MemoryPeak    uint64 `json:"memoryPeakBytes"`
+	CPUUsageUsec  uint64 `json:"cpuUsageUsec"`
+	CPUUserUsec   uint64 `json:"cpuUserUsec"`
+	CPUSystemUsec uint64 `json:"cpuSystemUsec"`
+	PidsPeak      uint64 `json:"pidsPeak"`
+	IOReadBytes   uint64 `json:"ioReadBytes"`
+	IOWriteBytes  uint64 `json:"ioWriteBytes"`
+	IOReadOps     uint64 `json:"ioReadOps"`
+	IOWriteOps    uint64 `json:"ioWriteOps"`
+}
+
+// ReadStats collects memory, cpu, pids and io usage from a cgroup directory.
+// Files missing on older kernels (memory.peak, pids.peak) are left at zero.
+func ReadStats(cgroupPath string) (*Stats, error) {
+	if cgroupPath == "" {
+		return nil, fmt.Errorf("cgroup path is empty")
+	}
+	if _, err := os.Stat(cgroupPath); err != nil {
+		return nil, fmt.Errorf("cgroup %s not available: %v", cgroupPath, err)
+	}
+
+	stats := &Stats{}
+	var err error
+
+	if stats.MemoryPeak, err = readCgroupUint(cgroupPath, "memory.peak"); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if stats.PidsPeak, err = readCgroupUint(cgroupPath, "pids.peak"); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cpuStat, err := readCgroupKeyValues(filepath.Join(cgroupPath, "cpu.stat"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	stats.CPUUsageUsec = cpuStat["usage_usec"]
+	stats.CPUUserUsec = cpuStat["user_usec"]
+	stats.CPUSystemUsec = cpuStat["system_usec"]
+
+	if err := readIOStat(cgroupPath, stats); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// readCgroupUint reads a cgroup file holding a single number
+func readCgroupUint(cgroupPath, file string) (uint64, error) {
+	content, err := os.ReadFile(filepath.Join(cgroupPath, file))
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+	return value, nil
+}
+
+// readCgroupKeyValues parses flat keyed files such as cpu.stat ("usage_usec 1234")
+func readCgroupKeyValues(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return map[string]uint64{}, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values, scanner.Err()
+}
+
+// readIOStat sums the per-device io.stat lines ("8:0 rbytes=1 wbytes=2 rios=3 wios=4 ...")
+func readIOStat(cgroupPath string, stats *Stats) error {
+	f, err := os.Open(filepath.Join(cgroupPath, "io.stat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for _, field := range fields[min(1, len(fields)):] {
+			key, rawValue, found := strings.Cut(field, "=")
+			if !found {
+				continue
+			}
+			value, err := strconv.ParseUint(rawValue, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				stats.IOReadBytes += value
+			case "wbytes":
+				stats.IOWriteBytes += value
+			case "rios":
+				stats.IOReadOps += value
+			case "wios":
+				stats.IOWriteOps += value
+			}
+		}
+	}
+	return scanner.Err()
+}
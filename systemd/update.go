@@ -0,0 +1,93 @@
+package systemd
+
+import (
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// cpuPeriodUsec is the cpu.max period used when writing CPU quotas directly
+const cpuPeriodUsec = 100000
+
+// UpdateResources changes the limits of a running container's scope. It asks systemd via
+// SetUnitProperties first and falls back to writing the cgroup files directly when the
+// user manager cannot be reached. It returns false when the container is not running.
+func UpdateResources(containerName, cgroupPath string, resources runConfig.Resources) (bool, error) {
+	if err := resources.Validate(); err != nil {
+		return false, err
+	}
+
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		if cgroupPath == "" {
+			return false, fmt.Errorf("failed to connect to session bus: %v", err)
+		}
+		if _, statErr := os.Stat(cgroupPath); statErr != nil {
+			return false, nil
+		}
+		return true, writeCgroupLimits(cgroupPath, resources)
+	}
+	defer func(conn *dbus.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	systemd := conn.Object(UserService, dbus.ObjectPath(UserPath))
+	unitName := fmt.Sprintf("%s.scope", containerName)
+
+	var unitPath dbus.ObjectPath
+	if err := systemd.Call(UserInterface+".GetUnit", 0, unitName).Store(&unitPath); err != nil {
+		// The scope only exists while the container runs
+		return false, nil
+	}
+
+	// runtime=true keeps the change out of persistent unit files; the scope is transient anyway
+	if err := systemd.Call(UserInterface+".SetUnitProperties", 0, unitName, true, resourceProperties(resources)).Err; err != nil {
+		return false, fmt.Errorf("failed to set properties on %s: %v", unitName, err)
+	}
+
+	return true, nil
+}
+
+// writeCgroupLimits applies the limits by writing the cgroup v2 interface files of the scope
+func writeCgroupLimits(cgroupPath string, resources runConfig.Resources) error {
+	limits := []struct {
+		file  string
+		value string
+	}{
+		{"memory.max", strconv.FormatUint(resources.Memory, 10)},
+		{"memory.swap.max", cgroupLimitValue(resources.SwapMax())},
+	}
+	if resources.MemoryHigh != 0 {
+		limits = append(limits, struct{ file, value string }{"memory.high", strconv.FormatUint(resources.MemoryHigh, 10)})
+	}
+	if resources.MemoryReservation != 0 {
+		limits = append(limits, struct{ file, value string }{"memory.low", strconv.FormatUint(resources.MemoryReservation, 10)})
+	}
+	if resources.CPUs != 0 {
+		quota := uint64(resources.CPUs * cpuPeriodUsec)
+		limits = append(limits, struct{ file, value string }{"cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriodUsec)})
+	}
+	if resources.PidsLimit != 0 {
+		limits = append(limits, struct{ file, value string }{"pids.max", strconv.FormatUint(resources.PidsLimit, 10)})
+	}
+
+	for _, limit := range limits {
+		path := filepath.Join(cgroupPath, limit.file)
+		if err := os.WriteFile(path, []byte(limit.value), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// cgroupLimitValue renders a limit for a cgroup file, where "max" means unlimited
+func cgroupLimitValue(value uint64) string {
+	if value == ^uint64(0) {
+		return "max"
+	}
+	return strconv.FormatUint(value, 10)
+}
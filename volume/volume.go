@@ -0,0 +1,240 @@
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	runConfig "github.com/Simeon2001/AlpineCell/config"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metadataFile sits next to a volume's data directory
+const metadataFile = "volume.json"
+
+// lockFile serializes creating, attaching and removing volumes between otala-box processes
+const lockFile = ".lock"
+
+// Volume is a directory kept outside any container, attached to containers with --volume
+type Volume struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Path is the directory holding the data, mounted into containers
+	Path string `json:"-"`
+}
+
+// Store keeps every volume under <data>/volumes/<name>, its data in a data directory
+type Store struct {
+	dir string
+}
+
+// NewStore opens the volume store in the runtime data directory, creating it if needed
+func NewStore() (*Store, error) {
+	dataDir, _, err := runConfig.RuntimePaths()
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{dir: filepath.Join(dataDir, "volumes")}
+	if err := os.MkdirAll(store.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create volume store: %v", err)
+	}
+	return store, nil
+}
+
+// volumeDir returns where the volume name is kept
+func (s *Store) volumeDir(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// lock takes the volume store lock and returns its release
+func (s *Store) lock() (func(), error) {
+	file, err := os.OpenFile(filepath.Join(s.dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open volume store lock: %v", err)
+	}
+	for {
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock volume store: %v", err)
+	}
+
+	return func() {
+		_ = unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// Create makes a new empty volume. Its data directory belongs to the user running otala-box,
+// which is root inside the containers it is attached to.
+func (s *Store) Create(name string) (*Volume, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.create(name)
+}
+
+// create makes a new empty volume, the store lock is held by the caller
+func (s *Store) create(name string) (*Volume, error) {
+	if err := runConfig.ValidateVolumeName(name); err != nil {
+		return nil, err
+	}
+	dir := s.volumeDir(name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("volume %s already exists", name)
+		}
+		return nil, fmt.Errorf("failed to create volume %s: %v", name, err)
+	}
+
+	vol := &Volume{Name: name, Created: time.Now(), Path: filepath.Join(dir, "data")}
+	data, err := json.MarshalIndent(vol, "", "  ")
+	if err == nil {
+		err = os.Mkdir(vol.Path, 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, metadataFile), data, 0644)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create volume %s: %v", name, err)
+	}
+	return vol, nil
+}
+
+// Get loads the volume name
+func (s *Store) Get(name string) (*Volume, error) {
+	if err := runConfig.ValidateVolumeName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(s.volumeDir(name), metadataFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no such volume: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var vol Volume
+	if err := json.Unmarshal(data, &vol); err != nil {
+		return nil, fmt.Errorf("failed to parse volume %s: %v", name, err)
+	}
+	vol.Path = filepath.Join(s.volumeDir(name), "data")
+	return &vol, nil
+}
+
+// List returns every volume, sorted by name
+func (s *Store) List() ([]*Volume, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var volumes []*Volume
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		vol, err := s.Get(entry.Name())
+		if err != nil {
+			continue
+		}
+		volumes = append(volumes, vol)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// Attach fills in the source of mounts, creating the volumes that do not exist yet, and calls record
+// while still holding the store lock, so a volume cannot be removed before its user is recorded.
+// It returns the names of the volumes it created; those are removed again when record fails.
+func (s *Store) Attach(mounts []runConfig.VolumeMount, record func() error) ([]string, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var created []string
+	undo := func() {
+		for _, name := range created {
+			_ = s.remove(name)
+		}
+	}
+	for i := range mounts {
+		vol, err := s.Get(mounts[i].Name)
+		if err != nil {
+			if vol, err = s.create(mounts[i].Name); err != nil {
+				undo()
+				return nil, err
+			}
+			created = append(created, vol.Name)
+		}
+		mounts[i].Source = vol.Path
+	}
+	if err := record(); err != nil {
+		undo()
+		return nil, err
+	}
+	return created, nil
+}
+
+// Remove deletes a volume and its data, refusing while a container uses it
+func (s *Store) Remove(name string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := s.Get(name); err != nil {
+		return err
+	}
+	users, err := Users(name)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("volume %s is used by %s, remove or rerun those containers without it first", name, strings.Join(users, ", "))
+	}
+	return s.remove(name)
+}
+
+// remove deletes a volume and its data, the store lock is held by the caller
+func (s *Store) remove(name string) error {
+	// Drop the metadata first so a partly removed volume no longer shows up
+	dir := s.volumeDir(name)
+	if err := os.Remove(filepath.Join(dir, metadataFile)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove volume %s: %v", name, err)
+	}
+	return nil
+}
+
+// Users returns the names of the containers whose last run attached the volume name
+func Users(name string) ([]string, error) {
+	containers, err := runConfig.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, state := range containers {
+		for _, mount := range state.Volumes {
+			if mount.Name == name {
+				users = append(users, state.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}